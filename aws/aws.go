@@ -0,0 +1,175 @@
+// Package aws provides aws-sdk-go-v2 middleware that rate limits calls to AWS APIs using leaky
+// buckets from any leakybucket.Storage. Sharing a redis or dynamodb storage between hosts keeps a
+// whole fleet within AWS API quotas that are shared across hosts, such as the SES send rate.
+//
+// Usage:
+//
+//	limiter := leakybucketAWS.New(storage,
+//		leakybucketAWS.WithLimit("SESv2", "SendEmail", 14, time.Second),
+//		leakybucketAWS.WithWait(5*time.Second))
+//	client := sesv2.NewFromConfig(cfg, func(o *sesv2.Options) {
+//		o.APIOptions = append(o.APIOptions, limiter.AddToStack)
+//	})
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// KeyFunc returns the name of the bucket a call is charged to. scope is the service ID for limits
+// of a whole service, e.g. "DynamoDB", or the service ID and operation separated by a colon for
+// limits of a single operation, e.g. "SESv2:SendEmail".
+type KeyFunc func(ctx context.Context, scope string) string
+
+// CostFunc returns how much a call adds to its bucket, e.g. the number of recipients of an email.
+// input is the operation's input, e.g. *sesv2.SendEmailInput.
+type CostFunc func(ctx context.Context, service, operation string, input interface{}) uint
+
+// LimitedError is returned for calls that weren't made because their bucket was full. It matches
+// leakybucket.ErrorFull using errors.Is.
+type LimitedError struct {
+	Service, Operation string
+	// State is the state of the bucket when the call was given up on.
+	State leakybucket.BucketState
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limit of %s %s exceeded until %s", e.Service, e.Operation, e.State.Reset.Format(time.RFC3339))
+}
+
+// Unwrap returns leakybucket.ErrorFull.
+func (e *LimitedError) Unwrap() error {
+	return leakybucket.ErrorFull
+}
+
+type limit struct {
+	capacity uint
+	rate     time.Duration
+}
+
+// Limiter rate limits calls made by AWS SDK clients.
+type Limiter struct {
+	storage  leakybucket.Storage
+	limits   map[string]limit
+	fallback *limit
+	key      KeyFunc
+	cost     CostFunc
+	maxWait  time.Duration
+}
+
+// Option configures optional behavior of a Limiter.
+type Option func(*Limiter)
+
+// WithLimit limits calls to an operation of a service, identified by its service ID, e.g.
+// "DynamoDB" or "SESv2", to capacity per rate. An empty operation limits all calls to the
+// service together. Limits of an operation take precedence over limits of its service.
+func WithLimit(service, operation string, capacity uint, rate time.Duration) Option {
+	return func(l *Limiter) {
+		l.limits[scope(service, operation)] = limit{capacity, rate}
+	}
+}
+
+// WithDefaultLimit limits calls to each operation without a limit of its own or of its service to
+// capacity per rate. By default such calls aren't limited.
+func WithDefaultLimit(capacity uint, rate time.Duration) Option {
+	return func(l *Limiter) {
+		l.fallback = &limit{capacity, rate}
+	}
+}
+
+// WithKey sets how calls are mapped to buckets. By default calls are charged to a bucket per scope
+// and region, e.g. "aws:us-west-1:SESv2:SendEmail".
+func WithKey(key KeyFunc) Option {
+	return func(l *Limiter) {
+		l.key = key
+	}
+}
+
+// WithCost sets how much each call adds to its bucket. By default every call adds 1.
+func WithCost(cost CostFunc) Option {
+	return func(l *Limiter) {
+		l.cost = cost
+	}
+}
+
+// WithWait makes calls whose bucket is full wait for it to drain, for up to max in total, rather
+// than fail immediately. Calls also stop waiting when their context is done.
+func WithWait(max time.Duration) Option {
+	return func(l *Limiter) {
+		l.maxWait = max
+	}
+}
+
+// New creates a Limiter.
+func New(storage leakybucket.Storage, opts ...Option) *Limiter {
+	l := &Limiter{
+		storage: storage,
+		limits:  map[string]limit{},
+		key: func(ctx context.Context, scope string) string {
+			return "aws:" + awsmiddleware.GetRegion(ctx) + ":" + scope
+		},
+		cost: func(context.Context, string, string, interface{}) uint { return 1 },
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+func scope(service, operation string) string {
+	if operation == "" {
+		return service
+	}
+	return service + ":" + operation
+}
+
+// MiddlewareID is the ID of the Limiter's middleware in the initialize step of the stack.
+const MiddlewareID = "LeakybucketRateLimit"
+
+// AddToStack adds the Limiter's middleware to a client's middleware stack. It's meant to be
+// appended to the APIOptions of a client's options. Calls are charged once, before they're
+// serialized, however many times the SDK retries them.
+func (l *Limiter) AddToStack(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(MiddlewareID, l.handle), middleware.After)
+}
+
+func (l *Limiter) handle(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+	s, lim, ok := l.limit(service, operation)
+	if !ok {
+		return next.HandleInitialize(ctx, in)
+	}
+	name := l.key(ctx, s)
+	amount := l.cost(ctx, service, operation, in.Parameters)
+	bucket, err := leakybucket.CreateContext(ctx, l.storage, name, lim.capacity, lim.rate)
+	if err != nil {
+		return middleware.InitializeOutput{}, middleware.Metadata{}, err
+	}
+	state, err := leakybucket.Wait(ctx, bucket, amount, l.maxWait)
+	if err == leakybucket.ErrorFull {
+		return middleware.InitializeOutput{}, middleware.Metadata{}, &LimitedError{Service: service, Operation: operation, State: state}
+	} else if err != nil {
+		return middleware.InitializeOutput{}, middleware.Metadata{}, err
+	}
+	return next.HandleInitialize(ctx, in)
+}
+
+// limit returns the scope and limit of calls to an operation.
+func (l *Limiter) limit(service, operation string) (string, limit, bool) {
+	if lim, ok := l.limits[scope(service, operation)]; ok {
+		return scope(service, operation), lim, true
+	}
+	if lim, ok := l.limits[service]; ok {
+		return service, lim, true
+	}
+	if l.fallback != nil {
+		return scope(service, operation), *l.fallback, true
+	}
+	return "", limit{}, false
+}
@@ -0,0 +1,128 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	sdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHTTP answers every request with an empty JSON object, counting requests.
+type fakeHTTP struct {
+	requests int
+}
+
+func (f *fakeHTTP) Do(r *http.Request) (*http.Response, error) {
+	f.requests++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader("{}")),
+		Request:    r,
+	}, nil
+}
+
+func client(l *Limiter, h *fakeHTTP) *dynamodb.Client {
+	return dynamodb.New(dynamodb.Options{
+		Region:      "us-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		HTTPClient:  h,
+		APIOptions:  []func(*middleware.Stack) error{l.AddToStack},
+	})
+}
+
+func TestLimit(t *testing.T) {
+	h := &fakeHTTP{}
+	c := client(New(memory.New(), WithLimit("DynamoDB", "ListTables", 2, time.Minute)), h)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := c.ListTables(ctx, &dynamodb.ListTablesInput{})
+		require.NoError(t, err)
+	}
+	_, err := c.ListTables(ctx, &dynamodb.ListTablesInput{})
+	require.True(t, errors.Is(err, leakybucket.ErrorFull), err)
+	var limited *LimitedError
+	require.True(t, errors.As(err, &limited))
+	require.Equal(t, "DynamoDB", limited.Service)
+	require.Equal(t, "ListTables", limited.Operation)
+	require.Equal(t, 2, h.requests)
+
+	// other operations aren't limited
+	for i := 0; i < 3; i++ {
+		_, err := c.DescribeLimits(ctx, &dynamodb.DescribeLimitsInput{})
+		require.NoError(t, err)
+	}
+}
+
+func TestServiceLimit(t *testing.T) {
+	storage := memory.New()
+	var names []string
+	l := New(storage,
+		WithLimit("DynamoDB", "", 2, time.Minute),
+		WithLimit("DynamoDB", "DescribeLimits", 1, time.Minute),
+		WithKey(func(ctx context.Context, scope string) string {
+			names = append(names, scope)
+			return scope
+		}))
+	c := client(l, &fakeHTTP{})
+	ctx := context.Background()
+
+	_, err := c.ListTables(ctx, &dynamodb.ListTablesInput{})
+	require.NoError(t, err)
+	_, err = c.DescribeEndpoints(ctx, &dynamodb.DescribeEndpointsInput{})
+	require.NoError(t, err)
+	_, err = c.ListTables(ctx, &dynamodb.ListTablesInput{})
+	require.True(t, errors.Is(err, leakybucket.ErrorFull))
+
+	_, err = c.DescribeLimits(ctx, &dynamodb.DescribeLimitsInput{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"DynamoDB", "DynamoDB", "DynamoDB", "DynamoDB:DescribeLimits"}, names)
+}
+
+func TestCostAndDefault(t *testing.T) {
+	l := New(memory.New(), WithDefaultLimit(10, time.Minute), WithCost(func(ctx context.Context, service, operation string, input interface{}) uint {
+		if in, ok := input.(*dynamodb.ListTablesInput); ok && in.Limit != nil {
+			return uint(*in.Limit)
+		}
+		return 1
+	}))
+	c := client(l, &fakeHTTP{})
+	ctx := context.Background()
+
+	_, err := c.ListTables(ctx, &dynamodb.ListTablesInput{Limit: sdk.Int32(6)})
+	require.NoError(t, err)
+	_, err = c.ListTables(ctx, &dynamodb.ListTablesInput{Limit: sdk.Int32(6)})
+	require.True(t, errors.Is(err, leakybucket.ErrorFull))
+	_, err = c.DescribeLimits(ctx, &dynamodb.DescribeLimitsInput{})
+	require.NoError(t, err)
+}
+
+func TestWait(t *testing.T) {
+	l := New(memory.New(), WithDefaultLimit(1, 200*time.Millisecond), WithWait(time.Second))
+	c := client(l, &fakeHTTP{})
+	ctx := context.Background()
+
+	_, err := c.ListTables(ctx, &dynamodb.ListTablesInput{})
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = c.ListTables(ctx, &dynamodb.ListTablesInput{})
+	require.NoError(t, err)
+	require.True(t, time.Since(start) > 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = c.ListTables(ctx, &dynamodb.ListTablesInput{})
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+}
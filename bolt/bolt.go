@@ -0,0 +1,391 @@
+/*
+Package bolt provides a leaky bucket implementation backed by a bbolt file, for tools that need
+buckets to persist across runs without a server.
+
+Every Add is a read-write transaction of the file, so a Storage is safe to use from several
+goroutines, but bbolt locks the file for a single process at a time.
+*/
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+	_ leakybucket.ContextBucket  = &bucket{}
+	_ leakybucket.Releaser       = &bucket{}
+)
+
+// record is the value a bucket is stored as: how much was added to it in its current window, its
+// configuration, and when it drains, as big-endian 64-bit integers.
+type record struct {
+	used, capacity uint64
+	rate           time.Duration
+	reset          time.Time
+}
+
+const recordSize = 32
+
+func decodeRecord(data []byte) (*record, bool) {
+	if len(data) != recordSize {
+		return nil, false
+	}
+	return &record{
+		used:     binary.BigEndian.Uint64(data[0:]),
+		capacity: binary.BigEndian.Uint64(data[8:]),
+		rate:     time.Duration(binary.BigEndian.Uint64(data[16:])),
+		reset:    time.Unix(0, int64(binary.BigEndian.Uint64(data[24:]))),
+	}, true
+}
+
+func (r *record) encode() []byte {
+	data := make([]byte, recordSize)
+	binary.BigEndian.PutUint64(data[0:], r.used)
+	binary.BigEndian.PutUint64(data[8:], r.capacity)
+	binary.BigEndian.PutUint64(data[16:], uint64(r.rate))
+	binary.BigEndian.PutUint64(data[24:], uint64(r.reset.UnixNano()))
+	return data
+}
+
+func (r *record) state() leakybucket.BucketState {
+	return leakybucket.BucketState{
+		Capacity:  uint(r.capacity),
+		Remaining: uint(r.capacity - min(r.used, r.capacity)),
+		Reset:     r.reset,
+	}
+}
+
+func (r *record) mismatch(name string, capacity uint, rate time.Duration) error {
+	if r.capacity == uint64(capacity) && r.rate == rate {
+		return nil
+	}
+	return &leakybucket.ConfigMismatchError{
+		Name:              name,
+		Capacity:          uint(r.capacity),
+		Rate:              r.rate,
+		RequestedCapacity: capacity,
+		RequestedRate:     rate,
+	}
+}
+
+type bucket struct {
+	name     string
+	capacity uint
+	rate     time.Duration
+	storage  *Storage
+	mutex    sync.Mutex
+	state    leakybucket.BucketState
+}
+
+// Capacity of the bucket.
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Reset
+}
+
+// update sets the local state of the bucket, unless an error left it unknown.
+func (b *bucket) update(state leakybucket.BucketState, err error) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil || state.Capacity != 0 {
+		b.state = leakybucket.BucketState{Capacity: b.capacity, Remaining: state.Remaining, Reset: state.Reset}
+	}
+	return b.state, err
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket. Transactions of bbolt can't be canceled, so ctx is unused.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	var state leakybucket.BucketState
+	err := b.storage.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		state, err = b.storage.add(tx, b.name, amount, b.capacity, b.rate)
+		return err
+	})
+	return b.update(state, err)
+}
+
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	s := b.storage
+	var state leakybucket.BucketState
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		r := s.get(tx, b.name)
+		if r == nil {
+			state = leakybucket.BucketState{Capacity: b.capacity, Remaining: b.capacity, Reset: time.Now().Add(b.rate)}
+			return nil
+		}
+		state = r.state()
+		if !r.reset.Equal(reset) || r.mismatch(b.name, b.capacity, b.rate) != nil || time.Now().After(r.reset) {
+			return nil
+		}
+		r.used -= min(uint64(amount), r.used)
+		state = r.state()
+		return s.put(tx, b.name, r)
+	})
+	return b.update(state, err)
+}
+
+// Storage is a bbolt-based, thread-safe leaky bucket factory.
+type Storage struct {
+	db          *bbolt.DB
+	bucket      []byte
+	reconfigure bool
+	usage       leakybucket.UsageMode
+	cleanup     time.Duration
+	onCleanup   func(deleted int, err error)
+	stop        chan struct{}
+	stopped     sync.WaitGroup
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithBucket sets the name of the bbolt bucket holding the leaky buckets. The default is
+// "leakybucket".
+func WithBucket(name string) Option {
+	return func(s *Storage) {
+		s.bucket = []byte(name)
+	}
+}
+
+// WithReconfigure makes Create store the requested capacity and rate with a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
+}
+
+// WithCleanup deletes the buckets that have drained every interval, until the storage is closed,
+// calling onCleanup, if not nil, with the outcome. By default drained buckets stay in the file
+// until DeleteExpired is called.
+func WithCleanup(interval time.Duration, onCleanup func(deleted int, err error)) Option {
+	return func(s *Storage) {
+		s.cleanup = interval
+		s.onCleanup = onCleanup
+	}
+}
+
+// New opens, or creates, the bbolt file at path to store buckets in. Close the storage once done
+// with it to release the file.
+func New(path string, opts ...Option) (*Storage, error) {
+	s := &Storage{
+		bucket: []byte("leakybucket"),
+		stop:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.db = db
+	if s.cleanup > 0 {
+		s.stopped.Add(1)
+		go s.cleanupLoop()
+	}
+	return s, nil
+}
+
+// Close stops cleaning up and closes the bbolt file. Calling it again returns the same result.
+func (s *Storage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.stopped.Wait()
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
+}
+
+func (s *Storage) cleanupLoop() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.cleanup)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			deleted, err := s.DeleteExpired()
+			if s.onCleanup != nil {
+				s.onCleanup(deleted, err)
+			}
+		}
+	}
+}
+
+// DeleteExpired deletes the buckets that have drained, and returns how many it deleted.
+func (s *Storage) DeleteExpired() (int, error) {
+	var expired [][]byte
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		b := tx.Bucket(s.bucket)
+		if err := b.ForEach(func(k, v []byte) error {
+			if r, ok := decodeRecord(v); !ok || now.After(r.reset) {
+				expired = append(expired, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// get reads a bucket, returning nil if it doesn't exist.
+func (s *Storage) get(tx *bbolt.Tx, name string) *record {
+	r, ok := decodeRecord(tx.Bucket(s.bucket).Get([]byte(name)))
+	if !ok {
+		return nil
+	}
+	return r
+}
+
+func (s *Storage) put(tx *bbolt.Tx, name string, r *record) error {
+	return tx.Bucket(s.bucket).Put([]byte(name), r.encode())
+}
+
+// add adds to a bucket if there is space for it, creating the bucket or starting a new window if
+// needed.
+func (s *Storage) add(tx *bbolt.Tx, name string, amount, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	now := time.Now()
+	r := s.get(tx, name)
+	if r != nil {
+		if err := r.mismatch(name, capacity, rate); err != nil {
+			return r.state(), err
+		}
+	}
+	if r == nil || now.After(r.reset) {
+		r = &record{capacity: uint64(capacity), rate: rate, reset: now.Add(rate)}
+	}
+	if r.used+uint64(amount) > r.capacity {
+		return r.state(), leakybucket.ErrorFull
+	}
+	r.used += uint64(amount)
+	if err := s.put(tx, name, r); err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	return r.state(), nil
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket. Transactions of bbolt can't be canceled, so ctx is unused.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	var state leakybucket.BucketState
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		// adding 0 creates the bucket, or starts a new window if it has drained
+		state, err = s.add(tx, name, 0, capacity, rate)
+		if err != nil && s.reconfigure && errors.Is(err, leakybucket.ErrConfigMismatch) {
+			state, err = s.updateLimits(tx, name, capacity, rate)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{
+		name:     name,
+		capacity: capacity,
+		rate:     rate,
+		storage:  s,
+		state:    state,
+	}, nil
+}
+
+// updateLimits stores a new configuration with a bucket, carrying over its used space and the
+// start of its window.
+func (s *Storage) updateLimits(tx *bbolt.Tx, name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	now := time.Now()
+	r := s.get(tx, name)
+	if r == nil {
+		return leakybucket.BucketState{Capacity: capacity, Remaining: capacity, Reset: now.Add(rate)}, nil
+	}
+	var used uint
+	reset := r.reset
+	if !now.After(reset) {
+		used = s.usage.Carry(uint(r.used), uint(r.capacity), capacity)
+		// the window keeps its start
+		reset = reset.Add(rate - r.rate)
+	}
+	if now.After(reset) {
+		// the bucket drained under the new rate
+		used = 0
+		reset = now.Add(rate)
+	}
+	r = &record{used: uint64(used), capacity: uint64(capacity), rate: rate, reset: reset}
+	if err := s.put(tx, name, r); err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	return r.state(), nil
+}
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	var state leakybucket.BucketState
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		state, err = s.updateLimits(tx, name, capacity, rate)
+		return err
+	})
+	return state, err
+}
@@ -0,0 +1,117 @@
+package bolt
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+func testStorage(t *testing.T, opts ...Option) *Storage {
+	s, err := New(filepath.Join(t.TempDir(), "leakybucket.db"), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(testStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(testStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(testStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	test.AddResetTest(testStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(testStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	test.BucketInstanceConsistencyTest(testStorage(t))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(testStorage(t))(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	test.ReconfigureTest(testStorage(t, WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(testStorage(t))(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	test.UpdateLimitsProportionalTest(testStorage(t, WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	test.ReleaseTest(testStorage(t))(t)
+}
+
+// package specific tests
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leakybucket.db")
+	s, err := New(path)
+	require.NoError(t, err)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(4)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = New(path)
+	require.NoError(t, err)
+	defer s.Close()
+	bucket, err = s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(6), bucket.Remaining())
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s := testStorage(t)
+	_, err := s.Create("short", 10, time.Millisecond)
+	require.NoError(t, err)
+	_, err = s.Create("long", 10, time.Minute)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	deleted, err := s.DeleteExpired()
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+}
+
+func TestCleanup(t *testing.T) {
+	var deleted atomic.Int64
+	s := testStorage(t, WithCleanup(10*time.Millisecond, func(n int, err error) {
+		require.NoError(t, err)
+		deleted.Add(int64(n))
+	}))
+	for _, name := range []string{"a", "b", "c"} {
+		_, err := s.Create(name, 10, time.Millisecond)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return deleted.Load() == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCloseTwice(t *testing.T) {
+	s, err := New(filepath.Join(t.TempDir(), "leakybucket.db"), WithCleanup(time.Millisecond, nil))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+}
@@ -0,0 +1,18 @@
+module github.com/Clever/leakybucket/bolt/v2
+
+go 1.24
+
+require (
+	github.com/Clever/leakybucket/v2 v2.0.0
+	github.com/stretchr/testify v1.10.0
+	go.etcd.io/bbolt v1.4.3
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/Clever/leakybucket/v2 => ../
@@ -0,0 +1,197 @@
+// Package breaker provides a leakybucket.Storage decorator that stops calling a failing or slow
+// storage, such as an unreachable redis, for a while, rather than have every request wait for it
+// to time out.
+//
+// The circuit breaker opens after a number of failures, each within the open timeout of the
+// previous one. Calls that take longer than the latency threshold count as failures, even when
+// they succeed. While open, operations fail immediately with an *OpenError. Once the open timeout
+// has passed, the breaker half-opens and lets calls through to probe the storage: it closes once
+// enough of them succeed, and opens again as soon as one fails.
+//
+// Combine it with the fallback package to decide what happens to requests while the breaker is
+// open:
+//
+//	storage := fallback.New(breaker.New(redisStorage, breaker.WithLatencyThreshold(50*time.Millisecond)),
+//		fallback.WithDefaultPolicy(fallback.Local(0.1)))
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/eapache/go-resiliency/breaker"
+)
+
+// ErrOpen matches, using errors.Is, the errors of operations short-circuited by an open breaker.
+var ErrOpen = errors.New("circuit breaker open")
+
+// OpenError is returned by operations short-circuited by an open breaker.
+type OpenError struct {
+	// Name of the bucket the operation was on.
+	Name string
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open, not calling the storage for bucket %q", e.Name)
+}
+
+// Is makes errors.Is(err, ErrOpen) true for an *OpenError.
+func (e *OpenError) Is(target error) bool {
+	return target == ErrOpen
+}
+
+// errSlow is what slow calls report to the breaker.
+var errSlow = errors.New("slow call")
+
+// Breaker short-circuits the operations of a storage through its Middleware.
+type Breaker struct {
+	breaker   *breaker.Breaker
+	latency   time.Duration
+	isFailure func(error) bool
+}
+
+// Storage wraps a leakybucket.Storage with a circuit breaker.
+type Storage struct {
+	leakybucket.ChainedStorage
+	*Breaker
+}
+
+type config struct {
+	failures, successes int
+	timeout             time.Duration
+	latency             time.Duration
+	isFailure           func(error) bool
+}
+
+// Option configures optional behavior of a Breaker.
+type Option func(*config)
+
+// WithFailureThreshold sets how many failures open the breaker. The default is 5.
+func WithFailureThreshold(n int) Option {
+	return func(c *config) {
+		c.failures = n
+	}
+}
+
+// WithSuccessThreshold sets how many successful calls close a half-open breaker. The default is 1.
+func WithSuccessThreshold(n int) Option {
+	return func(c *config) {
+		c.successes = n
+	}
+}
+
+// WithOpenTimeout sets how long the breaker stays open before half-opening, and how close failures
+// must be to count towards opening it. The default is 5 seconds.
+func WithOpenTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithLatencyThreshold makes calls taking longer than d count as failures. By default latency
+// doesn't matter.
+func WithLatencyThreshold(d time.Duration) Option {
+	return func(c *config) {
+		c.latency = d
+	}
+}
+
+// WithFailureClassifier sets which errors count as failures. By default every error does, but
+// leakybucket.ErrorFull and errors matching leakybucket.ErrConfigMismatch or errors.ErrUnsupported.
+func WithFailureClassifier(isFailure func(error) bool) Option {
+	return func(c *config) {
+		c.isFailure = isFailure
+	}
+}
+
+// New wraps a storage with a circuit breaker.
+func New(storage leakybucket.Storage, opts ...Option) *Storage {
+	b := NewBreaker(opts...)
+	return &Storage{
+		ChainedStorage: leakybucket.Chain(storage, b.Middleware()),
+		Breaker:        b,
+	}
+}
+
+// NewBreaker creates the Breaker used by New, to wrap a storage of one's own making with
+// Middleware and leakybucket.Chain.
+func NewBreaker(opts ...Option) *Breaker {
+	c := &config{
+		failures:  5,
+		successes: 1,
+		timeout:   5 * time.Second,
+		isFailure: func(err error) bool {
+			return err != leakybucket.ErrorFull && !errors.Is(err, leakybucket.ErrConfigMismatch) &&
+				!errors.Is(err, errors.ErrUnsupported)
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return &Breaker{
+		breaker:   breaker.New(c.failures, c.successes, c.timeout),
+		latency:   c.latency,
+		isFailure: c.isFailure,
+	}
+}
+
+// run calls work through the breaker, returning its error or an *OpenError.
+func (b *Breaker) run(name string, work func() error) error {
+	var err error
+	result := b.breaker.Run(func() error {
+		start := time.Now()
+		err = work()
+		if err != nil && b.isFailure(err) {
+			return err
+		} else if b.latency > 0 && time.Since(start) > b.latency {
+			return errSlow
+		}
+		return nil
+	})
+	if result == breaker.ErrBreakerOpen {
+		return &OpenError{Name: name}
+	}
+	return err
+}
+
+// Middleware short-circuits the operations of a storage and its buckets while the breaker is open.
+func (b *Breaker) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				var bucket leakybucket.Bucket
+				err := b.run(spec.Name, func() (err error) {
+					bucket, err = next(ctx, spec)
+					return err
+				})
+				if err != nil {
+					return nil, err
+				}
+				return bucket, nil
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				var state leakybucket.BucketState
+				err := b.run(spec.Name, func() (err error) {
+					state, err = next(ctx, spec, amount)
+					return err
+				})
+				return state, err
+			}
+		},
+		UpdateLimits: func(next leakybucket.UpdateLimitsFunc) leakybucket.UpdateLimitsFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.BucketState, error) {
+				var state leakybucket.BucketState
+				err := b.run(spec.Name, func() (err error) {
+					state, err = next(ctx, spec)
+					return err
+				})
+				return state, err
+			}
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package breaker
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+var errDown = errors.New("connection refused")
+
+// flaky is a storage whose buckets fail while it's down, and take delay to answer.
+type flaky struct {
+	leakybucket.Storage
+	down  *atomic.Bool
+	delay *atomic.Int64
+	calls *atomic.Int64
+}
+
+type flakyBucket struct {
+	leakybucket.Bucket
+	flaky
+}
+
+func newFlaky() flaky {
+	return flaky{Storage: memory.New(), down: &atomic.Bool{}, delay: &atomic.Int64{}, calls: &atomic.Int64{}}
+}
+
+func (f flaky) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, err := f.Storage.Create(name, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+	return flakyBucket{b, f}, nil
+}
+
+func (b flakyBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	b.calls.Add(1)
+	time.Sleep(time.Duration(b.delay.Load()))
+	if b.down.Load() {
+		return leakybucket.BucketState{}, errDown
+	}
+	return b.Bucket.Add(amount)
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New()))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New(memory.New()))(t)
+}
+
+func TestOpensOnFailures(t *testing.T) {
+	primary := newFlaky()
+	s := New(primary, WithFailureThreshold(3), WithOpenTimeout(100*time.Millisecond))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+
+	primary.down.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err := bucket.Add(1)
+		require.Equal(t, errDown, err)
+	}
+	_, err = bucket.Add(1)
+	require.ErrorIs(t, err, ErrOpen)
+	var openErr *OpenError
+	require.ErrorAs(t, err, &openErr)
+	require.Equal(t, "testbucket", openErr.Name)
+	require.Equal(t, int64(3), primary.calls.Load(), "an open breaker shouldn't call the storage")
+
+	// half-open: a failed probe opens the breaker again
+	time.Sleep(150 * time.Millisecond)
+	_, err = bucket.Add(1)
+	require.Equal(t, errDown, err)
+	_, err = bucket.Add(1)
+	require.ErrorIs(t, err, ErrOpen)
+
+	// half-open: a successful probe closes it
+	primary.down.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		_, err = bucket.Add(1)
+		require.NoError(t, err)
+	}
+}
+
+func TestFullIsNotAFailure(t *testing.T) {
+	s := New(newFlaky(), WithFailureThreshold(1))
+	bucket, err := s.Create("testbucket", 1, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := bucket.Add(1)
+		require.Equal(t, leakybucket.ErrorFull, err)
+	}
+}
+
+func TestOpensOnLatency(t *testing.T) {
+	primary := newFlaky()
+	s := New(primary, WithFailureThreshold(2), WithLatencyThreshold(20*time.Millisecond))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+
+	primary.delay.Store(int64(50 * time.Millisecond))
+	for i := 0; i < 2; i++ {
+		// slow calls still return their result
+		state, err := bucket.Add(1)
+		require.NoError(t, err)
+		require.Equal(t, uint(100-2-i), state.Remaining)
+	}
+	start := time.Now()
+	_, err = bucket.Add(1)
+	require.ErrorIs(t, err, ErrOpen)
+	require.True(t, time.Since(start) < 20*time.Millisecond)
+}
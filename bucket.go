@@ -2,14 +2,42 @@ package leakybucket
 
 import (
 	"errors"
+	"fmt"
 	"time"
 )
 
 var (
 	// ErrorFull is returned when the amount requested to add exceeds the remaining space in the bucket.
 	ErrorFull = errors.New("add exceeds free capacity")
+
+	// ErrConfigMismatch is matched by errors returned when a bucket already exists with a different
+	// capacity or rate than requested. Use errors.Is to check for it, the error itself is a
+	// *ConfigMismatchError.
+	ErrConfigMismatch = errors.New("bucket exists with a different capacity or rate")
 )
 
+// ConfigMismatchError is returned when a bucket already exists with a different capacity or rate
+// than requested.
+type ConfigMismatchError struct {
+	Name string
+	// Capacity and Rate the bucket exists with.
+	Capacity uint
+	Rate     time.Duration
+	// RequestedCapacity and RequestedRate are what the caller asked for.
+	RequestedCapacity uint
+	RequestedRate     time.Duration
+}
+
+func (e *ConfigMismatchError) Error() string {
+	return fmt.Sprintf("bucket %q exists with capacity %d and rate %s, requested capacity %d and rate %s",
+		e.Name, e.Capacity, e.Rate, e.RequestedCapacity, e.RequestedRate)
+}
+
+// Is makes errors.Is(err, ErrConfigMismatch) true for a *ConfigMismatchError.
+func (e *ConfigMismatchError) Is(target error) bool {
+	return target == ErrConfigMismatch
+}
+
 // Bucket interface for interacting with leaky buckets: https://en.wikipedia.org/wiki/Leaky_bucket
 type Bucket interface {
 	// Capacity of the bucket.
@@ -25,6 +53,15 @@ type Bucket interface {
 	Add(uint) (BucketState, error)
 }
 
+// Releaser is implemented by buckets that can give back space added to them, e.g. space reserved
+// ahead of time but left unused.
+type Releaser interface {
+	// Release removes up to amount from what was added to the bucket in the window ending at reset,
+	// as returned by Add, and returns the bucket state after releasing. A bucket that has drained
+	// since, or whose limits have changed, is left alone.
+	Release(amount uint, reset time.Time) (BucketState, error)
+}
+
 // BucketState is a snapshot of a bucket's properties.
 type BucketState struct {
 	Capacity  uint
@@ -36,5 +73,54 @@ type BucketState struct {
 type Storage interface {
 	// Create a bucket with a name, capacity, and rate.
 	// rate is how long it takes for full capacity to drain.
+	// If the bucket already exists with a different capacity or rate, Create returns an error
+	// matching ErrConfigMismatch unless the storage was configured to reconfigure buckets.
 	Create(name string, capacity uint, rate time.Duration) (Bucket, error)
 }
+
+// LimitUpdater is implemented by storages that can change the limits of existing buckets.
+type LimitUpdater interface {
+	// UpdateLimits changes the capacity and rate of a bucket, taking effect immediately. The space
+	// already used in the bucket carries over according to the storage's UsageMode, and the bucket
+	// now drains rate after its current window started. Buckets that don't exist are left alone.
+	// Subsequent calls to Create must use the new capacity and rate.
+	UpdateLimits(name string, capacity uint, rate time.Duration) (BucketState, error)
+}
+
+// UpdateLimits changes the limits of a bucket with s.UpdateLimits if s is a LimitUpdater, or fails
+// with an error matching errors.ErrUnsupported otherwise.
+func UpdateLimits(s Storage, name string, capacity uint, rate time.Duration) (BucketState, error) {
+	if lu, ok := s.(LimitUpdater); ok {
+		return lu.UpdateLimits(name, capacity, rate)
+	}
+	return BucketState{}, fmt.Errorf("%T can't update the limits of buckets: %w", s, errors.ErrUnsupported)
+}
+
+// UsageMode controls how LimitUpdater.UpdateLimits carries the space already used in a bucket over to
+// its new capacity.
+type UsageMode int
+
+const (
+	// UsageAbsolute keeps the amount used: a bucket of capacity 10 with 4 used has 16 remaining
+	// once its capacity is raised to 20.
+	UsageAbsolute UsageMode = iota
+	// UsageProportional keeps the fraction used: a bucket of capacity 10 with 4 used has 12
+	// remaining once its capacity is raised to 20.
+	UsageProportional
+)
+
+// Carry returns how much of newCapacity is used once a bucket with used of oldCapacity used has its
+// capacity changed.
+func (m UsageMode) Carry(used, oldCapacity, newCapacity uint) uint {
+	if m == UsageProportional {
+		if oldCapacity == 0 {
+			return 0
+		}
+		// round to the nearest integer
+		used = uint((uint64(used)*uint64(newCapacity) + uint64(oldCapacity)/2) / uint64(oldCapacity))
+	}
+	if used > newCapacity {
+		return newCapacity
+	}
+	return used
+}
@@ -0,0 +1,25 @@
+package leakybucket
+
+import (
+	"testing"
+)
+
+func TestUsageModeCarry(t *testing.T) {
+	for _, c := range []struct {
+		mode                               UsageMode
+		used, oldCapacity, newCapacity, is uint
+	}{
+		{UsageAbsolute, 4, 10, 20, 4},
+		{UsageAbsolute, 8, 10, 5, 5},
+		{UsageProportional, 4, 10, 20, 8},
+		{UsageProportional, 4, 10, 5, 2},
+		{UsageProportional, 1, 3, 2, 1},
+		{UsageProportional, 10, 10, 7, 7},
+		{UsageProportional, 3, 0, 7, 0},
+	} {
+		if is := c.mode.Carry(c.used, c.oldCapacity, c.newCapacity); is != c.is {
+			t.Errorf("mode %d carrying %d of %d over to %d: expected %d, got %d",
+				c.mode, c.used, c.oldCapacity, c.newCapacity, c.is, is)
+		}
+	}
+}
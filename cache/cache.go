@@ -0,0 +1,286 @@
+// Package cache provides a leakybucket.Storage decorator that answers some Add calls from what it
+// last learned about a bucket, rather than calling a remote storage such as redis or DynamoDB.
+//
+// Buckets only drain at their Reset, so once a bucket has too little space left for an Add, it
+// will until then: the cache rejects such Adds locally, with leakybucket.ErrorFull and the cached
+// state, which spares the storage the load of clients hammering a full bucket. This is exact,
+// unless the limits of the bucket change, e.g. by calling UpdateLimits from another process.
+// Likewise, creating a bucket the cache knows about, with the same limits, returns a bucket with
+// the cached state: the storage is only asked for it once an Add can't be answered locally.
+//
+// Optionally, the cache also admits Adds locally out of a fraction of the space a bucket had left,
+// for a bounded time: see WithHeadroom. Space used locally is charged to the bucket in the storage
+// with the next Add that reaches it.
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// Cache answers Add calls from what it last learned about buckets, through its Middleware.
+type Cache struct {
+	fraction   float64
+	staleness  time.Duration
+	maxEntries int
+
+	mutex   sync.Mutex
+	entries map[string]*entry
+}
+
+// entry is what the cache knows about a bucket.
+type entry struct {
+	mutex sync.Mutex
+	spec  leakybucket.BucketSpec
+	state leakybucket.BucketState
+	// budget is the space left to admit locally until fresh, and pending the space admitted
+	// locally not yet charged to the storage.
+	budget  uint
+	pending uint
+	fresh   time.Time
+}
+
+// Storage wraps a leakybucket.Storage with a cache.
+type Storage struct {
+	leakybucket.ChainedStorage
+	*Cache
+}
+
+type config struct {
+	fraction   float64
+	staleness  time.Duration
+	maxEntries int
+}
+
+// Option configures optional behavior of a Cache.
+type Option func(*config)
+
+// WithHeadroom makes the cache admit Adds locally out of fraction of the space a bucket had left,
+// as last returned by the storage, for up to staleness. Other processes sharing the bucket aren't
+// told of this usage until the cache charges it, so the bucket may admit up to fraction of its space
+// left more than its capacity per process. By default the cache doesn't admit Adds locally.
+func WithHeadroom(fraction float64, staleness time.Duration) Option {
+	return func(c *config) {
+		c.fraction = fraction
+		c.staleness = staleness
+	}
+}
+
+// WithMaxEntries sets how many buckets the cache knows about at most. The default is 10000.
+func WithMaxEntries(n int) Option {
+	return func(c *config) {
+		c.maxEntries = n
+	}
+}
+
+// New wraps a storage with a cache.
+func New(storage leakybucket.Storage, opts ...Option) *Storage {
+	c := NewCache(opts...)
+	return &Storage{
+		ChainedStorage: leakybucket.Chain(storage, c.Middleware()),
+		Cache:          c,
+	}
+}
+
+// NewCache creates the Cache used by New, to wrap a storage of one's own making with Middleware and
+// leakybucket.Chain.
+func NewCache(opts ...Option) *Cache {
+	c := &config{
+		maxEntries: 10000,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return &Cache{
+		fraction:   c.fraction,
+		staleness:  c.staleness,
+		maxEntries: c.maxEntries,
+		entries:    make(map[string]*entry),
+	}
+}
+
+// entry returns the entry of a bucket, creating it if there's room, or nil.
+func (c *Cache) entry(spec leakybucket.BucketSpec) *entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[spec.Name]
+	if ok {
+		return e
+	}
+	if len(c.entries) >= c.maxEntries {
+		c.sweep()
+		if len(c.entries) >= c.maxEntries {
+			return nil
+		}
+	}
+	e = &entry{spec: spec}
+	c.entries[spec.Name] = e
+	return e
+}
+
+// sweep forgets the buckets that have drained since the cache last learned about them. The caller
+// must hold the mutex.
+func (c *Cache) sweep() {
+	now := time.Now()
+	for name, e := range c.entries {
+		e.mutex.Lock()
+		if now.After(e.state.Reset) {
+			delete(c.entries, name)
+		}
+		e.mutex.Unlock()
+	}
+}
+
+// forget forgets what the cache knows about a bucket.
+func (c *Cache) forget(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, name)
+}
+
+// cached returns the state the cache knows of a bucket with the given spec that hasn't drained
+// since, if any.
+func (c *Cache) cached(spec leakybucket.BucketSpec) (leakybucket.BucketState, bool) {
+	c.mutex.Lock()
+	e, ok := c.entries[spec.Name]
+	c.mutex.Unlock()
+	if !ok {
+		return leakybucket.BucketState{}, false
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.spec != spec || !time.Now().Before(e.state.Reset) {
+		return leakybucket.BucketState{}, false
+	}
+	return e.state, true
+}
+
+// local answers an Add from the entry, if it can. The caller must hold the entry's mutex.
+func (e *entry) local(amount uint, now time.Time) (leakybucket.BucketState, bool, error) {
+	if !now.Before(e.state.Reset) {
+		// the bucket drained, and with it the usage not yet charged
+		e.state, e.budget, e.pending = leakybucket.BucketState{}, 0, 0
+		return leakybucket.BucketState{}, false, nil
+	}
+	if amount > e.state.Remaining {
+		return e.state, true, leakybucket.ErrorFull
+	}
+	if amount <= e.budget && now.Before(e.fresh) {
+		e.budget -= amount
+		e.pending += amount
+		e.state.Remaining -= amount
+		return e.state, true, nil
+	}
+	return leakybucket.BucketState{}, false, nil
+}
+
+// learn updates the entry with the state returned by the storage. The caller must hold the entry's
+// mutex.
+func (c *Cache) learn(e *entry, state leakybucket.BucketState, now time.Time) {
+	e.state = state
+	e.budget = uint(c.fraction * float64(state.Remaining))
+	e.fresh = now.Add(c.staleness)
+}
+
+// Middleware answers the Create calls of a storage and the Add calls of its buckets from the cache
+// when it can.
+func (c *Cache) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				if state, ok := c.cached(spec); ok {
+					return &uncreated{spec: spec, state: state, create: next}, nil
+				}
+				return next(ctx, spec)
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				e := c.entry(spec)
+				if e == nil {
+					return next(ctx, spec, amount)
+				}
+				e.mutex.Lock()
+				if e.spec != spec {
+					// the bucket was created again with other limits
+					e.spec, e.state, e.budget, e.pending = spec, leakybucket.BucketState{}, 0, 0
+				}
+				if state, ok, err := e.local(amount, time.Now()); ok {
+					e.mutex.Unlock()
+					return state, err
+				}
+				pending := e.pending
+				e.pending = 0
+				e.mutex.Unlock()
+
+				state, err := next(ctx, spec, amount+pending)
+				if err == leakybucket.ErrorFull && pending > 0 {
+					// the bucket filled up while we admitted locally: the usage not yet charged
+					// is lost, but it mustn't reject an Add that fits
+					state, err = next(ctx, spec, amount)
+				}
+
+				e.mutex.Lock()
+				defer e.mutex.Unlock()
+				if err == nil || err == leakybucket.ErrorFull {
+					c.learn(e, state, time.Now())
+				} else {
+					// charge the usage with the next Add instead
+					e.pending += pending
+				}
+				return state, err
+			}
+		},
+		UpdateLimits: func(next leakybucket.UpdateLimitsFunc) leakybucket.UpdateLimitsFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.BucketState, error) {
+				c.forget(spec.Name)
+				return next(ctx, spec)
+			}
+		},
+	}
+}
+
+// uncreated is a bucket created from the cache. It creates the bucket in the storage on its first
+// Add, which only happens for Adds the cache can't answer.
+type uncreated struct {
+	spec   leakybucket.BucketSpec
+	state  leakybucket.BucketState
+	create leakybucket.CreateFunc
+
+	mutex  sync.Mutex
+	bucket leakybucket.Bucket
+}
+
+func (b *uncreated) Capacity() uint {
+	return b.state.Capacity
+}
+
+func (b *uncreated) Remaining() uint {
+	return b.state.Remaining
+}
+
+func (b *uncreated) Reset() time.Time {
+	return b.state.Reset
+}
+
+func (b *uncreated) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+func (b *uncreated) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	bucket := b.bucket
+	if bucket == nil {
+		var err error
+		if bucket, err = b.create(ctx, b.spec); err != nil {
+			b.mutex.Unlock()
+			return leakybucket.BucketState{}, err
+		}
+		b.bucket = bucket
+	}
+	b.mutex.Unlock()
+	return leakybucket.AddContext(ctx, bucket, amount)
+}
@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+// counting is a storage counting its Create calls and the Add calls to its buckets.
+type counting struct {
+	leakybucket.Storage
+	creates *atomic.Int64
+	adds    *atomic.Int64
+}
+
+type countingBucket struct {
+	leakybucket.Bucket
+	adds *atomic.Int64
+}
+
+func newCounting() counting {
+	return counting{Storage: memory.New(), creates: &atomic.Int64{}, adds: &atomic.Int64{}}
+}
+
+func (c counting) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	c.creates.Add(1)
+	b, err := c.Storage.Create(name, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+	return countingBucket{b, c.adds}, nil
+}
+
+func (b countingBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	b.adds.Add(1)
+	return b.Bucket.Add(amount)
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New()))(t)
+}
+
+func TestAddReset(t *testing.T) {
+	test.AddResetTest(New(memory.New()))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New(memory.New()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(New(memory.New()))(t)
+}
+
+func TestHeadroomAdd(t *testing.T) {
+	test.AddTest(New(memory.New(), WithHeadroom(0.5, time.Minute)))(t)
+}
+
+func TestFull(t *testing.T) {
+	storage := newCounting()
+	s := New(storage)
+	bucket, err := s.Create("testbucket", 2, 200*time.Millisecond)
+	require.NoError(t, err)
+
+	_, err = bucket.Add(2)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		state, err := bucket.Add(1)
+		require.Equal(t, leakybucket.ErrorFull, err)
+		require.Equal(t, uint(0), state.Remaining)
+	}
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	// the bucket drains at its reset
+	time.Sleep(250 * time.Millisecond)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), state.Remaining)
+	require.Equal(t, int64(2), storage.adds.Load())
+}
+
+func TestFullCreate(t *testing.T) {
+	storage := newCounting()
+	s := New(storage)
+	bucket, err := s.Create("testbucket", 2, 200*time.Millisecond)
+	require.NoError(t, err)
+	_, err = bucket.Add(2)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), storage.creates.Load())
+
+	// like the http, grpc and aws limiters, create the bucket for every request
+	for i := 0; i < 5; i++ {
+		bucket, err := s.Create("testbucket", 2, 200*time.Millisecond)
+		require.NoError(t, err)
+		require.Equal(t, uint(0), bucket.Remaining())
+		_, err = bucket.Add(1)
+		require.Equal(t, leakybucket.ErrorFull, err)
+	}
+	require.Equal(t, int64(1), storage.creates.Load())
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	// other limits aren't answered from the cache
+	_, err = s.Create("testbucket", 3, 200*time.Millisecond)
+	require.Error(t, err)
+	require.Equal(t, int64(2), storage.creates.Load())
+
+	// once the bucket drains, Adds reach the storage, creating the bucket there
+	time.Sleep(250 * time.Millisecond)
+	bucket, err = s.Create("testbucket", 2, 200*time.Millisecond)
+	require.NoError(t, err)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), state.Remaining)
+	require.Equal(t, int64(3), storage.creates.Load())
+	require.Equal(t, int64(2), storage.adds.Load())
+}
+
+func TestCreateFits(t *testing.T) {
+	storage := newCounting()
+	s := New(storage)
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(3)
+	require.NoError(t, err)
+
+	// a bucket created from the cache creates it in the storage for an Add that reaches it
+	bucket, err = s.Create("testbucket", 5, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), storage.creates.Load())
+	state, err := bucket.Add(2)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), state.Remaining)
+	require.Equal(t, int64(2), storage.creates.Load())
+	require.Equal(t, int64(2), storage.adds.Load())
+}
+
+func TestFullFits(t *testing.T) {
+	storage := newCounting()
+	s := New(storage)
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	require.NoError(t, err)
+
+	_, err = bucket.Add(3)
+	require.NoError(t, err)
+	_, err = bucket.Add(3)
+	require.Equal(t, leakybucket.ErrorFull, err)
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	// an Add that fits in the space left reaches the storage
+	state, err := bucket.Add(2)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), state.Remaining)
+	require.Equal(t, int64(2), storage.adds.Load())
+}
+
+func TestHeadroom(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithHeadroom(0.5, time.Minute))
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+
+	state, err := bucket.Add(2)
+	require.NoError(t, err)
+	require.Equal(t, uint(8), state.Remaining)
+
+	// half of the 8 left is admitted locally
+	for i := 0; i < 4; i++ {
+		state, err := bucket.Add(1)
+		require.NoError(t, err)
+		require.Equal(t, uint(7-i), state.Remaining)
+	}
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	// the next Add charges the usage admitted locally
+	state, err = bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), state.Remaining)
+	require.Equal(t, int64(2), storage.adds.Load())
+
+	direct, err := storage.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), direct.Remaining())
+}
+
+func TestHeadroomStaleness(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithHeadroom(1, 50*time.Millisecond))
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	time.Sleep(100 * time.Millisecond)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(7), state.Remaining)
+	require.Equal(t, int64(2), storage.adds.Load())
+}
+
+func TestHeadroomFull(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithHeadroom(1, 50*time.Millisecond))
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	_, err = bucket.Add(4)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	// another process fills the bucket but for a token
+	other, err := storage.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = other.Add(8)
+	require.NoError(t, err)
+
+	// the usage admitted locally doesn't fit anymore, but the Add does
+	time.Sleep(100 * time.Millisecond)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), state.Remaining)
+	require.Equal(t, int64(4), storage.adds.Load(), "the other Add, and two for this one")
+}
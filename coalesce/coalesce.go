@@ -0,0 +1,276 @@
+// Package coalesce provides a leakybucket.Storage decorator that batches concurrent Add calls to
+// the same bucket into a single Add to the storage, so that hundreds of goroutines adding to a hot
+// redis or DynamoDB bucket cost a round trip per batch rather than one each.
+//
+// An Add to a bucket no other Add is being made to is added to the storage right away. Otherwise,
+// the first Add opens a batch and waits for the batch window for more Adds to join it, then adds
+// the total to the storage. Adds to a busy bucket may thus wait up to the window longer than they
+// would alone. If the total fits, every Add in the batch is admitted. If it
+// doesn't, as many Adds as fit in the space the bucket has left are admitted, in the order they
+// joined the batch, with a second Add to the storage, and the others are rejected with
+// leakybucket.ErrorFull.
+//
+// The state returned to each Add of a batch is as if the Adds had been made one after the other,
+// in the order they joined the batch. An Add that joined a batch returns as soon as its context is
+// done, with the context's error. Its amount is still added to the storage if the batch was
+// already closed.
+package coalesce
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// Coalescer batches concurrent Add calls to the same bucket through its Middleware.
+type Coalescer struct {
+	window   time.Duration
+	maxBatch int
+
+	mutex   sync.Mutex
+	batches map[leakybucket.BucketSpec]*batch
+	// inflight counts the Adds being made to each bucket.
+	inflight map[leakybucket.BucketSpec]int
+}
+
+// batch is the Adds to a bucket made together.
+type batch struct {
+	// wait is whether the Add that opened the batch waits for more Adds to join it.
+	wait    bool
+	amounts []uint
+	results []result
+	// full is closed once the batch can't take any more Adds, done once results are in.
+	full chan struct{}
+	done chan struct{}
+}
+
+type result struct {
+	state leakybucket.BucketState
+	err   error
+}
+
+// Storage wraps a leakybucket.Storage, batching concurrent Adds to its buckets.
+type Storage struct {
+	leakybucket.ChainedStorage
+	*Coalescer
+}
+
+type config struct {
+	window   time.Duration
+	maxBatch int
+}
+
+// Option configures optional behavior of a Coalescer.
+type Option func(*config)
+
+// WithWindow sets how long the first Add of a batch waits for more Adds to join it. The default is
+// one millisecond.
+func WithWindow(d time.Duration) Option {
+	return func(c *config) {
+		c.window = d
+	}
+}
+
+// WithMaxBatch sets how many Adds a batch takes at most: the batch is added to the storage as soon
+// as it has that many. The default is 100.
+func WithMaxBatch(n int) Option {
+	return func(c *config) {
+		c.maxBatch = n
+	}
+}
+
+// New wraps a storage, batching concurrent Adds to its buckets.
+func New(storage leakybucket.Storage, opts ...Option) *Storage {
+	c := NewCoalescer(opts...)
+	return &Storage{
+		ChainedStorage: leakybucket.Chain(storage, c.Middleware()),
+		Coalescer:      c,
+	}
+}
+
+// NewCoalescer creates the Coalescer used by New, to wrap a storage of one's own making with
+// Middleware and leakybucket.Chain.
+func NewCoalescer(opts ...Option) *Coalescer {
+	c := &config{
+		window:   time.Millisecond,
+		maxBatch: 100,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return &Coalescer{
+		window:   c.window,
+		maxBatch: c.maxBatch,
+		batches:  make(map[leakybucket.BucketSpec]*batch),
+		inflight: make(map[leakybucket.BucketSpec]int),
+	}
+}
+
+// join adds amount to the open batch of a bucket, opening one if needed. It returns the batch, the
+// index of the Add in it, and whether the Add opened it. A batch opened while no other Add is being
+// made to the bucket is closed right away. Every join must be followed by a leave.
+func (c *Coalescer) join(spec leakybucket.BucketSpec, amount uint) (*batch, int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inflight[spec]++
+	b, ok := c.batches[spec]
+	if !ok {
+		b = &batch{full: make(chan struct{}), done: make(chan struct{})}
+		if c.inflight[spec] == 1 {
+			b.amounts = append(b.amounts, amount)
+			return b, 0, true
+		}
+		b.wait = true
+		c.batches[spec] = b
+	}
+	b.amounts = append(b.amounts, amount)
+	if len(b.amounts) >= c.maxBatch {
+		delete(c.batches, spec)
+		close(b.full)
+	}
+	return b, len(b.amounts) - 1, !ok
+}
+
+// leave ends an Add to a bucket.
+func (c *Coalescer) leave(spec leakybucket.BucketSpec) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inflight[spec]--; c.inflight[spec] == 0 {
+		delete(c.inflight, spec)
+	}
+}
+
+// withdraw takes the Add at index i out of a batch, unless the batch was closed already.
+func (c *Coalescer) withdraw(spec leakybucket.BucketSpec, b *batch, i int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.batches[spec] == b {
+		b.amounts[i] = 0
+	}
+}
+
+// close stops a batch from taking more Adds.
+func (c *Coalescer) close(spec leakybucket.BucketSpec, b *batch) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.batches[spec] == b {
+		delete(c.batches, spec)
+	}
+}
+
+// run adds a closed batch to the storage and hands out the results.
+func (b *batch) run(ctx context.Context, spec leakybucket.BucketSpec, next leakybucket.AddFunc) {
+	defer close(b.done)
+	b.results = make([]result, len(b.amounts))
+	var total uint
+	for _, amount := range b.amounts {
+		total += amount
+	}
+	state, err := next(ctx, spec, total)
+	if err == nil {
+		b.admit(allOf(b.amounts), state)
+		return
+	} else if err != leakybucket.ErrorFull || len(b.amounts) == 1 {
+		b.fail(allOf(b.amounts), state, err)
+		return
+	}
+
+	// admit what fits, in order
+	admitted := make([]bool, len(b.amounts))
+	var fits uint
+	for i, amount := range b.amounts {
+		if fits+amount <= state.Remaining {
+			admitted[i] = true
+			fits += amount
+		}
+	}
+	rejected := not(admitted)
+	if fits == 0 {
+		b.fail(rejected, state, leakybucket.ErrorFull)
+		return
+	}
+	state, err = next(ctx, spec, fits)
+	if err != nil {
+		b.fail(admitted, state, err)
+		b.fail(rejected, state, leakybucket.ErrorFull)
+		return
+	}
+	b.admit(admitted, state)
+	b.fail(rejected, state, leakybucket.ErrorFull)
+}
+
+// admit hands out the state after adding the selected Adds, as if they'd been made in order.
+func (b *batch) admit(selected []bool, state leakybucket.BucketState) {
+	remaining := state.Remaining
+	for i := len(b.amounts) - 1; i >= 0; i-- {
+		if !selected[i] {
+			continue
+		}
+		b.results[i] = result{state: leakybucket.BucketState{
+			Capacity:  state.Capacity,
+			Remaining: remaining,
+			Reset:     state.Reset,
+		}}
+		remaining += b.amounts[i]
+	}
+}
+
+// fail hands out an error to the selected Adds.
+func (b *batch) fail(selected []bool, state leakybucket.BucketState, err error) {
+	for i := range b.amounts {
+		if selected[i] {
+			b.results[i] = result{state: state, err: err}
+		}
+	}
+}
+
+func allOf(amounts []uint) []bool {
+	all := make([]bool, len(amounts))
+	for i := range all {
+		all[i] = true
+	}
+	return all
+}
+
+func not(selected []bool) []bool {
+	inverse := make([]bool, len(selected))
+	for i, s := range selected {
+		inverse[i] = !s
+	}
+	return inverse
+}
+
+// Middleware batches concurrent Adds to the same bucket of a storage. The batch is added to the
+// storage with the context of the Add that opened it, minus its cancellation.
+func (c *Coalescer) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				b, i, opened := c.join(spec, amount)
+				defer c.leave(spec)
+				if opened {
+					if b.wait {
+						timer := time.NewTimer(c.window)
+						select {
+						case <-timer.C:
+							c.close(spec, b)
+						case <-b.full:
+							timer.Stop()
+						}
+					}
+					b.run(context.WithoutCancel(ctx), spec, next)
+					return b.results[i].state, b.results[i].err
+				}
+				select {
+				case <-b.done:
+				case <-ctx.Done():
+					c.withdraw(spec, b, i)
+					return leakybucket.BucketState{}, ctx.Err()
+				}
+				return b.results[i].state, b.results[i].err
+			}
+		},
+	}
+}
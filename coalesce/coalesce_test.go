@@ -0,0 +1,210 @@
+package coalesce
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+// counting is a storage counting the Add calls to its buckets, which take delay, as a round trip
+// to a remote storage would.
+type counting struct {
+	leakybucket.Storage
+	adds  *atomic.Int64
+	delay time.Duration
+}
+
+type countingBucket struct {
+	leakybucket.Bucket
+	adds  *atomic.Int64
+	delay time.Duration
+}
+
+func newCounting(delay time.Duration) counting {
+	return counting{Storage: memory.New(), adds: &atomic.Int64{}, delay: delay}
+}
+
+func (c counting) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, err := c.Storage.Create(name, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+	return countingBucket{b, c.adds, c.delay}, nil
+}
+
+func (b countingBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	b.adds.Add(1)
+	time.Sleep(b.delay)
+	return b.Bucket.Add(amount)
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New()))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(New(memory.New()))(t)
+}
+
+func TestBucketInstanceConsistency(t *testing.T) {
+	test.BucketInstanceConsistencyTest(New(memory.New()))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New(memory.New()))(t)
+}
+
+// addConcurrently adds 1 to the bucket from n goroutines at once.
+func addConcurrently(bucket leakybucket.Bucket, n int) ([]uint, int) {
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		remaining []uint
+		full      int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := bucket.Add(1)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == leakybucket.ErrorFull {
+				full++
+			} else if err == nil {
+				remaining = append(remaining, state.Remaining)
+			}
+		}()
+	}
+	wg.Wait()
+	return remaining, full
+}
+
+func TestCoalesce(t *testing.T) {
+	storage := newCounting(20 * time.Millisecond)
+	s := New(storage, WithWindow(50*time.Millisecond))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+
+	remaining, full := addConcurrently(bucket, 50)
+	require.Equal(t, 0, full)
+	require.Len(t, remaining, 50)
+	require.Less(t, storage.adds.Load(), int64(5))
+
+	// every Add sees the bucket as if it were alone
+	seen := map[uint]bool{}
+	for _, r := range remaining {
+		seen[r] = true
+	}
+	for r := uint(50); r < 100; r++ {
+		require.True(t, seen[r], "expected an Add to see %d remaining", r)
+	}
+}
+
+func TestCoalesceFull(t *testing.T) {
+	storage := newCounting(20 * time.Millisecond)
+	s := New(storage, WithWindow(50*time.Millisecond))
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+
+	remaining, full := addConcurrently(bucket, 15)
+	require.Len(t, remaining, 10)
+	require.Equal(t, 5, full)
+	require.Less(t, storage.adds.Load(), int64(5))
+}
+
+func TestMaxBatch(t *testing.T) {
+	storage := newCounting(200 * time.Millisecond)
+	s := New(storage, WithWindow(time.Minute), WithMaxBatch(10))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+	go bucket.Add(1)
+	require.Eventually(t, func() bool { return storage.adds.Load() == 1 }, time.Second, time.Millisecond)
+
+	// batches don't wait out the window once they're full
+	remaining, _ := addConcurrently(bucket, 20)
+	require.Len(t, remaining, 20)
+	require.Equal(t, int64(3), storage.adds.Load())
+}
+
+func TestAlone(t *testing.T) {
+	storage := newCounting(0)
+	s := New(storage, WithWindow(time.Minute))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+
+	// an Add no other Add is made with doesn't wait out the window
+	for i := 0; i < 3; i++ {
+		_, err := bucket.Add(1)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(3), storage.adds.Load())
+}
+
+func TestContextDone(t *testing.T) {
+	storage := newCounting(100 * time.Millisecond)
+	s := New(storage, WithWindow(100*time.Millisecond))
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	add := func() {
+		defer wg.Done()
+		if _, err := bucket.Add(1); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the first Add is in flight while the second opens a batch
+	wg.Add(2)
+	go add()
+	require.Eventually(t, func() bool { return storage.adds.Load() == 1 }, time.Second, time.Millisecond)
+	go add()
+	require.Eventually(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.batches) == 1
+	}, time.Second, time.Millisecond)
+
+	// an Add joining the batch doesn't wait for it once its context is done, and leaves it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = leakybucket.AddContext(ctx, bucket, 5)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	wg.Wait()
+	direct, err := storage.Storage.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(8), direct.Remaining())
+}
+
+func TestBatchOrder(t *testing.T) {
+	bucket, err := memory.New().Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(2)
+	require.NoError(t, err)
+	next := func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+		return bucket.Add(amount)
+	}
+
+	b := &batch{amounts: []uint{3, 5, 2, 4}, done: make(chan struct{})}
+	b.run(context.Background(), leakybucket.BucketSpec{}, next)
+	require.NoError(t, b.results[0].err)
+	require.Equal(t, uint(5), b.results[0].state.Remaining)
+	require.NoError(t, b.results[1].err)
+	require.Equal(t, uint(0), b.results[1].state.Remaining)
+	require.Equal(t, leakybucket.ErrorFull, b.results[2].err)
+	require.Equal(t, leakybucket.ErrorFull, b.results[3].err)
+}
@@ -0,0 +1,215 @@
+// Package consistent provides a leakybucket.Storage spreading buckets across several storages, e.g.
+// redis instances, by consistent hashing of their names.
+//
+// Each shard is placed on a hash ring at many points, its virtual nodes, and a bucket belongs to
+// the shard of the first point following the hash of its name. Adding or removing a shard only
+// moves the buckets of the ring segments it gains or loses, about 1/n of them with n shards, and
+// naming shards rather than numbering them keeps the ring the same across processes and restarts
+// whatever order the shards are listed in.
+//
+// Buckets moved to another shard start afresh there: their usage on the previous shard is lost.
+// Buckets created before a change keep using the shard that owned them then.
+package consistent
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// ErrNoShards is returned when creating or updating a bucket of a Storage without any shards.
+var ErrNoShards = errors.New("no shards to store buckets in")
+
+// HashFunc hashes keys onto the ring.
+type HashFunc func(key []byte) uint64
+
+// point is a virtual node of a shard on the ring.
+type point struct {
+	hash  uint64
+	shard string
+}
+
+// Storage spreads buckets across shards by consistent hashing of their names.
+type Storage struct {
+	vnodes int
+	hash   HashFunc
+
+	mutex  sync.RWMutex
+	shards map[string]leakybucket.Storage
+	ring   []point
+}
+
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+)
+
+type config struct {
+	vnodes int
+	hash   HashFunc
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*config)
+
+// WithVirtualNodes sets how many points each shard has on the ring. More points spread buckets more
+// evenly across shards, at the cost of memory and of time to add or remove a shard. The default is
+// 160.
+func WithVirtualNodes(n int) Option {
+	return func(c *config) {
+		c.vnodes = n
+	}
+}
+
+// WithHash sets the hash of the ring. Every process sharing the shards must use the same one. The
+// default is 64-bit FNV-1a, mixed with the MurmurHash3 finalizer to spread similar keys apart.
+func WithHash(hash HashFunc) Option {
+	return func(c *config) {
+		c.hash = hash
+	}
+}
+
+func fnvMix(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// New creates a storage spreading buckets across shards, keyed by name.
+func New(shards map[string]leakybucket.Storage, opts ...Option) *Storage {
+	c := &config{
+		vnodes: 160,
+		hash:   fnvMix,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	s := &Storage{
+		vnodes: c.vnodes,
+		hash:   c.hash,
+		shards: make(map[string]leakybucket.Storage, len(shards)),
+	}
+	for name, shard := range shards {
+		s.shards[name] = shard
+	}
+	s.build()
+	return s
+}
+
+// build places the shards on the ring. The caller must hold the mutex for writing.
+func (s *Storage) build() {
+	ring := make([]point, 0, len(s.shards)*s.vnodes)
+	for name := range s.shards {
+		for i := 0; i < s.vnodes; i++ {
+			ring = append(ring, point{hash: s.hash([]byte(name + "#" + strconv.Itoa(i))), shard: name})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			// break ties the same way in every process
+			return ring[i].shard < ring[j].shard
+		}
+		return ring[i].hash < ring[j].hash
+	})
+	s.ring = ring
+}
+
+// AddShard adds a shard, or replaces the storage of a shard with the same name.
+func (s *Storage) AddShard(name string, shard leakybucket.Storage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, exists := s.shards[name]
+	s.shards[name] = shard
+	if !exists {
+		s.build()
+	}
+}
+
+// RemoveShard removes a shard, handing its buckets over to the other shards.
+func (s *Storage) RemoveShard(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.shards[name]; !exists {
+		return
+	}
+	delete(s.shards, name)
+	s.build()
+}
+
+// Shards returns the names of the shards, sorted.
+func (s *Storage) Shards() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Owner returns the name of the shard owning a bucket, or "" if there are no shards.
+func (s *Storage) Owner(name string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.owner(name)
+}
+
+// owner returns the name of the shard owning a bucket. The caller must hold the mutex.
+func (s *Storage) owner(name string) string {
+	if len(s.ring) == 0 {
+		return ""
+	}
+	h := s.hash([]byte(name))
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+// shard returns the storage of the shard owning a bucket.
+func (s *Storage) shard(name string) (leakybucket.Storage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	owner := s.owner(name)
+	if owner == "" {
+		return nil, ErrNoShards
+	}
+	return s.shards[owner], nil
+}
+
+// Create a bucket in the shard owning it.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket in the shard owning it, passing ctx on to the shard.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	shard, err := s.shard(name)
+	if err != nil {
+		return nil, err
+	}
+	return leakybucket.CreateContext(ctx, shard, name, capacity, rate)
+}
+
+// UpdateLimits changes the capacity and rate of a bucket in the shard owning it.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	shard, err := s.shard(name)
+	if err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	return leakybucket.UpdateLimits(shard, name, capacity, rate)
+}
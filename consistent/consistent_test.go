@@ -0,0 +1,125 @@
+package consistent
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+func newStorage(shards ...string) *Storage {
+	storages := map[string]leakybucket.Storage{}
+	for _, name := range shards {
+		storages[name] = memory.New()
+	}
+	return New(storages)
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(newStorage("a", "b", "c"))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(newStorage("a", "b", "c"))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(newStorage("a", "b", "c"))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(newStorage("a", "b", "c"))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(newStorage("a", "b", "c"))(t)
+}
+
+func TestNoShards(t *testing.T) {
+	s := newStorage()
+	require.Equal(t, "", s.Owner("testbucket"))
+	_, err := s.Create("testbucket", 10, time.Minute)
+	require.Equal(t, ErrNoShards, err)
+	_, err = s.UpdateLimits("testbucket", 10, time.Minute)
+	require.Equal(t, ErrNoShards, err)
+}
+
+func TestOwner(t *testing.T) {
+	shards := map[string]leakybucket.Storage{"a": memory.New(), "b": memory.New(), "c": memory.New()}
+	s := New(shards)
+	require.Equal(t, []string{"a", "b", "c"}, s.Shards())
+
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(3)
+	require.NoError(t, err)
+
+	// the bucket lives in its owner only
+	for name, shard := range shards {
+		b, err := shard.Create("testbucket", 10, time.Minute)
+		require.NoError(t, err)
+		if name == s.Owner("testbucket") {
+			require.Equal(t, uint(7), b.Remaining())
+		} else {
+			require.Equal(t, uint(10), b.Remaining())
+		}
+	}
+}
+
+func owners(s *Storage, n int) []string {
+	owners := make([]string, n)
+	for i := range owners {
+		owners[i] = s.Owner(fmt.Sprintf("bucket-%d", i))
+	}
+	return owners
+}
+
+func TestBalance(t *testing.T) {
+	s := newStorage("a", "b", "c", "d")
+	counts := map[string]int{}
+	for _, owner := range owners(s, 10000) {
+		counts[owner]++
+	}
+	for shard, count := range counts {
+		require.InDelta(t, 2500, count, 500, "shard %s owns %d buckets", shard, count)
+	}
+}
+
+func TestRemap(t *testing.T) {
+	s := newStorage("a", "b", "c", "d")
+	before := owners(s, 10000)
+
+	s.AddShard("e", memory.New())
+	after := owners(s, 10000)
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			require.Equal(t, "e", after[i], "buckets only move to the new shard")
+			moved++
+		}
+	}
+	require.InDelta(t, 2000, moved, 500)
+
+	s.RemoveShard("e")
+	require.Equal(t, before, owners(s, 10000))
+
+	s.RemoveShard("a")
+	after = owners(s, 10000)
+	for i := range before {
+		if before[i] != "a" {
+			require.Equal(t, before[i], after[i], "only the buckets of the removed shard move")
+		}
+	}
+}
+
+func TestOrderIndependent(t *testing.T) {
+	a := newStorage("a", "b", "c")
+	b := newStorage("c")
+	b.AddShard("b", memory.New())
+	b.AddShard("a", memory.New())
+	require.Equal(t, owners(a, 1000), owners(b, 1000))
+}
@@ -0,0 +1,38 @@
+package leakybucket
+
+import (
+	"context"
+	"time"
+)
+
+// ContextStorage is implemented by storages that can tie the work of creating a bucket to a
+// context, e.g. to trace it. The buckets of such storages should be ContextBuckets.
+type ContextStorage interface {
+	Storage
+	// CreateContext is Create with a context.
+	CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (Bucket, error)
+}
+
+// ContextBucket is implemented by buckets that can tie the work of adding to them to a context.
+type ContextBucket interface {
+	Bucket
+	// AddContext is Add with a context.
+	AddContext(ctx context.Context, amount uint) (BucketState, error)
+}
+
+// CreateContext creates a bucket with s.CreateContext if s is a ContextStorage, or s.Create
+// otherwise.
+func CreateContext(ctx context.Context, s Storage, name string, capacity uint, rate time.Duration) (Bucket, error) {
+	if cs, ok := s.(ContextStorage); ok {
+		return cs.CreateContext(ctx, name, capacity, rate)
+	}
+	return s.Create(name, capacity, rate)
+}
+
+// AddContext adds to a bucket with b.AddContext if b is a ContextBucket, or b.Add otherwise.
+func AddContext(ctx context.Context, b Bucket, amount uint) (BucketState, error) {
+	if cb, ok := b.(ContextBucket); ok {
+		return cb.AddContext(ctx, amount)
+	}
+	return b.Add(amount)
+}
@@ -1,7 +1,7 @@
 /*
 Package dynamodb provides a leaky bucket implementation backed by AWS DynamoDB
 
-For additional details please refer to: https://github.com/Clever/leakybucket/tree/master/dynamodb
+For additional details please refer to: https://github.com/Clever/leakybucket/v2/tree/master/dynamodb
 */
 package dynamodb
 
@@ -11,14 +11,19 @@ import (
 	"sync"
 	"time"
 
-	"github.com/Clever/leakybucket"
+	"github.com/Clever/leakybucket/v2"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/eapache/go-resiliency/retrier"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
-var _ leakybucket.Bucket = &bucket{}
+var (
+	_ leakybucket.ContextBucket = &bucket{}
+	_ leakybucket.Releaser      = &bucket{}
+)
 
 type bucket struct {
 	name                string
@@ -46,16 +51,26 @@ func (b *bucket) Reset() time.Time {
 
 // Add to the bucket.
 func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket, tracing the DynamoDB requests it makes as children of ctx's span.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
+	ctx, cancel := b.db.context(ctx)
+	defer cancel()
 	// Storage.Create guarantees the DB Bucket with a configured TTL. For long running executions it
 	// is possible old buckets will get deleted, so we use `findOrCreate` rather than `bucket`
-	dbBucket, err := b.db.findOrCreateBucket(b.name, b.rate)
+	dbBucket, err := b.db.findOrCreateBucket(ctx, b.name, b.capacity, b.rate)
 	if err != nil {
 		return b.state(), err
 	}
-	if dbBucket.expired() {
-		dbBucket, err = b.db.resetBucket(*dbBucket, b.rate)
+	if err := dbBucket.configMismatch(b.capacity, b.rate); err != nil {
+		return b.state(), err
+	}
+	if b.db.expired(dbBucket) {
+		dbBucket, err = b.db.resetBucket(ctx, *dbBucket, b.capacity, b.rate)
 		if err != nil {
 			return b.state(), err
 		}
@@ -66,7 +81,7 @@ func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
 	if amount > b.remaining {
 		return b.state(), leakybucket.ErrorFull
 	}
-	updatedDBBucket, err := b.db.incrementBucketValue(b.name, amount, b.capacity)
+	updatedDBBucket, err := b.db.incrementBucketValue(ctx, b.name, amount, b.capacity)
 	if err != nil {
 		if err == errBucketCapacityExceeded {
 			return b.state(), leakybucket.ErrorFull
@@ -78,6 +93,22 @@ func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
 	return b.state(), nil
 }
 
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ctx, cancel := b.db.context(context.Background())
+	defer cancel()
+	value, ok, err := b.db.release(ctx, []string{b.name}, amount, b.capacity, b.rate, reset)
+	if err != nil {
+		return b.state(), err
+	} else if ok {
+		b.remaining = b.capacity - min(value, b.capacity)
+		b.reset = reset
+	}
+	return b.state(), nil
+}
+
 func (b *bucket) state() leakybucket.BucketState {
 	return leakybucket.BucketState{
 		Capacity:  b.Capacity(),
@@ -86,37 +117,116 @@ func (b *bucket) state() leakybucket.BucketState {
 	}
 }
 
-var _ leakybucket.Storage = &Storage{}
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+)
 
 // Storage is a dyanamodb-based, thread-safe leaky bucket factory.
 type Storage struct {
-	db bucketDB
+	db          bucketDB
+	shards      int
+	reconfigure bool
+	usage       leakybucket.UsageMode
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithShards spreads every bucket across n items so that writes to a single hot bucket are not
+// limited by the throughput of a single DynamoDB partition. Each Add reads all n items, in batches
+// of 100, and increments one of them chosen at random, so reads grow with n while writes are spread
+// evenly.
+// Concurrent adds landing on different shards may briefly overfill the bucket by at most the
+// amounts added concurrently. n <= 1 disables sharding.
+func WithShards(n int) Option {
+	return func(s *Storage) {
+		s.shards = n
+	}
+}
+
+// WithReconfigure makes Create store the requested capacity and rate with a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
+}
+
+// WithClock sets the time source used to start and expire bucket windows, e.g. to use a clock kept
+// in sync more tightly than the host's. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Storage) {
+		s.db.clock = now
+	}
+}
+
+// WithSkewTolerance makes buckets drain d later than the time stored with them, so that a client
+// whose clock runs ahead of the others' by up to d doesn't drain buckets early. Buckets whose
+// window was started by such a client may drain up to d late for everyone else.
+func WithSkewTolerance(d time.Duration) Option {
+	return func(s *Storage) {
+		s.db.skew = d
+	}
+}
+
+// WithTracerProvider traces every DynamoDB request made by the storage and its buckets. Requests
+// are children of the spans of the contexts passed to CreateContext and AddContext. By default
+// nothing is traced.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Storage) {
+		s.db.tracer = tp.Tracer("github.com/Clever/leakybucket/v2/dynamodb")
+	}
 }
 
 // Create a bucket. It will determine the current state of the bucket based on:
 // - The corresponding bucket in the database
 // - From scratch using the values provided
 func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket, tracing the DynamoDB requests it makes as children of ctx's span.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	if s.shards > 1 {
+		return s.createSharded(ctx, name, capacity, rate)
+	}
 	bucket := &bucket{
 		name:      name,
 		capacity:  capacity,
 		remaining: capacity,
-		reset:     time.Now().Add(rate),
+		reset:     s.db.now().Add(rate),
 		rate:      rate,
 		db:        s.db,
 	}
-	dbBucket, err := s.db.findOrCreateBucket(name, rate)
+	parent := ctx
+	ctx, cancel := s.db.context(ctx)
+	defer cancel()
+	dbBucket, err := s.db.findOrCreateBucket(ctx, name, capacity, rate)
 	if err != nil {
 		return nil, err
 	}
+	if dbBucket, err = s.configure(ctx, dbBucket, capacity, rate); err != nil {
+		return nil, err
+	}
 	// guarantee the bucket is in a good state
-	if dbBucket.expired() {
+	if s.db.expired(dbBucket) {
 		// adding 0 will reset the persisted bucket
-		if _, err := bucket.Add(0); err != nil {
+		if _, err := bucket.AddContext(parent, 0); err != nil {
 			return nil, err
 		}
+		return bucket, nil
 	}
-	bucket.remaining = max(capacity-dbBucket.Value, 0)
+	bucket.remaining = capacity - min(dbBucket.Value, capacity)
 	bucket.reset = dbBucket.Expiration
 
 	return bucket, nil
@@ -125,13 +235,14 @@ func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakyb
 // New initializes the a new bucket storage factory backed by dynamodb. We recommend the config is
 // configured with minimal or no retries for a real time use case. Additionally, we recommend
 // itemTTL >>> any rate provided in Storage.Create
-func New(tableName string, cfg aws.Config, itemTTL time.Duration) (*Storage, error) {
+func New(tableName string, cfg aws.Config, itemTTL time.Duration, opts ...Option) (*Storage, error) {
 	ddb := dynamodb.NewFromConfig(cfg)
 
 	db := bucketDB{
 		ddb:       ddb,
 		tableName: tableName,
 		ttl:       itemTTL,
+		tracer:    noop.NewTracerProvider().Tracer(""),
 	}
 
 	// Fail early if the table doesn't exist or we have any other issues with the DynamoDB API
@@ -148,16 +259,109 @@ func New(tableName string, cfg aws.Config, itemTTL time.Duration) (*Storage, err
 		return nil, err
 	}
 
-	return &Storage{
+	s := &Storage{
 		db: db,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
-func max(a, b uint) uint {
-	if a > b {
-		return a
+// configure checks the configuration persisted with a bucket against the requested one, storing
+// the requested one instead if the Storage was configured to reconfigure buckets.
+func (s *Storage) configure(ctx context.Context, dbBucket *ddbBucket, capacity uint, rate time.Duration) (*ddbBucket, error) {
+	if err := dbBucket.configMismatch(capacity, rate); err == nil {
+		return dbBucket, nil
+	} else if !s.reconfigure {
+		return nil, err
 	}
-	return b
+	updated, err := s.updateLimits(ctx, dbBucket.Name, capacity, rate)
+	if err != nil {
+		return nil, err
+	} else if updated == nil {
+		// the bucket was deleted in the meantime
+		return s.db.findOrCreateBucket(ctx, dbBucket.Name, capacity, rate)
+	}
+	return updated, nil
+}
+
+// maxUpdateAttempts bounds how many times updateLimits tries again when the bucket changes
+// between reading and writing it.
+const maxUpdateAttempts = 10
+
+// updateLimits stores a new configuration with a bucket, carrying over its value and the start of
+// its window. The value of every shard is moved to the first one. It returns nil if the bucket
+// doesn't exist.
+func (s *Storage) updateLimits(ctx context.Context, name string, capacity uint, rate time.Duration) (*ddbBucket, error) {
+	for attempt := 1; ; attempt++ {
+		primary, err := s.db.bucket(ctx, name)
+		if err == errBucketNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		total := primary.Value
+		var shards map[string]*ddbBucket
+		if s.shards > 1 {
+			if shards, err = s.db.buckets(ctx, shardNames(name, s.shards)); err != nil {
+				return nil, err
+			}
+			for _, shard := range shards {
+				if sameWindow(shard.Expiration, primary.Expiration) {
+					total += shard.Value
+				}
+			}
+		}
+
+		oldCapacity, oldRate := primary.Capacity, primary.Rate
+		if oldCapacity == 0 && oldRate == 0 {
+			// buckets persisted before their configuration are assumed to already have the new one
+			oldCapacity, oldRate = capacity, rate
+		}
+		var value uint
+		expiration := primary.Expiration
+		if !s.db.expired(primary) {
+			value = s.usage.Carry(total, oldCapacity, capacity)
+			// the window keeps its start
+			expiration = expiration.Add(rate - oldRate)
+		}
+
+		updated, err := s.db.updateBucket(ctx, *primary, value, capacity, rate, expiration)
+		if err == errBucketConflict && attempt < maxUpdateAttempts {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for name, shard := range shards {
+			if shard.Value > 0 && sameWindow(shard.Expiration, primary.Expiration) {
+				if _, err := s.db.resetShard(ctx, name, shard, updated.Expiration); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return updated, nil
+	}
+}
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	ctx, cancel := s.db.context(context.Background())
+	defer cancel()
+	updated, err := s.updateLimits(ctx, name, capacity, rate)
+	if err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	state := leakybucket.BucketState{
+		Capacity:  capacity,
+		Remaining: capacity,
+		Reset:     s.db.now().Add(rate),
+	}
+	if updated != nil && !s.db.expired(updated) {
+		state.Remaining = capacity - min(updated.Value, capacity)
+		state.Reset = updated.Expiration
+	}
+	return state, nil
 }
 
 func min(a, b uint) uint {
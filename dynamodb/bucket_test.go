@@ -6,7 +6,8 @@ import (
 	"testing"
 	"time"
 
-	"github.com/Clever/leakybucket/test"
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -15,6 +16,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func testRequiredEnv(t *testing.T, key string) string {
@@ -27,7 +30,7 @@ func testRequiredEnv(t *testing.T, key string) string {
 	return val
 }
 
-func testStorage(t *testing.T) *Storage {
+func testStorage(t *testing.T, opts ...Option) *Storage {
 	table := "test-table"
 
 	// Create custom config for testing
@@ -58,7 +61,7 @@ func testStorage(t *testing.T) *Storage {
 	deleteTable(db)
 	err = createTable(db)
 	require.NoError(t, err)
-	storage, err := New(table, cfg, 10*time.Second)
+	storage, err := New(table, cfg, 10*time.Second, opts...)
 	require.NoError(t, err)
 
 	return storage
@@ -88,6 +91,75 @@ func TestBucketInstanceConsistencyTest(t *testing.T) {
 	test.BucketInstanceConsistencyTest(testStorage(t))(t)
 }
 
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(testStorage(t))(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	test.ReconfigureTest(testStorage(t, WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(testStorage(t))(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	test.UpdateLimitsProportionalTest(testStorage(t, WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	test.ReleaseTest(testStorage(t))(t)
+}
+
+func TestShardedCreate(t *testing.T) {
+	test.CreateTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedAdd(t *testing.T) {
+	test.AddTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedReset(t *testing.T) {
+	test.AddResetTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedBucketInstanceConsistencyTest(t *testing.T) {
+	test.BucketInstanceConsistencyTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedReconfigure(t *testing.T) {
+	test.ReconfigureTest(testStorage(t, WithShards(4), WithReconfigure()))(t)
+}
+
+func TestShardedUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestShardedRelease(t *testing.T) {
+	test.ReleaseTest(testStorage(t, WithShards(4)))(t)
+}
+
+func TestClockSkew(t *testing.T) {
+	fast := testStorage(t, WithSkewTolerance(3*time.Second), WithClock(func() time.Time {
+		return time.Now().Add(2 * time.Second)
+	}))
+	// creating the second storage recreates the table, which is still empty
+	slow := testStorage(t, WithSkewTolerance(3*time.Second))
+	test.ClockSkewTest(fast, slow)(t)
+}
+
 // package specific tests
 func TestNoTable(t *testing.T) {
 	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
@@ -129,7 +201,7 @@ func TestBucketTTL(t *testing.T) {
 	require.NoError(t, err)
 
 	time.Sleep(s.db.ttl + 10*time.Second)
-	dbBucket, err := s.db.bucket("testbucket")
+	dbBucket, err := s.db.bucket(context.Background(), "testbucket")
 	if err == nil {
 		t.Log("bucket not yet deleted. TTL: ", dbBucket.TTL)
 		require.NotNil(t, dbBucket)
@@ -142,3 +214,48 @@ func TestBucketTTL(t *testing.T) {
 	_, err = bucket.Add(1)
 	require.NoError(t, err)
 }
+
+// TestShardedWindow makes sure shards left over from a previous window don't count towards the
+// current one.
+func TestShardedWindow(t *testing.T) {
+	s := testStorage(t, WithShards(4))
+
+	bucket, err := s.Create("testbucket", 8, time.Second)
+	require.NoError(t, err)
+	for i := 0; i < 8; i++ {
+		_, err := bucket.Add(1)
+		require.NoError(t, err)
+	}
+	_, err = bucket.Add(1)
+	require.Equal(t, leakybucket.ErrorFull, err)
+
+	time.Sleep(2 * time.Second)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(7), state.Remaining)
+}
+
+// BatchGetItem reads up to 100 items at a time.
+func TestManyShards(t *testing.T) {
+	test.AddTest(testStorage(t, WithShards(150)))(t)
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s := testStorage(t, WithTracerProvider(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	bucket, err := s.CreateContext(ctx, "testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = leakybucket.AddContext(ctx, bucket, 1)
+	require.NoError(t, err)
+	parent.End()
+
+	spans := recorder.Ended()
+	require.True(t, len(spans) > 1)
+	for _, span := range spans[:len(spans)-1] {
+		require.Contains(t, span.Name(), "DynamoDB.")
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+}
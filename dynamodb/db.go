@@ -6,21 +6,41 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/Clever/leakybucket/v2"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/eapache/go-resiliency/retrier"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	errBucketCapacityExceeded = errors.New("bucket capacity exceeded")
 	errBucketNotFound         = errors.New("bucket not found")
+	errBucketConflict         = errors.New("bucket changed concurrently")
 )
 
 type bucketDB struct {
 	ddb       *dynamodb.Client
 	tableName string
 	ttl       time.Duration
+	// retrier and budget implement the RetryPolicy
+	retrier *retrier.Retrier
+	budget  time.Duration
+	// clock and skew implement WithClock and WithSkewTolerance
+	clock func() time.Time
+	skew  time.Duration
+	// tracer implements WithTracerProvider
+	tracer trace.Tracer
+}
+
+func (db bucketDB) now() time.Time {
+	if db.clock != nil {
+		return db.clock()
+	}
+	return time.Now()
 }
 
 type ddbBucketStatePrimaryKey struct {
@@ -59,22 +79,28 @@ type ddbBucket struct {
 	Value uint `dynamodbav:"value"`
 	// Version is an internal field used to control flushing/draining the Value field concurrently
 	Version uint `dynamodbav:"version"`
+	// Capacity and Rate are the configuration the bucket was created with. Buckets written by older
+	// versions of this package, as well as shards other than the first, don't have them.
+	Capacity uint          `dynamodbav:"capacity,omitempty"`
+	Rate     time.Duration `dynamodbav:"rate,omitempty"`
 	// TTL is an internal attribute to define how long the item will live in dynamodb prior to being
 	// set for removal. This TTL mechanism is only used for good hygiene to ensure we don't leave
 	// unused buckets in the database forever
 	TTL time.Time `dynamodbav:"_ttl,unixtime"`
 }
 
-func newDDBBucket(name string, expiresIn time.Duration, ttl time.Duration) ddbBucket {
-	now := time.Now()
+func (db bucketDB) newBucket(name string, capacity uint, rate time.Duration) ddbBucket {
+	now := db.now()
 	return ddbBucket{
 		ddbBucketStatePrimaryKey: ddbBucketStatePrimaryKey{
 			Name: name,
 		},
-		Expiration: now.Add(expiresIn),
+		Expiration: now.Add(rate),
 		Value:      0,
 		Version:    0,
-		TTL:        now.Add(ttl),
+		Capacity:   capacity,
+		Rate:       rate,
+		TTL:        now.Add(db.ttl),
 	}
 }
 
@@ -90,8 +116,28 @@ func encodeBucket(b ddbBucket) (map[string]types.AttributeValue, error) {
 	return attributevalue.MarshalMap(b)
 }
 
-func (b *ddbBucket) expired() bool {
-	return time.Now().After(b.Expiration)
+// expired reports whether the bucket's window is over, giving other clients' clocks the benefit of
+// the doubt up to the skew tolerance.
+func (db bucketDB) expired(b *ddbBucket) bool {
+	return db.now().After(b.Expiration.Add(db.skew))
+}
+
+// configMismatch returns a *leakybucket.ConfigMismatchError if the bucket was persisted with a
+// different configuration.
+func (b *ddbBucket) configMismatch(capacity uint, rate time.Duration) error {
+	if b.Capacity == 0 && b.Rate == 0 {
+		// persisted before the configuration was
+		return nil
+	} else if b.Capacity == capacity && b.Rate == rate {
+		return nil
+	}
+	return &leakybucket.ConfigMismatchError{
+		Name:              b.Name,
+		Capacity:          b.Capacity,
+		Rate:              b.Rate,
+		RequestedCapacity: capacity,
+		RequestedRate:     rate,
+	}
 }
 
 func (db bucketDB) key(name string) (map[string]types.AttributeValue, error) {
@@ -100,49 +146,60 @@ func (db bucketDB) key(name string) (map[string]types.AttributeValue, error) {
 	})
 }
 
-func (db bucketDB) bucket(name string) (*ddbBucket, error) {
+func (db bucketDB) bucket(ctx context.Context, name string) (*ddbBucket, error) {
 	key, err := db.key(name)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	res, err := db.ddb.GetItem(ctx, &dynamodb.GetItemInput{
-		Key:            key,
-		TableName:      aws.String(db.tableName),
-		ConsistentRead: aws.Bool(true),
+	var res *dynamodb.GetItemOutput
+	err = db.call(ctx, "GetItem", func(ctx context.Context) error {
+		var err error
+		res, err = db.ddb.GetItem(ctx, &dynamodb.GetItemInput{
+			Key:            key,
+			TableName:      aws.String(db.tableName),
+			ConsistentRead: aws.Bool(true),
+		})
+		return err
 	})
 	var rnfe *types.ResourceNotFoundException
-	if errors.As(err, &rnfe) || len(res.Item) == 0 {
+	if errors.As(err, &rnfe) {
 		return nil, errBucketNotFound
 	} else if err != nil {
 		return nil, err
+	} else if len(res.Item) == 0 {
+		return nil, errBucketNotFound
 	}
 
 	return decodeBucket(res.Item)
 }
 
-func (db bucketDB) findOrCreateBucket(name string, expiresIn time.Duration) (*ddbBucket, error) {
-	dbBucket, err := db.bucket(name)
+func (db bucketDB) findOrCreateBucket(ctx context.Context, name string, capacity uint, rate time.Duration) (*ddbBucket, error) {
+	dbBucket, err := db.bucket(ctx, name)
 	if err == nil {
 		return dbBucket, nil
 	} else if err != errBucketNotFound {
 		return nil, err
 	}
+	return db.createBucket(ctx, name, capacity, rate)
+}
 
-	// otherwise create the bucket
-	bucket := newDDBBucket(name, expiresIn, db.ttl)
+// createBucket creates a bucket, or reads it if another consumer created it first.
+func (db bucketDB) createBucket(ctx context.Context, name string, capacity uint, rate time.Duration) (*ddbBucket, error) {
+	bucket := db.newBucket(name, capacity, rate)
 	data, err := encodeBucket(bucket)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	_, err = db.ddb.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(db.tableName),
-		Item:      data,
-		ExpressionAttributeNames: map[string]string{
-			"#N": "name",
-		},
-		ConditionExpression: aws.String("attribute_not_exists(#N)"),
+	err = db.call(ctx, "PutItem", func(ctx context.Context) error {
+		_, err := db.ddb.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(db.tableName),
+			Item:      data,
+			ExpressionAttributeNames: map[string]string{
+				"#N": "name",
+			},
+			ConditionExpression: aws.String("attribute_not_exists(#N)"),
+		})
+		return err
 	})
 	if err != nil {
 		var ccfe *types.ConditionalCheckFailedException
@@ -151,35 +208,39 @@ func (db bucketDB) findOrCreateBucket(name string, expiresIn time.Duration) (*dd
 		}
 		// insane edge case because we know we can have multiple consumers
 		// for existing buckets simply re-fetch
-		return db.bucket(bucket.Name)
+		return db.bucket(ctx, bucket.Name)
 	}
 
 	return &bucket, err
 }
 
-func (db bucketDB) incrementBucketValue(name string, amount, capacity uint) (*ddbBucket, error) {
+func (db bucketDB) incrementBucketValue(ctx context.Context, name string, amount, capacity uint) (*ddbBucket, error) {
 	key, err := db.key(name)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	res, err := db.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		Key:       key,
-		TableName: aws.String(db.tableName),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":a": &types.AttributeValueMemberN{
-				Value: fmt.Sprintf("%d", amount),
+	var res *dynamodb.UpdateItemOutput
+	err = db.call(ctx, "UpdateItem", func(ctx context.Context) error {
+		var err error
+		res, err = db.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key:       key,
+			TableName: aws.String(db.tableName),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":a": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", amount),
+				},
+				":c": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", capacity),
+				},
 			},
-			":c": &types.AttributeValueMemberN{
-				Value: fmt.Sprintf("%d", capacity),
+			ExpressionAttributeNames: map[string]string{
+				"#V": "value",
 			},
-		},
-		ExpressionAttributeNames: map[string]string{
-			"#V": "value",
-		},
-		ReturnValues:        types.ReturnValueAllNew,
-		UpdateExpression:    aws.String("SET #V = #V + :a"),
-		ConditionExpression: aws.String("#V <= :c"),
+			ReturnValues:        types.ReturnValueAllNew,
+			UpdateExpression:    aws.String("SET #V = #V + :a"),
+			ConditionExpression: aws.String("#V <= :c"),
+		})
+		return err
 	})
 	if err != nil {
 		var ccfe *types.ConditionalCheckFailedException
@@ -191,30 +252,36 @@ func (db bucketDB) incrementBucketValue(name string, amount, capacity uint) (*dd
 	return decodeBucket(res.Attributes)
 }
 
-// resetBucket will reset the bucket's value to 0 iff the versions match
-func (db bucketDB) resetBucket(bucket ddbBucket, expiresIn time.Duration) (*ddbBucket, error) {
+func nextVersion(version uint) uint {
 	// dbMaxVersion is an arbitrary constant to prevent the version field from overflowing
 	var dbMaxVersion uint = 2 << 28
-	newVersion := bucket.Version + 1
+	newVersion := version + 1
 	if newVersion > dbMaxVersion {
 		newVersion = 0
 	}
-	updatedBucket := newDDBBucket(bucket.ddbBucketStatePrimaryKey.Name, expiresIn, db.ttl)
-	updatedBucket.Version = newVersion
+	return newVersion
+}
+
+// resetBucket will reset the bucket's value to 0 iff the versions match
+func (db bucketDB) resetBucket(ctx context.Context, bucket ddbBucket, capacity uint, rate time.Duration) (*ddbBucket, error) {
+	updatedBucket := db.newBucket(bucket.ddbBucketStatePrimaryKey.Name, capacity, rate)
+	updatedBucket.Version = nextVersion(bucket.Version)
 	data, err := encodeBucket(updatedBucket)
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
-	_, err = db.ddb.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(db.tableName),
-		Item:      data,
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":v": &types.AttributeValueMemberN{
-				Value: fmt.Sprintf("%d", bucket.Version),
+	err = db.call(ctx, "PutItem", func(ctx context.Context) error {
+		_, err := db.ddb.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(db.tableName),
+			Item:      data,
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", bucket.Version),
+				},
 			},
-		},
-		ConditionExpression: aws.String("version = :v"),
+			ConditionExpression: aws.String("version = :v"),
+		})
+		return err
 	})
 	if err != nil {
 		var ccfe *types.ConditionalCheckFailedException
@@ -223,7 +290,266 @@ func (db bucketDB) resetBucket(bucket ddbBucket, expiresIn time.Duration) (*ddbB
 		}
 		// A conditional check failing means another consumer of this bucket reset at the same time.
 		// We can simply swallow the error and re-fetch the bucket
-		return db.bucket(bucket.Name)
+		return db.bucket(ctx, bucket.Name)
 	}
 	return &updatedBucket, nil
 }
+
+// maxBatchGetKeys is how many keys BatchGetItem reads at most. It may read fewer when it's throttled,
+// returning the rest as unprocessed keys.
+const maxBatchGetKeys = 100
+
+// buckets fetches the buckets with the given names. The result is keyed by name and omits buckets
+// that don't exist.
+func (db bucketDB) buckets(ctx context.Context, names []string) (map[string]*ddbBucket, error) {
+	keys := make([]map[string]types.AttributeValue, 0, len(names))
+	for _, name := range names {
+		key, err := db.key(name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	found := make(map[string]*ddbBucket, len(names))
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > maxBatchGetKeys {
+			batch = batch[:maxBatchGetKeys]
+		}
+		keys = keys[len(batch):]
+		err := db.call(ctx, "BatchGetItem", func(ctx context.Context) error {
+			res, err := db.ddb.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{
+					db.tableName: {
+						Keys:           batch,
+						ConsistentRead: aws.Bool(true),
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			for _, item := range res.Responses[db.tableName] {
+				b, err := decodeBucket(item)
+				if err != nil {
+					return err
+				}
+				found[b.Name] = b
+			}
+			// DynamoDB leaves keys unprocessed when it's throttled, retry them as such
+			if unprocessed := res.UnprocessedKeys[db.tableName].Keys; len(unprocessed) > 0 {
+				batch = unprocessed
+				return errUnprocessedKeys
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// resetShard empties a shard and moves it into the window ending at expiration. prev is the
+// current state of the shard, or nil if it doesn't exist yet. Like resetBucket, the reset only
+// happens iff nobody else has reset the shard in the meantime.
+func (db bucketDB) resetShard(ctx context.Context, name string, prev *ddbBucket, expiration time.Time) (*ddbBucket, error) {
+	shard := db.newBucket(name, 0, 0)
+	shard.Expiration = expiration
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(db.tableName),
+	}
+	if prev == nil {
+		input.ExpressionAttributeNames = map[string]string{
+			"#N": "name",
+		}
+		input.ConditionExpression = aws.String("attribute_not_exists(#N)")
+	} else {
+		shard.Version = nextVersion(prev.Version)
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{
+				Value: fmt.Sprintf("%d", prev.Version),
+			},
+		}
+		input.ConditionExpression = aws.String("version = :v")
+	}
+	data, err := encodeBucket(shard)
+	if err != nil {
+		return nil, err
+	}
+	input.Item = data
+	if err := db.call(ctx, "PutItem", func(ctx context.Context) error {
+		_, err := db.ddb.PutItem(ctx, input)
+		return err
+	}); err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccfe) {
+			return nil, err
+		}
+		// someone else reset the shard first
+		return db.bucket(ctx, name)
+	}
+	return &shard, nil
+}
+
+// incrementShardValue adds amount to a shard iff the shard is still in the window ending at
+// expiration and its value is at most limit.
+func (db bucketDB) incrementShardValue(ctx context.Context, name string, amount, limit uint, expiration time.Time) (*ddbBucket, error) {
+	key, err := db.key(name)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := attributevalue.Marshal(attributevalue.UnixTime(expiration))
+	if err != nil {
+		return nil, err
+	}
+	var res *dynamodb.UpdateItemOutput
+	err = db.call(ctx, "UpdateItem", func(ctx context.Context) error {
+		var err error
+		res, err = db.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key:       key,
+			TableName: aws.String(db.tableName),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":a": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", amount),
+				},
+				":l": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", limit),
+				},
+				":e": exp,
+			},
+			ExpressionAttributeNames: map[string]string{
+				"#V": "value",
+				"#E": "expiration",
+			},
+			ReturnValues:        types.ReturnValueAllNew,
+			UpdateExpression:    aws.String("SET #V = #V + :a"),
+			ConditionExpression: aws.String("#V <= :l AND #E = :e"),
+		})
+		return err
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return nil, errBucketCapacityExceeded
+		}
+		return nil, err
+	}
+	return decodeBucket(res.Attributes)
+}
+
+// updateBucket overwrites a bucket iff nobody else has changed it since it was read as prev.
+func (db bucketDB) updateBucket(ctx context.Context, prev ddbBucket, value, capacity uint, rate time.Duration, expiration time.Time) (*ddbBucket, error) {
+	updatedBucket := db.newBucket(prev.Name, capacity, rate)
+	updatedBucket.Expiration = expiration
+	updatedBucket.Value = value
+	updatedBucket.Version = nextVersion(prev.Version)
+	data, err := encodeBucket(updatedBucket)
+	if err != nil {
+		return nil, err
+	}
+	err = db.call(ctx, "PutItem", func(ctx context.Context) error {
+		_, err := db.ddb.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(db.tableName),
+			Item:      data,
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", prev.Version),
+				},
+				":val": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", prev.Value),
+				},
+			},
+			ExpressionAttributeNames: map[string]string{
+				"#V": "value",
+			},
+			ConditionExpression: aws.String("version = :v AND #V = :val"),
+		})
+		return err
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return nil, errBucketConflict
+		}
+		return nil, err
+	}
+	return &updatedBucket, nil
+}
+
+// decrementValue removes amount from an item iff the item is still in the window ending at
+// expiration and its value is at least amount.
+func (db bucketDB) decrementValue(ctx context.Context, name string, amount uint, expiration time.Time) (*ddbBucket, error) {
+	key, err := db.key(name)
+	if err != nil {
+		return nil, err
+	}
+	exp, err := attributevalue.Marshal(attributevalue.UnixTime(expiration))
+	if err != nil {
+		return nil, err
+	}
+	var res *dynamodb.UpdateItemOutput
+	err = db.call(ctx, "UpdateItem", func(ctx context.Context) error {
+		var err error
+		res, err = db.ddb.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			Key:       key,
+			TableName: aws.String(db.tableName),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":a": &types.AttributeValueMemberN{
+					Value: fmt.Sprintf("%d", amount),
+				},
+				":e": exp,
+			},
+			ExpressionAttributeNames: map[string]string{
+				"#V": "value",
+				"#E": "expiration",
+			},
+			ReturnValues:        types.ReturnValueAllNew,
+			UpdateExpression:    aws.String("SET #V = #V - :a"),
+			ConditionExpression: aws.String("#V >= :a AND #E = :e"),
+		})
+		return err
+	})
+	if err != nil {
+		var ccfe *types.ConditionalCheckFailedException
+		if errors.As(err, &ccfe) {
+			return nil, errBucketConflict
+		}
+		return nil, err
+	}
+	return decodeBucket(res.Attributes)
+}
+
+// release removes up to amount from the items with the given names, the first of which holds the
+// bucket's configuration, that are in the window ending at expiration. It returns the total value
+// of the items in that window, and whether the bucket is still in it with the given configuration.
+// Items changed concurrently are left alone.
+func (db bucketDB) release(ctx context.Context, names []string, amount, capacity uint, rate time.Duration, expiration time.Time) (uint, bool, error) {
+	items, err := db.buckets(ctx, names)
+	if err != nil {
+		return 0, false, err
+	}
+	primary := items[names[0]]
+	if primary == nil || !sameWindow(primary.Expiration, expiration) || primary.configMismatch(capacity, rate) != nil {
+		return 0, false, nil
+	}
+	var total uint
+	for _, name := range names {
+		item := items[name]
+		if item == nil || !sameWindow(item.Expiration, expiration) {
+			continue
+		}
+		value := item.Value
+		if n := min(amount, value); n > 0 {
+			updated, err := db.decrementValue(ctx, name, n, expiration)
+			if err == nil {
+				value = updated.Value
+				amount -= n
+			} else if err != errBucketConflict {
+				return 0, false, err
+			}
+		}
+		total += value
+	}
+	return total, true, nil
+}
@@ -0,0 +1,150 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/eapache/go-resiliency/retrier"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrThrottled matches, using errors.Is, any error caused by DynamoDB throttling a request that the
+// retry policy gave up on. Callers may use it to decide whether to fail open or closed.
+var ErrThrottled = errors.New("dynamodb throttled the request")
+
+// RequestError is returned by Storage.Create and Bucket.Add when a DynamoDB request fails for
+// reasons other than the bucket being full.
+type RequestError struct {
+	// Op is the DynamoDB operation that failed, e.g. "UpdateItem".
+	Op string
+	// Throttled is true if DynamoDB was throttling the request, as opposed to rejecting it or
+	// being unreachable.
+	Throttled bool
+	// Err is the last error encountered.
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	if e.Throttled {
+		return fmt.Sprintf("dynamodb %s throttled: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("dynamodb %s failed: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether a throttled RequestError matches ErrThrottled.
+func (e *RequestError) Is(target error) bool {
+	return target == ErrThrottled && e.Throttled
+}
+
+// RetryPolicy controls how Storage.Create and Bucket.Add retry DynamoDB requests that were
+// throttled or failed transiently. Conditional check failures are part of normal operation and are
+// never retried. Keys left unprocessed by BatchGetItem, which reads sharded buckets, are retried as
+// throttled. Retries happen on top of whatever the aws.Config passed to New is configured to do.
+type RetryPolicy struct {
+	// Backoff is how long to wait before each retry. Its length is the maximum number of retries
+	// of a single request.
+	Backoff []time.Duration
+	// Jitter randomizes each backoff by up to this factor, between 0 and 1.
+	Jitter float64
+	// Budget bounds the total time a single Create or Add may spend on requests and retries.
+	// Zero means no bound.
+	Budget time.Duration
+}
+
+// WithRetryPolicy configures how a Storage retries DynamoDB requests. By default no requests are
+// retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(s *Storage) {
+		r := retrier.New(p.Backoff, requestRetrier{})
+		r.SetJitter(p.Jitter)
+		s.db.retrier = r
+		s.db.budget = p.Budget
+	}
+}
+
+// errUnprocessedKeys is returned by BatchGetItem requests that left keys unprocessed, which DynamoDB
+// does instead of failing them when it's throttled.
+var errUnprocessedKeys = errors.New("keys left unprocessed")
+
+func isThrottle(err error) bool {
+	return errors.Is(err, errUnprocessedKeys) ||
+		retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var ccfe *types.ConditionalCheckFailedException
+	return errors.As(err, &ccfe)
+}
+
+// requestRetrier classifies throttling and transient errors from the DynamoDB API as retryable.
+// Conditional check failures and other client errors fail immediately.
+type requestRetrier struct{}
+
+var _ retrier.Classifier = requestRetrier{}
+
+func (requestRetrier) Classify(err error) retrier.Action {
+	if err == nil {
+		return retrier.Succeed
+	} else if isConditionalCheckFailed(err) {
+		return retrier.Fail
+	} else if isThrottle(err) {
+		return retrier.Retry
+	} else if retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary {
+		return retrier.Retry
+	}
+	return retrier.Fail
+}
+
+// context returns the context bounding a single Create or Add.
+func (db bucketDB) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if db.budget > 0 {
+		return context.WithTimeout(parent, db.budget)
+	}
+	return context.WithCancel(parent)
+}
+
+// call runs a single DynamoDB request according to the retry policy. Conditional check failures
+// are returned as is, as callers handle them; every other error is wrapped in a RequestError.
+func (db bucketDB) call(ctx context.Context, op string, request func(context.Context) error) error {
+	ctx, span := db.tracer.Start(ctx, "DynamoDB."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "DynamoDB"),
+		attribute.String("rpc.method", op),
+		attribute.String("aws.dynamodb.table_names", db.tableName),
+	))
+	defer span.End()
+	r := db.retrier
+	if r == nil {
+		r = retrier.New(nil, requestRetrier{})
+	}
+	var last error
+	attempts := 0
+	err := r.RunCtx(ctx, func(ctx context.Context) error {
+		attempts++
+		last = request(ctx)
+		return last
+	})
+	span.SetAttributes(attribute.Int("leakybucket.attempts", attempts))
+	if err == nil || isConditionalCheckFailed(err) {
+		return err
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return &RequestError{
+		Op:        op,
+		Throttled: isThrottle(last),
+		Err:       err,
+	}
+}
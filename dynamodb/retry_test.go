@@ -0,0 +1,35 @@
+package dynamodb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/eapache/go-resiliency/retrier"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestRetrierClassify(t *testing.T) {
+	c := requestRetrier{}
+	require.Equal(t, retrier.Succeed, c.Classify(nil))
+	require.Equal(t, retrier.Retry, c.Classify(&types.ProvisionedThroughputExceededException{}))
+	require.Equal(t, retrier.Retry, c.Classify(&types.RequestLimitExceeded{}))
+	require.Equal(t, retrier.Retry, c.Classify(errUnprocessedKeys))
+	require.Equal(t, retrier.Fail, c.Classify(&types.ConditionalCheckFailedException{}))
+	require.Equal(t, retrier.Fail, c.Classify(&types.ResourceNotFoundException{}))
+}
+
+func TestRequestError(t *testing.T) {
+	cause := &types.ProvisionedThroughputExceededException{}
+	var err error = &RequestError{Op: "UpdateItem", Throttled: true, Err: cause}
+	require.True(t, errors.Is(err, ErrThrottled))
+	var ptee *types.ProvisionedThroughputExceededException
+	require.True(t, errors.As(err, &ptee))
+
+	err = &RequestError{Op: "BatchGetItem", Throttled: isThrottle(errUnprocessedKeys), Err: errUnprocessedKeys}
+	require.True(t, errors.Is(err, ErrThrottled))
+
+	err = &RequestError{Op: "UpdateItem", Err: errors.New("boom")}
+	require.False(t, errors.Is(err, ErrThrottled))
+}
@@ -0,0 +1,234 @@
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+var (
+	_ leakybucket.ContextBucket = &shardedBucket{}
+	_ leakybucket.Releaser      = &shardedBucket{}
+)
+
+// shardedBucket is a bucket whose value is spread across several items. The first shard is
+// stored under the bucket's own name and owns the bucket's window: the remaining shards only count
+// towards the bucket while their expiration matches the first shard's.
+type shardedBucket struct {
+	name                string
+	capacity, remaining uint
+	reset               time.Time
+	rate                time.Duration
+	shards              int
+	db                  bucketDB
+	mutex               sync.Mutex
+}
+
+// shardName returns the name of the item holding the i-th shard of a bucket.
+func shardName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s#shard-%d", name, i)
+}
+
+// shardNames returns the names of every shard of a bucket but the first.
+func shardNames(name string, shards int) []string {
+	names := make([]string, 0, shards-1)
+	for i := 1; i < shards; i++ {
+		names = append(names, shardName(name, i))
+	}
+	return names
+}
+
+func sameWindow(a, b time.Time) bool {
+	return a.Unix() == b.Unix()
+}
+
+// Capacity ...
+func (b *shardedBucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *shardedBucket) Remaining() uint {
+	return b.remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *shardedBucket) Reset() time.Time {
+	return b.reset
+}
+
+// read fetches every shard of the bucket in a single batch, creating the first shard if it doesn't
+// exist yet. It returns the first shard, which holds the bucket's configuration, and the remaining
+// shards keyed by name.
+func (b *shardedBucket) read(ctx context.Context) (*ddbBucket, map[string]*ddbBucket, error) {
+	shards, err := b.db.buckets(ctx, append([]string{b.name}, shardNames(b.name, b.shards)...))
+	if err != nil {
+		return nil, nil, err
+	}
+	primary, ok := shards[b.name]
+	if !ok {
+		if primary, err = b.db.createBucket(ctx, b.name, b.capacity, b.rate); err != nil {
+			return nil, nil, err
+		}
+	}
+	delete(shards, b.name)
+	return primary, shards, nil
+}
+
+// window resets the window of the bucket if it has expired, and returns the first shard and the
+// total value of the current window.
+func (b *shardedBucket) window(ctx context.Context, primary *ddbBucket, shards map[string]*ddbBucket) (*ddbBucket, uint, error) {
+	if b.db.expired(primary) {
+		var err error
+		if primary, err = b.db.resetBucket(ctx, *primary, b.capacity, b.rate); err != nil {
+			return nil, 0, err
+		}
+	}
+	total := primary.Value
+	for _, shard := range shards {
+		if sameWindow(shard.Expiration, primary.Expiration) {
+			total += shard.Value
+		}
+	}
+	return primary, total, nil
+}
+
+// load fetches every shard of the bucket, resetting the window if it has expired. It returns the
+// first shard, the remaining shards keyed by name, and the total value of the current window.
+func (b *shardedBucket) load(ctx context.Context) (*ddbBucket, map[string]*ddbBucket, uint, error) {
+	primary, shards, err := b.read(ctx)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if err := primary.configMismatch(b.capacity, b.rate); err != nil {
+		return nil, nil, 0, err
+	}
+	primary, total, err := b.window(ctx, primary, shards)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return primary, shards, total, nil
+}
+
+// Add to the bucket.
+func (b *shardedBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket, tracing the DynamoDB requests it makes as children of ctx's span.
+func (b *shardedBucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ctx, cancel := b.db.context(ctx)
+	defer cancel()
+	primary, shards, total, err := b.load(ctx)
+	if err != nil {
+		return b.state(), err
+	}
+	// update local state
+	b.remaining = b.capacity - min(total, b.capacity)
+	b.reset = primary.Expiration
+	if amount > b.remaining {
+		return b.state(), leakybucket.ErrorFull
+	}
+
+	name := shardName(b.name, rand.Intn(b.shards))
+	shard := primary
+	if name != b.name {
+		shard = shards[name]
+		if shard == nil || !sameWindow(shard.Expiration, primary.Expiration) {
+			// the shard is left over from a previous window (or was never written to)
+			if shard != nil {
+				total -= shard.Value
+			}
+			shard, err = b.db.resetShard(ctx, name, shard, primary.Expiration)
+			if err != nil {
+				return b.state(), err
+			}
+			if !sameWindow(shard.Expiration, primary.Expiration) {
+				// lost a race with a consumer resetting the shard into another window
+				return b.state(), leakybucket.ErrorFull
+			}
+			total += shard.Value
+		}
+	}
+	// the shard may only grow up to whatever the other shards have left over
+	others := total - shard.Value
+	limit := b.capacity - min(others+amount, b.capacity)
+	updatedShard, err := b.db.incrementShardValue(ctx, name, amount, limit, primary.Expiration)
+	if err != nil {
+		if err == errBucketCapacityExceeded {
+			return b.state(), leakybucket.ErrorFull
+		}
+		return b.state(), err
+	}
+	// ensure we can't overflow
+	b.remaining = b.capacity - min(others+updatedShard.Value, b.capacity)
+	return b.state(), nil
+}
+
+// Release space added to the bucket in the window ending at reset.
+func (b *shardedBucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ctx, cancel := b.db.context(context.Background())
+	defer cancel()
+	names := append([]string{b.name}, shardNames(b.name, b.shards)...)
+	total, ok, err := b.db.release(ctx, names, amount, b.capacity, b.rate, reset)
+	if err != nil {
+		return b.state(), err
+	} else if ok {
+		b.remaining = b.capacity - min(total, b.capacity)
+		b.reset = reset
+	}
+	return b.state(), nil
+}
+
+func (b *shardedBucket) state() leakybucket.BucketState {
+	return leakybucket.BucketState{
+		Capacity:  b.Capacity(),
+		Remaining: b.Remaining(),
+		Reset:     b.Reset(),
+	}
+}
+
+func (s *Storage) createSharded(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	bucket := &shardedBucket{
+		name:      name,
+		capacity:  capacity,
+		remaining: capacity,
+		reset:     s.db.now().Add(rate),
+		rate:      rate,
+		shards:    s.shards,
+		db:        s.db,
+	}
+	ctx, cancel := s.db.context(ctx)
+	defer cancel()
+	primary, shards, err := bucket.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configured, err := s.configure(ctx, primary, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+	if configured != primary {
+		// reconfiguring moved the value of every shard to the first one
+		shards = nil
+	}
+	primary, total, err := bucket.window(ctx, configured, shards)
+	if err != nil {
+		return nil, err
+	}
+	bucket.remaining = capacity - min(total, capacity)
+	bucket.reset = primary.Expiration
+
+	return bucket, nil
+}
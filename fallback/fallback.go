@@ -0,0 +1,354 @@
+// Package fallback provides a leakybucket.Storage decorator deciding what happens to requests when
+// the underlying storage, e.g. redis or dynamodb, is unreachable. Each class of buckets has a
+// Policy:
+//
+//   - FailOpen allows every request.
+//   - FailClosed rejects every request with leakybucket.ErrorFull.
+//   - Local(scale) limits requests with a local in-memory bucket of the bucket's capacity scaled
+//     by scale, e.g. 1/n for a fleet of n hosts. Once the storage recovers, the usage of local
+//     buckets is added to the storage's, so that it isn't granted twice within a window, as the
+//     storage's buckets have space for it.
+//
+// Usage:
+//
+//	storage := fallback.New(redisStorage,
+//		fallback.WithClass(func(name string) string { return strings.SplitN(name, ":", 2)[0] }),
+//		fallback.WithPolicy("login", fallback.FailClosed),
+//		fallback.WithDefaultPolicy(fallback.Local(0.1)))
+package fallback
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+)
+
+type mode int
+
+const (
+	modeClosed mode = iota
+	modeOpen
+	modeLocal
+)
+
+// Policy decides what happens to requests when the storage fails.
+type Policy struct {
+	mode  mode
+	scale float64
+}
+
+var (
+	// FailOpen allows requests when the storage fails.
+	FailOpen = Policy{mode: modeOpen}
+	// FailClosed rejects requests with leakybucket.ErrorFull when the storage fails.
+	FailClosed = Policy{mode: modeClosed}
+)
+
+// Local limits requests with local buckets of the capacity of the storage's buckets scaled by
+// scale when the storage fails. Local buckets have a capacity of at least 1.
+func Local(scale float64) Policy {
+	return Policy{mode: modeLocal, scale: scale}
+}
+
+func (p Policy) capacity(capacity uint) uint {
+	scaled := uint(math.Floor(float64(capacity) * p.scale))
+	if scaled < 1 {
+		return 1
+	}
+	return scaled
+}
+
+// Fallback applies policies to the operations of a storage that fail, through its Middleware.
+type Fallback struct {
+	class     leakybucket.ClassFunc
+	policies  map[string]Policy
+	fallback  Policy
+	isFailure func(error) bool
+	onFailure func(name string, err error)
+
+	local *memory.Storage
+	// pending maps bucket names to their *pending usage.
+	pending sync.Map
+}
+
+// pending is usage granted by a local bucket that is yet to be added to the storage's bucket.
+type pending struct {
+	mutex  sync.Mutex
+	amount uint
+	// until is when the window the usage was granted in ends, after which it no longer matters.
+	until time.Time
+	// removed is set once the usage is removed from Fallback.pending, to be granted anew.
+	removed bool
+}
+
+// Storage wraps a leakybucket.Storage, applying policies when it fails.
+type Storage struct {
+	leakybucket.ChainedStorage
+	*Fallback
+}
+
+// Option configures optional behavior of a Fallback.
+type Option func(*Fallback)
+
+// WithClass sets the class of buckets policies apply to. By default every bucket's class is
+// "default".
+func WithClass(class leakybucket.ClassFunc) Option {
+	return func(f *Fallback) {
+		f.class = class
+	}
+}
+
+// WithPolicy sets the policy of a class of buckets.
+func WithPolicy(class string, p Policy) Option {
+	return func(f *Fallback) {
+		f.policies[class] = p
+	}
+}
+
+// WithDefaultPolicy sets the policy of classes without a policy of their own. The default is
+// FailClosed.
+func WithDefaultPolicy(p Policy) Option {
+	return func(f *Fallback) {
+		f.fallback = p
+	}
+}
+
+// WithFailureClassifier sets which errors are failures of the storage policies apply to. By
+// default every error is, but leakybucket.ErrorFull and errors matching
+// leakybucket.ErrConfigMismatch.
+func WithFailureClassifier(isFailure func(error) bool) Option {
+	return func(f *Fallback) {
+		f.isFailure = isFailure
+	}
+}
+
+// WithFailureHandler sets a function called with every failure of the storage before its policy
+// applies, e.g. to log it.
+func WithFailureHandler(h func(name string, err error)) Option {
+	return func(f *Fallback) {
+		f.onFailure = h
+	}
+}
+
+// New wraps a storage, applying policies when it fails.
+func New(storage leakybucket.Storage, opts ...Option) *Storage {
+	f := NewFallback(opts...)
+	return &Storage{
+		ChainedStorage: leakybucket.Chain(storage, f.Middleware()),
+		Fallback:       f,
+	}
+}
+
+// NewFallback creates the Fallback used by New, to apply policies to a storage of one's own making
+// with Middleware and leakybucket.Chain.
+func NewFallback(opts ...Option) *Fallback {
+	f := &Fallback{
+		class:    func(string) string { return "default" },
+		policies: map[string]Policy{},
+		fallback: FailClosed,
+		isFailure: func(err error) bool {
+			return err != leakybucket.ErrorFull && !errors.Is(err, leakybucket.ErrConfigMismatch)
+		},
+		onFailure: func(string, error) {},
+		local:     memory.New(memory.WithReconfigure()),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	return f
+}
+
+func (f *Fallback) policy(name string) Policy {
+	if p, ok := f.policies[f.class(name)]; ok {
+		return p
+	}
+	return f.fallback
+}
+
+// Middleware applies policies to the operations of a storage that fail.
+func (f *Fallback) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				b, err := next(ctx, spec)
+				if err != nil && f.isFailure(err) {
+					f.onFailure(spec.Name, err)
+					// adding to the bucket creates it once the storage recovers, until then the
+					// policy applies to adds
+					return &uncreated{spec: spec, create: next}, nil
+				}
+				return b, err
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				state, err := next(ctx, spec, amount)
+				if err == nil || err == leakybucket.ErrorFull {
+					return f.reconcile(ctx, next, spec, state, err)
+				}
+				if !f.isFailure(err) {
+					return state, err
+				}
+				f.onFailure(spec.Name, err)
+				return f.apply(spec, amount)
+			}
+		},
+	}
+}
+
+// apply decides an add according to the policy of its bucket.
+func (f *Fallback) apply(spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+	p := f.policy(spec.Name)
+	switch p.mode {
+	case modeOpen:
+		return leakybucket.BucketState{
+			Capacity:  spec.Capacity,
+			Remaining: spec.Capacity - min(amount, spec.Capacity),
+			Reset:     time.Now().Add(spec.Rate),
+		}, nil
+	case modeLocal:
+		b, err := f.local.Create(spec.Name, p.capacity(spec.Capacity), spec.Rate)
+		if err != nil {
+			return leakybucket.BucketState{}, err
+		}
+		state, err := b.Add(amount)
+		if err == nil {
+			f.owe(spec.Name, amount, state.Reset)
+		}
+		return state, err
+	default:
+		return leakybucket.BucketState{
+			Capacity:  spec.Capacity,
+			Remaining: 0,
+			Reset:     time.Now().Add(spec.Rate),
+		}, leakybucket.ErrorFull
+	}
+}
+
+// reconcile adds the usage granted by a bucket's local bucket, if any, to the storage's bucket
+// now that the storage works again. The storage's bucket may not have space for all of it, in
+// which case it's filled and the rest is added by later adds, until the window it was granted in
+// ends. If the storage fails again, the usage is kept to add later.
+func (f *Fallback) reconcile(ctx context.Context, next leakybucket.AddFunc, spec leakybucket.BucketSpec, state leakybucket.BucketState, err error) (leakybucket.BucketState, error) {
+	v, ok := f.pending.Load(spec.Name)
+	if !ok {
+		return state, err
+	}
+	owed := v.(*pending)
+	owed.mutex.Lock()
+	if time.Now().After(owed.until) {
+		owed.amount = 0
+	}
+	// concurrent adds mustn't add the same usage
+	amount := min(owed.amount, state.Remaining)
+	owed.amount -= amount
+	if owed.amount == 0 {
+		owed.removed = true
+		f.pending.CompareAndDelete(spec.Name, owed)
+	}
+	until := owed.until
+	owed.mutex.Unlock()
+	if amount == 0 {
+		return state, err
+	}
+	reconciled, addErr := next(ctx, spec, amount)
+	switch {
+	case addErr == nil:
+		state = reconciled
+	case f.isFailure(addErr):
+		f.onFailure(spec.Name, addErr)
+		f.owe(spec.Name, amount, until)
+	case addErr == leakybucket.ErrorFull:
+		// the storage's bucket filled up in the meantime
+		f.owe(spec.Name, amount, until)
+	}
+	return state, err
+}
+
+// owe adds usage granted in the window ending at until to the usage yet to be added to the
+// storage's bucket.
+func (f *Fallback) owe(name string, amount uint, until time.Time) {
+	for {
+		v, _ := f.pending.LoadOrStore(name, &pending{})
+		owed := v.(*pending)
+		owed.mutex.Lock()
+		if owed.removed {
+			owed.mutex.Unlock()
+			continue
+		}
+		if time.Now().After(owed.until) {
+			owed.amount = 0
+		}
+		owed.amount += amount
+		if until.After(owed.until) {
+			owed.until = until
+		}
+		owed.mutex.Unlock()
+		return
+	}
+}
+
+// Pending returns how much usage granted by local buckets is yet to be added to the storage's
+// buckets, by bucket name.
+func (f *Fallback) Pending() map[string]uint {
+	amounts := map[string]uint{}
+	f.pending.Range(func(name, v any) bool {
+		owed := v.(*pending)
+		owed.mutex.Lock()
+		defer owed.mutex.Unlock()
+		if time.Now().Before(owed.until) && owed.amount > 0 {
+			amounts[name.(string)] = owed.amount
+		} else if !owed.removed {
+			owed.removed = true
+			f.pending.CompareAndDelete(name, owed)
+		}
+		return true
+	})
+	return amounts
+}
+
+// uncreated is a bucket the storage failed to create. It tries to create it again on every add,
+// failing with the storage's error until it succeeds.
+type uncreated struct {
+	spec   leakybucket.BucketSpec
+	create leakybucket.CreateFunc
+
+	mutex  sync.Mutex
+	bucket leakybucket.Bucket
+}
+
+func (b *uncreated) Capacity() uint {
+	return b.spec.Capacity
+}
+
+func (b *uncreated) Remaining() uint {
+	return b.spec.Capacity
+}
+
+func (b *uncreated) Reset() time.Time {
+	return time.Now().Add(b.spec.Rate)
+}
+
+func (b *uncreated) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+func (b *uncreated) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	bucket := b.bucket
+	if bucket == nil {
+		var err error
+		if bucket, err = b.create(ctx, b.spec); err != nil {
+			b.mutex.Unlock()
+			return leakybucket.BucketState{}, err
+		}
+		b.bucket = bucket
+	}
+	b.mutex.Unlock()
+	return leakybucket.AddContext(ctx, bucket, amount)
+}
@@ -0,0 +1,233 @@
+package fallback
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+var errDown = errors.New("connection refused")
+
+// flaky is a storage that fails while it's down. When downAfter is positive, it counts down the
+// adds that succeed before the storage goes down.
+type flaky struct {
+	leakybucket.Storage
+	down      *atomic.Bool
+	downAfter *atomic.Int32
+}
+
+type flakyBucket struct {
+	leakybucket.Bucket
+	down      *atomic.Bool
+	downAfter *atomic.Int32
+}
+
+func newFlaky() flaky {
+	return flaky{Storage: memory.New(), down: &atomic.Bool{}, downAfter: &atomic.Int32{}}
+}
+
+func (f flaky) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	if f.down.Load() {
+		return nil, errDown
+	}
+	b, err := f.Storage.Create(name, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+	return flakyBucket{b, f.down, f.downAfter}, nil
+}
+
+func (b flakyBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	if b.down.Load() {
+		return leakybucket.BucketState{}, errDown
+	}
+	state, err := b.Bucket.Add(amount)
+	if err == nil && b.downAfter.Add(-1) == 0 {
+		b.down.Store(true)
+	}
+	return state, err
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New()))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New(memory.New()))(t)
+}
+
+func TestPolicies(t *testing.T) {
+	primary := newFlaky()
+	var failures []string
+	s := New(primary,
+		WithClass(func(name string) string { return name }),
+		WithPolicy("open", FailOpen),
+		WithPolicy("local", Local(0.5)),
+		WithFailureHandler(func(name string, err error) {
+			require.Equal(t, errDown, err)
+			failures = append(failures, name)
+		}))
+	primary.down.Store(true)
+
+	open, err := s.Create("open", 4, time.Minute)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		state, err := open.Add(1)
+		require.NoError(t, err)
+		require.Equal(t, uint(3), state.Remaining)
+	}
+
+	closed, err := s.Create("closed", 4, time.Minute)
+	require.NoError(t, err)
+	_, err = closed.Add(1)
+	require.Equal(t, leakybucket.ErrorFull, err)
+
+	local, err := s.Create("local", 4, time.Minute)
+	require.NoError(t, err)
+	state, err := local.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, leakybucket.BucketState{Capacity: 2, Remaining: 1, Reset: state.Reset}, state)
+	_, err = local.Add(1)
+	require.NoError(t, err)
+	_, err = local.Add(1)
+	require.Equal(t, leakybucket.ErrorFull, err)
+	require.Equal(t, map[string]uint{"local": 2}, s.Pending())
+
+	// every add retries creating the bucket, and fails again
+	counts := map[string]int{}
+	for _, name := range failures {
+		counts[name]++
+	}
+	require.Equal(t, map[string]int{"open": 1 + 10, "closed": 1 + 1, "local": 1 + 3}, counts)
+}
+
+func TestRecovery(t *testing.T) {
+	primary := newFlaky()
+	s := New(primary, WithDefaultPolicy(Local(0.5)))
+
+	// the storage fails after the bucket was created
+	bucket, err := s.Create("bucket", 10, time.Minute)
+	require.NoError(t, err)
+	primary.down.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err := bucket.Add(1)
+		require.NoError(t, err)
+	}
+
+	// the storage fails before the bucket is created
+	other, err := s.Create("other", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = other.Add(4)
+	require.NoError(t, err)
+
+	// usage granted locally is added to the storage once it recovers
+	primary.down.Store(false)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(6), state.Remaining)
+	state, err = other.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(5), state.Remaining)
+	require.Empty(t, s.Pending())
+
+	direct, err := primary.Create("bucket", 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(6), direct.Remaining())
+}
+
+func TestReconcileFills(t *testing.T) {
+	primary := newFlaky()
+	s := New(primary, WithDefaultPolicy(Local(1)))
+	bucket, err := s.Create("bucket", 4, time.Minute)
+	require.NoError(t, err)
+	primary.down.Store(true)
+	_, err = bucket.Add(4)
+	require.NoError(t, err)
+	primary.down.Store(false)
+
+	// another host used the storage's bucket in the meantime
+	direct, err := primary.Create("bucket", 4, time.Minute)
+	require.NoError(t, err)
+	_, err = direct.Add(2)
+	require.NoError(t, err)
+
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), state.Remaining)
+	// the rest is added once the storage's bucket has space for it
+	require.Equal(t, map[string]uint{"bucket": 3}, s.Pending())
+}
+
+func TestReconcileConcurrent(t *testing.T) {
+	primary := newFlaky()
+	s := New(primary, WithDefaultPolicy(Local(1)))
+	bucket, err := s.Create("bucket", 100, time.Minute)
+	require.NoError(t, err)
+	primary.down.Store(true)
+	for i := 0; i < 50; i++ {
+		_, err := bucket.Add(1)
+		require.NoError(t, err)
+	}
+	primary.down.Store(false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := bucket.Add(1)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, s.Pending())
+	direct, err := primary.Create("bucket", 100, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), direct.Remaining())
+}
+
+func TestReconcileFailure(t *testing.T) {
+	primary := newFlaky()
+	var failures []error
+	s := New(primary, WithDefaultPolicy(Local(1)), WithFailureHandler(func(_ string, err error) {
+		failures = append(failures, err)
+	}))
+	bucket, err := s.Create("bucket", 10, time.Minute)
+	require.NoError(t, err)
+	primary.down.Store(true)
+	_, err = bucket.Add(3)
+	require.NoError(t, err)
+
+	// the storage recovers, only to fail again while the usage granted locally is added to it
+	primary.down.Store(false)
+	primary.downAfter.Store(1)
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, []error{errDown, errDown}, failures)
+	require.Equal(t, map[string]uint{"bucket": 3}, s.Pending())
+
+	primary.down.Store(false)
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(5), state.Remaining)
+	require.Empty(t, s.Pending())
+}
+
+func TestFailureClassifier(t *testing.T) {
+	primary := newFlaky()
+	s := New(primary, WithDefaultPolicy(FailOpen), WithFailureClassifier(func(err error) bool { return false }))
+	primary.down.Store(true)
+	_, err := s.Create("bucket", 4, time.Minute)
+	require.Equal(t, errDown, err)
+}
@@ -0,0 +1,11 @@
+// Package grpc provides gRPC server interceptors that rate limit calls using leaky buckets from any
+// leakybucket.Storage.
+//
+// Usage:
+//
+//	limiter := leakybucketGRPC.New(storage, 100, time.Minute,
+//		leakybucketGRPC.WithKey(leakybucketGRPC.MetadataValue("x-api-key")))
+//	server := grpc.NewServer(
+//		grpc.UnaryInterceptor(limiter.UnaryServerInterceptor()),
+//		grpc.StreamInterceptor(limiter.StreamServerInterceptor()))
+package grpc
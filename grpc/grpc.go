@@ -0,0 +1,265 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// KeyFunc returns the name of the bucket a call to fullMethod is charged to.
+type KeyFunc func(ctx context.Context, fullMethod string) (string, error)
+
+// CostFunc returns how much a call to fullMethod, or a message received by it, adds to its bucket.
+type CostFunc func(ctx context.Context, fullMethod string) uint
+
+// ErrorHandler decides what happens to a call that could not be rate limited because of err. It
+// returns the error the call fails with, or nil to let the call through.
+type ErrorHandler func(ctx context.Context, fullMethod string, err error) error
+
+// Limiter rate limits calls to a gRPC server.
+type Limiter struct {
+	storage    leakybucket.Storage
+	capacity   uint
+	rate       time.Duration
+	key        KeyFunc
+	cost       CostFunc
+	perMessage bool
+	onError    ErrorHandler
+}
+
+// Option configures optional behavior of a Limiter.
+type Option func(*Limiter)
+
+// WithKey sets how calls are mapped to buckets. By default calls are charged to a bucket per peer
+// address.
+func WithKey(key KeyFunc) Option {
+	return func(l *Limiter) {
+		l.key = key
+	}
+}
+
+// WithCost sets how much each call, or each message with WithPerMessage, adds to its bucket. By
+// default every call adds 1.
+func WithCost(cost CostFunc) Option {
+	return func(l *Limiter) {
+		l.cost = cost
+	}
+}
+
+// WithPerMessage makes the stream interceptor charge every message received from the client instead
+// of charging once when the stream starts. A message that doesn't fit in its bucket fails the
+// stream's RecvMsg with codes.ResourceExhausted. Unary calls are still charged once.
+func WithPerMessage() Option {
+	return func(l *Limiter) {
+		l.perMessage = true
+	}
+}
+
+// WithErrorHandler sets how calls are handled when the storage fails. By default they fail with
+// codes.Unavailable. To let calls through when the storage fails, return nil from the handler.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(l *Limiter) {
+		l.onError = h
+	}
+}
+
+// New creates a Limiter charging calls to buckets of the given capacity and rate.
+func New(storage leakybucket.Storage, capacity uint, rate time.Duration, opts ...Option) *Limiter {
+	l := &Limiter{
+		storage:  storage,
+		capacity: capacity,
+		rate:     rate,
+		key:      PeerAddress,
+		cost:     func(context.Context, string) uint { return 1 },
+		onError: func(ctx context.Context, fullMethod string, err error) error {
+			return status.Error(codes.Unavailable, "rate limit unavailable")
+		},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// UnaryServerInterceptor returns an interceptor only passing on calls while their bucket has space
+// for them.
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := l.limit(ctx, info.FullMethod, grpc.SetHeader)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns an interceptor only passing on streams while their bucket has
+// space for them, or with WithPerMessage, only passing on messages while their bucket has space
+// for them.
+func (l *Limiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if l.perMessage {
+			return handler(srv, &limitedStream{ServerStream: ss, limiter: l, fullMethod: info.FullMethod})
+		}
+		ctx, err := l.limit(ss.Context(), info.FullMethod, func(_ context.Context, md metadata.MD) error {
+			return ss.SetHeader(md)
+		})
+		if err != nil {
+			return err
+		}
+		return handler(srv, &limitedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// limitedStream is a stream whose context carries the state of its bucket and, when charging per
+// message, that charges every message it receives. gRPC allows calling Context while RecvMsg runs
+// on another goroutine, so the context is guarded by a mutex.
+type limitedStream struct {
+	grpc.ServerStream
+	mutex      sync.Mutex
+	ctx        context.Context
+	limiter    *Limiter
+	fullMethod string
+}
+
+func (s *limitedStream) Context() context.Context {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return s.ServerStream.Context()
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil || s.limiter == nil {
+		return err
+	}
+	// messages are charged once received, so that the end of the stream isn't charged. Headers may
+	// only be sent once, so there is no point in sending them for every message.
+	ctx, err := s.limiter.limit(s.ServerStream.Context(), s.fullMethod, nil)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ctx = ctx
+	return err
+}
+
+// limit charges a call to its bucket, returning a context carrying the bucket's state or the error
+// the call should fail with. It sends the bucket's state as header metadata with setHeader, unless
+// setHeader is nil.
+func (l *Limiter) limit(ctx context.Context, fullMethod string, setHeader func(context.Context, metadata.MD) error) (context.Context, error) {
+	name, err := l.key(ctx, fullMethod)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return ctx, err
+		}
+		return ctx, l.onError(ctx, fullMethod, err)
+	}
+	bucket, err := leakybucket.CreateContext(ctx, l.storage, name, l.capacity, l.rate)
+	if err != nil {
+		return ctx, l.onError(ctx, fullMethod, err)
+	}
+	state, err := leakybucket.AddContext(ctx, bucket, l.cost(ctx, fullMethod))
+	if err != nil && err != leakybucket.ErrorFull {
+		return ctx, l.onError(ctx, fullMethod, err)
+	}
+	if setHeader != nil {
+		// failing to send headers, e.g. because the handler already did, shouldn't fail the call
+		setHeader(ctx, Metadata(state))
+	}
+	ctx = context.WithValue(ctx, stateKey{}, state)
+	if err == leakybucket.ErrorFull {
+		return ctx, ResourceExhausted(state, time.Now())
+	}
+	return ctx, nil
+}
+
+type stateKey struct{}
+
+// State returns the state of the bucket a call was charged to by a Limiter.
+func State(ctx context.Context) (leakybucket.BucketState, bool) {
+	state, ok := ctx.Value(stateKey{}).(leakybucket.BucketState)
+	return state, ok
+}
+
+// Metadata returns the x-ratelimit-limit, x-ratelimit-remaining and x-ratelimit-reset metadata
+// describing a bucket, mirroring the X-RateLimit headers set by the http package.
+func Metadata(state leakybucket.BucketState) metadata.MD {
+	return metadata.Pairs(
+		"x-ratelimit-limit", strconv.FormatUint(uint64(state.Capacity), 10),
+		"x-ratelimit-remaining", strconv.FormatUint(uint64(state.Remaining), 10),
+		"x-ratelimit-reset", strconv.FormatInt(state.Reset.Unix(), 10),
+	)
+}
+
+// ResourceExhausted returns the error calls to a full bucket fail with: a codes.ResourceExhausted
+// status whose details hold an errdetails.RetryInfo saying when the bucket drains.
+func ResourceExhausted(state leakybucket.BucketState, now time.Time) error {
+	delay := state.Reset.Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	st := status.New(codes.ResourceExhausted, "rate limit exceeded")
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// RetryDelay returns how long to wait before retrying a call that failed with err, as returned by
+// ResourceExhausted, and false if err doesn't carry retry info.
+func RetryDelay(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// FullMethod charges calls to a bucket per method, e.g. "/package.Service/Method".
+func FullMethod(ctx context.Context, fullMethod string) (string, error) {
+	return fullMethod, nil
+}
+
+// PeerAddress charges calls to a bucket per client IP, or per address for clients connecting
+// other than over IP, e.g. over a unix socket.
+func PeerAddress(ctx context.Context, fullMethod string) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "", fmt.Errorf("no peer for call to %s", fullMethod)
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host, nil
+	}
+	return addr, nil
+}
+
+// MetadataValue charges calls to a bucket per value of the incoming metadata key. Calls without
+// the key fail with codes.InvalidArgument.
+func MetadataValue(key string) KeyFunc {
+	return func(ctx context.Context, fullMethod string) (string, error) {
+		values := metadata.ValueFromIncomingContext(ctx, key)
+		if len(values) == 0 || values[0] == "" {
+			return "", status.Errorf(codes.InvalidArgument, "missing %s metadata", key)
+		}
+		return values[0], nil
+	}
+}
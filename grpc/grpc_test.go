@@ -0,0 +1,180 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// serve starts a server with the health service behind the limiter, returning a client for it.
+func serve(t *testing.T, l *Limiter) healthpb.HealthClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(l.UnaryServerInterceptor()),
+		grpc.StreamInterceptor(l.StreamServerInterceptor()))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+func TestUnary(t *testing.T) {
+	client := serve(t, New(memory.New(), 2, time.Minute))
+	for i := 0; i < 2; i++ {
+		var header metadata.MD
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		require.Equal(t, []string{"2"}, header.Get("x-ratelimit-limit"))
+	}
+
+	var header metadata.MD
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, []string{"0"}, header.Get("x-ratelimit-remaining"))
+	delay, ok := RetryDelay(err)
+	require.True(t, ok)
+	require.InDelta(t, float64(time.Minute), float64(delay), float64(time.Second))
+}
+
+func TestMetadataValue(t *testing.T) {
+	client := serve(t, New(memory.New(), 1, time.Minute, WithKey(MetadataValue("x-api-key"))))
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	for _, key := range []string{"a", "b"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	}
+}
+
+func TestStream(t *testing.T) {
+	client := serve(t, New(memory.New(), 1, time.Minute, WithKey(FullMethod)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// other methods have their own bucket
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+}
+
+// fakeStream receives a fixed number of messages.
+type fakeStream struct {
+	grpc.ServerStream
+	messages int
+}
+
+func (s *fakeStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if s.messages == 0 {
+		return io.EOF
+	}
+	s.messages--
+	return nil
+}
+
+func TestPerMessage(t *testing.T) {
+	l := New(memory.New(), 3, time.Minute, WithKey(FullMethod), WithPerMessage())
+	intercept := l.StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Upload", IsClientStream: true}
+
+	received := 0
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		for {
+			if err := stream.RecvMsg(nil); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			received++
+			state, ok := State(stream.Context())
+			require.True(t, ok)
+			require.Equal(t, uint(3-received), state.Remaining)
+		}
+	}
+	require.NoError(t, intercept(nil, &fakeStream{messages: 2}, info, handler))
+	require.Equal(t, 2, received)
+
+	err := intercept(nil, &fakeStream{messages: 2}, info, handler)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, 3, received)
+}
+
+// Handlers may read the stream's context while another goroutine receives messages.
+func TestPerMessageConcurrentContext(t *testing.T) {
+	l := New(memory.New(), 100, time.Minute, WithKey(FullMethod), WithPerMessage())
+	intercept := l.StreamServerInterceptor()
+	info := &grpc.StreamServerInfo{FullMethod: "/test.Service/Upload", IsClientStream: true}
+
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for stream.RecvMsg(nil) == nil {
+			}
+		}()
+		for {
+			select {
+			case <-done:
+				return nil
+			default:
+				State(stream.Context())
+				runtime.Gosched()
+			}
+		}
+	}
+	require.NoError(t, intercept(nil, &fakeStream{messages: 50}, info, handler))
+}
+
+func TestErrorHandler(t *testing.T) {
+	failing := WithKey(func(context.Context, string) (string, error) {
+		return "", errors.New("no key")
+	})
+	client := serve(t, New(memory.New(), 1, time.Minute, failing))
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	client = serve(t, New(memory.New(), 1, time.Minute, failing,
+		WithErrorHandler(func(context.Context, string, error) error { return nil })))
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+}
@@ -0,0 +1,16 @@
+// Package http provides net/http middleware that rate limits requests using leaky buckets from any
+// leakybucket.Storage.
+//
+// Usage:
+//
+//	limiter := leakybucketHTTP.New(storage, 100, time.Minute,
+//		leakybucketHTTP.WithKey(func(r *http.Request) (string, error) {
+//			return "api:" + r.Header.Get("X-Api-Key"), nil
+//		}))
+//	http.ListenAndServe(":8080", limiter.Handler(mux))
+//
+// Transport rate limits outbound requests instead:
+//
+//	client := &http.Client{Transport: leakybucketHTTP.NewTransport(storage, 100, time.Minute,
+//		leakybucketHTTP.WithWait(10*time.Second), leakybucketHTTP.WithAdaptiveLimits())}
+package http
@@ -0,0 +1,184 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// KeyFunc returns the name of the bucket a request is charged to.
+type KeyFunc func(r *http.Request) (string, error)
+
+// CostFunc returns how much a request adds to its bucket.
+type CostFunc func(r *http.Request) uint
+
+// ErrorHandler responds to a request that could not be rate limited because of err.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// Limiter rate limits requests to a handler.
+type Limiter struct {
+	storage  leakybucket.Storage
+	capacity uint
+	rate     time.Duration
+	key      KeyFunc
+	cost     CostFunc
+	limited  http.Handler
+	onError  ErrorHandler
+	headers  Headers
+	policy   string
+}
+
+// Headers selects which rate limit headers a Limiter sets on responses.
+type Headers int
+
+const (
+	// XRateLimitHeaders are X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset, as set
+	// by SetHeaders.
+	XRateLimitHeaders Headers = 1 << iota
+	// RateLimitHeaders are the IETF draft RateLimit and RateLimit-Policy, as set by
+	// SetRateLimitHeaders.
+	RateLimitHeaders
+)
+
+// Option configures optional behavior of a Limiter.
+type Option func(*Limiter)
+
+// WithKey sets how requests are mapped to buckets. By default requests are charged to a bucket per
+// client IP, as found in the request's RemoteAddr.
+func WithKey(key KeyFunc) Option {
+	return func(l *Limiter) {
+		l.key = key
+	}
+}
+
+// WithCost sets how much each request adds to its bucket. By default every request adds 1.
+func WithCost(cost CostFunc) Option {
+	return func(l *Limiter) {
+		l.cost = cost
+	}
+}
+
+// WithLimitedHandler sets the handler responding to requests rejected because their bucket is
+// full. The rate limit headers are already set when it's called, and State returns the state of
+// the bucket. By default rejected requests get a plain 429 Too Many Requests.
+func WithLimitedHandler(h http.Handler) Option {
+	return func(l *Limiter) {
+		l.limited = h
+	}
+}
+
+// WithErrorHandler sets how requests are handled when the storage fails. By default they get a 500
+// Internal Server Error. To let requests through when the storage fails, serve them from the error
+// handler.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(l *Limiter) {
+		l.onError = h
+	}
+}
+
+// WithHeaders sets which rate limit headers are set on responses, e.g.
+// XRateLimitHeaders|RateLimitHeaders for both. The default is XRateLimitHeaders.
+func WithHeaders(h Headers) Option {
+	return func(l *Limiter) {
+		l.headers = h
+	}
+}
+
+// WithPolicyName sets the name of the policy in RateLimit and RateLimit-Policy headers. The
+// default is "default".
+func WithPolicyName(name string) Option {
+	return func(l *Limiter) {
+		l.policy = name
+	}
+}
+
+// New creates a Limiter charging requests to buckets of the given capacity and rate. Requests are
+// served concurrently, so storage must be thread-safe.
+func New(storage leakybucket.Storage, capacity uint, rate time.Duration, opts ...Option) *Limiter {
+	l := &Limiter{
+		storage:  storage,
+		capacity: capacity,
+		rate:     rate,
+		key:      RemoteIP,
+		cost:     func(*http.Request) uint { return 1 },
+		limited:  http.HandlerFunc(tooManyRequests),
+		onError: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		},
+		headers: XRateLimitHeaders,
+		policy:  "default",
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Handler wraps next so that requests only reach it while their bucket has space for them.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, err := l.key(r)
+		if err != nil {
+			l.onError(w, r, err)
+			return
+		}
+		bucket, err := leakybucket.CreateContext(r.Context(), l.storage, name, l.capacity, l.rate)
+		if err != nil {
+			l.onError(w, r, err)
+			return
+		}
+		state, err := leakybucket.AddContext(r.Context(), bucket, l.cost(r))
+		if err != nil && err != leakybucket.ErrorFull {
+			l.onError(w, r, err)
+			return
+		}
+		now := time.Now()
+		if l.headers&XRateLimitHeaders != 0 {
+			SetHeaders(w.Header(), state)
+		}
+		if l.headers&RateLimitHeaders != 0 {
+			SetRateLimitHeaders(w.Header(), l.policy, state, l.rate, now)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), stateKey{}, state))
+		if err == leakybucket.ErrorFull {
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds(state.Reset.Sub(now)), 10))
+			l.limited.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type stateKey struct{}
+
+// State returns the state of the bucket a request was charged to by a Limiter.
+func State(r *http.Request) (leakybucket.BucketState, bool) {
+	state, ok := r.Context().Value(stateKey{}).(leakybucket.BucketState)
+	return state, ok
+}
+
+// SetHeaders sets the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers
+// describing a bucket. X-RateLimit-Reset is in seconds since the epoch.
+func SetHeaders(h http.Header, state leakybucket.BucketState) {
+	h.Set("X-RateLimit-Limit", strconv.FormatUint(uint64(state.Capacity), 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatUint(uint64(state.Remaining), 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(state.Reset.Unix(), 10))
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// RemoteIP charges requests to a bucket per client IP, as found in the request's RemoteAddr.
+func RemoteIP(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid remote address %q: %s", r.RemoteAddr, err)
+	}
+	return host, nil
+}
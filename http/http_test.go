@@ -0,0 +1,111 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func serve(h http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestLimit(t *testing.T) {
+	h := New(memory.New(), 2, time.Minute).Handler(ok)
+
+	for _, remaining := range []string{"1", "0"} {
+		w := serve(h, "10.0.0.1:1234")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+		require.Equal(t, remaining, w.Header().Get("X-RateLimit-Remaining"))
+		require.Empty(t, w.Header().Get("Retry-After"))
+	}
+
+	w := serve(h, "10.0.0.1:1234")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "0", w.Header().Get("X-RateLimit-Remaining"))
+	reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(time.Minute).Unix(), reset, 1)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	require.InDelta(t, 60, retryAfter, 1)
+
+	// other clients have their own bucket
+	w = serve(h, "10.0.0.2:1234")
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestKeyAndCost(t *testing.T) {
+	h := New(memory.New(), 10, time.Minute,
+		WithKey(func(r *http.Request) (string, error) {
+			return r.Header.Get("X-Api-Key"), nil
+		}),
+		WithCost(func(r *http.Request) uint {
+			if r.Method == "POST" {
+				return 5
+			}
+			return 1
+		}),
+	).Handler(ok)
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("X-Api-Key", "a")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "5", w.Header().Get("X-RateLimit-Remaining"))
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Api-Key", "a")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, "4", w.Header().Get("X-RateLimit-Remaining"))
+}
+
+func TestLimitedHandler(t *testing.T) {
+	var state leakybucket.BucketState
+	h := New(memory.New(), 1, time.Minute, WithLimitedHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, _ = State(r)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))).Handler(ok)
+
+	require.Equal(t, http.StatusOK, serve(h, "10.0.0.1:1234").Code)
+	require.Equal(t, http.StatusServiceUnavailable, serve(h, "10.0.0.1:1234").Code)
+	require.Equal(t, uint(1), state.Capacity)
+	require.Equal(t, uint(0), state.Remaining)
+}
+
+func TestErrorHandler(t *testing.T) {
+	h := New(memory.New(), 1, time.Minute).Handler(ok)
+	require.Equal(t, http.StatusInternalServerError, serve(h, "not an address").Code)
+
+	var handled error
+	h = New(memory.New(), 1, time.Minute,
+		WithKey(func(r *http.Request) (string, error) {
+			return "", errors.New("no key")
+		}),
+		WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			handled = err
+			ok.ServeHTTP(w, r)
+		}),
+	).Handler(ok)
+	require.Equal(t, http.StatusOK, serve(h, "10.0.0.1:1234").Code)
+	require.EqualError(t, handled, "no key")
+}
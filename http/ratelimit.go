@@ -0,0 +1,323 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// The RateLimit and RateLimit-Policy header fields are defined by the IETF draft "RateLimit header
+// fields for HTTP": https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/. Both
+// are Structured Field lists (RFC 8941) of named policies, e.g.
+//
+//	RateLimit-Policy: "default";q=100;w=60
+//	RateLimit: "default";r=42;t=17
+
+// Policy describes the quota of a bucket: Quota units per Window.
+type Policy struct {
+	Name   string
+	Quota  uint
+	Window time.Duration
+}
+
+// NewPolicy describes buckets with the given capacity and rate.
+func NewPolicy(name string, capacity uint, rate time.Duration) Policy {
+	return Policy{Name: name, Quota: capacity, Window: rate}
+}
+
+// String formats the policy as a RateLimit-Policy list member.
+func (p Policy) String() string {
+	return fmt.Sprintf("%s;q=%d;w=%d", formatString(p.Name), p.Quota, seconds(p.Window))
+}
+
+// Limit is the current state of a policy's quota: Remaining units until Reset.
+type Limit struct {
+	Policy    string
+	Remaining uint
+	Reset     time.Duration
+}
+
+// NewLimit describes the state of a bucket at the time now.
+func NewLimit(policy string, state leakybucket.BucketState, now time.Time) Limit {
+	return Limit{Policy: policy, Remaining: state.Remaining, Reset: state.Reset.Sub(now)}
+}
+
+// String formats the limit as a RateLimit list member.
+func (l Limit) String() string {
+	return fmt.Sprintf("%s;r=%d;t=%d", formatString(l.Policy), l.Remaining, seconds(l.Reset))
+}
+
+// SetRateLimitHeaders sets the RateLimit and RateLimit-Policy headers describing a bucket of the
+// given rate.
+func SetRateLimitHeaders(h http.Header, name string, state leakybucket.BucketState, rate time.Duration, now time.Time) {
+	h.Set("RateLimit-Policy", NewPolicy(name, state.Capacity, rate).String())
+	h.Set("RateLimit", NewLimit(name, state, now).String())
+}
+
+// ParsePolicies parses a RateLimit-Policy header.
+func ParsePolicies(v string) ([]Policy, error) {
+	items, err := parseList(v)
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]Policy, 0, len(items))
+	for _, item := range items {
+		quota, err := item.uint("q")
+		if err != nil {
+			return nil, err
+		}
+		window, err := item.uint("w")
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, Policy{
+			Name:   item.value,
+			Quota:  quota,
+			Window: time.Duration(window) * time.Second,
+		})
+	}
+	return policies, nil
+}
+
+// ParseLimits parses a RateLimit header.
+func ParseLimits(v string) ([]Limit, error) {
+	items, err := parseList(v)
+	if err != nil {
+		return nil, err
+	}
+	limits := make([]Limit, 0, len(items))
+	for _, item := range items {
+		remaining, err := item.uint("r")
+		if err != nil {
+			return nil, err
+		}
+		reset, err := item.uint("t")
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, Limit{
+			Policy:    item.value,
+			Remaining: remaining,
+			Reset:     time.Duration(reset) * time.Second,
+		})
+	}
+	return limits, nil
+}
+
+// ErrNoRateLimit is returned when parsing headers that don't describe a rate limit.
+var ErrNoRateLimit = errors.New("no rate limit headers")
+
+// ParseRateLimitHeaders reads the state and policy of a bucket from RateLimit and RateLimit-Policy
+// headers received at the time now. When several policies apply, the one with the least remaining
+// is returned.
+func ParseRateLimitHeaders(h http.Header, now time.Time) (leakybucket.BucketState, Policy, error) {
+	if h.Get("RateLimit") == "" {
+		return leakybucket.BucketState{}, Policy{}, ErrNoRateLimit
+	}
+	limits, err := ParseLimits(strings.Join(h.Values("RateLimit"), ","))
+	if err != nil {
+		return leakybucket.BucketState{}, Policy{}, err
+	}
+	policies, err := ParsePolicies(strings.Join(h.Values("RateLimit-Policy"), ","))
+	if err != nil {
+		return leakybucket.BucketState{}, Policy{}, err
+	}
+	var limit *Limit
+	for i := range limits {
+		if limit == nil || limits[i].Remaining < limit.Remaining {
+			limit = &limits[i]
+		}
+	}
+	if limit == nil {
+		return leakybucket.BucketState{}, Policy{}, ErrNoRateLimit
+	}
+	state := leakybucket.BucketState{Remaining: limit.Remaining, Reset: now.Add(limit.Reset)}
+	policy := Policy{Name: limit.Policy}
+	for _, p := range policies {
+		if p.Name == limit.Policy {
+			policy = p
+			state.Capacity = p.Quota
+			break
+		}
+	}
+	return state, policy, nil
+}
+
+// ParseHeaders reads the state of a bucket from X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset headers, as set by SetHeaders.
+func ParseHeaders(h http.Header) (leakybucket.BucketState, error) {
+	if h.Get("X-RateLimit-Remaining") == "" {
+		return leakybucket.BucketState{}, ErrNoRateLimit
+	}
+	var state leakybucket.BucketState
+	remaining, err := strconv.ParseUint(h.Get("X-RateLimit-Remaining"), 10, 0)
+	if err != nil {
+		return state, fmt.Errorf("invalid X-RateLimit-Remaining: %s", err)
+	}
+	state.Remaining = uint(remaining)
+	if v := h.Get("X-RateLimit-Limit"); v != "" {
+		capacity, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			return state, fmt.Errorf("invalid X-RateLimit-Limit: %s", err)
+		}
+		state.Capacity = uint(capacity)
+	}
+	if v := h.Get("X-RateLimit-Reset"); v != "" {
+		reset, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return state, fmt.Errorf("invalid X-RateLimit-Reset: %s", err)
+		}
+		state.Reset = time.Unix(reset, 0)
+	}
+	return state, nil
+}
+
+// seconds rounds d up to whole seconds, as the header fields require.
+func seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// sfItem is a Structured Field list member: a string or token, and its parameters.
+type sfItem struct {
+	value  string
+	params map[string]string
+}
+
+func (i sfItem) uint(key string) (uint, error) {
+	v, ok := i.params[key]
+	if !ok {
+		return 0, fmt.Errorf("policy %q has no %q parameter", i.value, key)
+	}
+	n, err := strconv.ParseUint(v, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("policy %q has invalid %q parameter %q", i.value, key, v)
+	}
+	return uint(n), nil
+}
+
+func formatString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// parseList parses a Structured Field list whose members are strings or tokens with parameters.
+// Parameter values are returned as they appear, except for strings which are unquoted.
+func parseList(s string) ([]sfItem, error) {
+	p := &sfParser{s: s}
+	var items []sfItem
+	p.skip(" \t")
+	for !p.done() {
+		value, err := p.bareItem()
+		if err != nil {
+			return nil, err
+		}
+		item := sfItem{value: value, params: map[string]string{}}
+		for p.peek() == ';' {
+			p.i++
+			p.skip(" ")
+			key := p.key()
+			if key == "" {
+				return nil, p.errorf("expected a parameter key")
+			}
+			item.params[key] = "?1"
+			if p.peek() == '=' {
+				p.i++
+				if item.params[key], err = p.bareItem(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		items = append(items, item)
+		p.skip(" \t")
+		if p.done() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, p.errorf("expected ','")
+		}
+		p.i++
+		p.skip(" \t")
+		if p.done() {
+			return nil, p.errorf("trailing ','")
+		}
+	}
+	return items, nil
+}
+
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) skip(chars string) {
+	for !p.done() && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *sfParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid structured field %q at %d: %s", p.s, p.i, fmt.Sprintf(format, args...))
+}
+
+func (p *sfParser) key() string {
+	start := p.i
+	for !p.done() {
+		c := p.s[p.i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// bareItem parses a string, returning it unquoted, or anything else up to the next delimiter.
+func (p *sfParser) bareItem() (string, error) {
+	if p.peek() != '"' {
+		start := p.i
+		for !p.done() && strings.IndexByte(";, \t", p.s[p.i]) < 0 {
+			p.i++
+		}
+		if start == p.i {
+			return "", p.errorf("expected an item")
+		}
+		return p.s[start:p.i], nil
+	}
+	p.i++
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '\\':
+			if p.done() || (p.s[p.i] != '"' && p.s[p.i] != '\\') {
+				return "", p.errorf("invalid escape")
+			}
+			b.WriteByte(p.s[p.i])
+			p.i++
+		case '"':
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	require.Equal(t, `"default";q=100;w=60`, NewPolicy("default", 100, time.Minute).String())
+	require.Equal(t, `"a \"quoted\" \\ name";q=1;w=1`, NewPolicy(`a "quoted" \ name`, 1, time.Millisecond).String())
+
+	now := time.Now()
+	state := leakybucket.BucketState{Capacity: 100, Remaining: 42, Reset: now.Add(16500 * time.Millisecond)}
+	require.Equal(t, `"default";r=42;t=17`, NewLimit("default", state, now).String())
+	state.Reset = now.Add(-time.Second)
+	require.Equal(t, `"default";r=42;t=0`, NewLimit("default", state, now).String())
+}
+
+func TestParse(t *testing.T) {
+	policies, err := ParsePolicies(`"burst";q=100;w=60, "day";q=1000;w=86400;pk=:cHsdsRa894==:`)
+	require.NoError(t, err)
+	require.Equal(t, []Policy{
+		{Name: "burst", Quota: 100, Window: time.Minute},
+		{Name: "day", Quota: 1000, Window: 24 * time.Hour},
+	}, policies)
+
+	limits, err := ParseLimits(`"a \"quoted\" \\ name";r=0;t=5`)
+	require.NoError(t, err)
+	require.Equal(t, []Limit{{Policy: `a "quoted" \ name`, Remaining: 0, Reset: 5 * time.Second}}, limits)
+
+	for _, invalid := range []string{
+		`"default";r=1`,
+		`"default";r=-1;t=1`,
+		`"default";r=1;t=1,`,
+		`"default;r=1;t=1`,
+		`"default";r=1;t=1 "other"`,
+		`"default";=1`,
+	} {
+		_, err := ParseLimits(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Now()
+	state := leakybucket.BucketState{Capacity: 100, Remaining: 42, Reset: now.Add(17 * time.Second)}
+	h := http.Header{}
+	SetRateLimitHeaders(h, "default", state, time.Minute, now)
+	parsed, policy, err := ParseRateLimitHeaders(h, now)
+	require.NoError(t, err)
+	require.Equal(t, NewPolicy("default", 100, time.Minute), policy)
+	require.Equal(t, state, parsed)
+
+	h = http.Header{}
+	SetHeaders(h, state)
+	parsed, err = ParseHeaders(h)
+	require.NoError(t, err)
+	require.Equal(t, state.Reset.Unix(), parsed.Reset.Unix())
+	parsed.Reset = state.Reset
+	require.Equal(t, state, parsed)
+
+	_, _, err = ParseRateLimitHeaders(http.Header{}, now)
+	require.Equal(t, ErrNoRateLimit, err)
+	_, err = ParseHeaders(http.Header{})
+	require.Equal(t, ErrNoRateLimit, err)
+}
+
+func TestParseMostRestrictive(t *testing.T) {
+	h := http.Header{}
+	h.Add("RateLimit-Policy", `"burst";q=100;w=60`)
+	h.Add("RateLimit-Policy", `"day";q=1000;w=86400`)
+	h.Set("RateLimit", `"burst";r=50;t=30, "day";r=10;t=3600`)
+	now := time.Now()
+	state, policy, err := ParseRateLimitHeaders(h, now)
+	require.NoError(t, err)
+	require.Equal(t, "day", policy.Name)
+	require.Equal(t, leakybucket.BucketState{Capacity: 1000, Remaining: 10, Reset: now.Add(time.Hour)}, state)
+}
+
+func TestLimiterHeaders(t *testing.T) {
+	h := New(memory.New(), 10, time.Minute, WithHeaders(RateLimitHeaders), WithPolicyName("api")).Handler(ok)
+	w := serve(h, "10.0.0.1:1234")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, w.Header().Get("X-RateLimit-Limit"))
+	require.Equal(t, `"api";q=10;w=60`, w.Header().Get("RateLimit-Policy"))
+	require.Regexp(t, `^"api";r=9;t=(59|60)$`, w.Header().Get("RateLimit"))
+
+	h = New(memory.New(), 10, time.Minute, WithHeaders(XRateLimitHeaders|RateLimitHeaders)).Handler(ok)
+	r := httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, "9", w.Header().Get("X-RateLimit-Remaining"))
+	require.Equal(t, `"default";q=10;w=60`, w.Header().Get("RateLimit-Policy"))
+}
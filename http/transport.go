@@ -0,0 +1,252 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// LimitedError is returned by a Transport for requests it didn't send because their bucket was
+// full. It matches leakybucket.ErrorFull using errors.Is.
+type LimitedError struct {
+	// Name is the name of the bucket.
+	Name string
+	// State is the state of the bucket when the request was given up on.
+	State leakybucket.BucketState
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limit of %s exceeded until %s", e.Name, e.State.Reset.Format(time.RFC3339))
+}
+
+// Unwrap returns leakybucket.ErrorFull.
+func (e *LimitedError) Unwrap() error {
+	return leakybucket.ErrorFull
+}
+
+// Transport is an http.RoundTripper rate limiting outbound requests, e.g. to stay within the quotas
+// of third-party APIs. Sharing a storage between processes shares the quotas between them too.
+type Transport struct {
+	storage  leakybucket.Storage
+	capacity uint
+	rate     time.Duration
+	base     http.RoundTripper
+	key      KeyFunc
+	cost     CostFunc
+	maxWait  time.Duration
+	adaptive bool
+
+	mutex   sync.Mutex
+	learned map[string]limits
+}
+
+type limits struct {
+	capacity uint
+	rate     time.Duration
+}
+
+// TransportOption configures optional behavior of a Transport.
+type TransportOption func(*Transport)
+
+// WithBase sets the RoundTripper sending requests once they're allowed through. The default is
+// http.DefaultTransport.
+func WithBase(base http.RoundTripper) TransportOption {
+	return func(t *Transport) {
+		t.base = base
+	}
+}
+
+// WithTransportKey sets how requests are mapped to buckets. By default requests are charged to a
+// bucket per host.
+func WithTransportKey(key KeyFunc) TransportOption {
+	return func(t *Transport) {
+		t.key = key
+	}
+}
+
+// WithTransportCost sets how much each request adds to its bucket. By default every request adds
+// 1.
+func WithTransportCost(cost CostFunc) TransportOption {
+	return func(t *Transport) {
+		t.cost = cost
+	}
+}
+
+// WithWait makes requests whose bucket is full wait for it to drain, for up to max in total, rather
+// than fail immediately. Requests also stop waiting when their context is done.
+func WithWait(max time.Duration) TransportOption {
+	return func(t *Transport) {
+		t.maxWait = max
+	}
+}
+
+// WithAdaptiveLimits makes the Transport adapt buckets to the rate limit headers of responses, as
+// read by ParseRateLimitHeaders or ParseHeaders: the capacity and rate of a bucket are updated to
+// match the server's policy, and whatever the server says was used, e.g. by other clients of the
+// same quota, is added to the bucket. A 429 Too Many Requests response fills the bucket. Adapting
+// is best effort: storage errors while doing so are ignored.
+//
+// Adapted limits are remembered by the Transport, and picked up from the storage when another
+// process adapted them first. Storages must not use their reconfigure option, which would undo
+// the adaptation.
+func WithAdaptiveLimits() TransportOption {
+	return func(t *Transport) {
+		t.adaptive = true
+	}
+}
+
+// NewTransport creates a Transport charging requests to buckets of the given capacity and rate.
+// Requests may be sent concurrently, so storage must be thread-safe.
+func NewTransport(storage leakybucket.Storage, capacity uint, rate time.Duration, opts ...TransportOption) *Transport {
+	t := &Transport{
+		storage:  storage,
+		capacity: capacity,
+		rate:     rate,
+		base:     http.DefaultTransport,
+		key:      Host,
+		cost:     func(*http.Request) uint { return 1 },
+		learned:  map[string]limits{},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// RoundTrip sends a request once its bucket has space for it. As required of RoundTrippers, the
+// request's body is closed even if the request isn't sent.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, err := t.key(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	state, err := t.add(req, name, t.cost(req))
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && t.adaptive {
+		t.adapt(req.Context(), name, resp, state)
+	}
+	return resp, err
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// add charges a request to its bucket, waiting for it to drain if configured to.
+func (t *Transport) add(req *http.Request, name string, amount uint) (leakybucket.BucketState, error) {
+	state, err := leakybucket.WaitFunc(req.Context(), amount, t.maxWait, func(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+		return t.addOnce(ctx, name, amount)
+	})
+	if err == leakybucket.ErrorFull {
+		return state, &LimitedError{Name: name, State: state}
+	}
+	return state, err
+}
+
+func (t *Transport) addOnce(ctx context.Context, name string, amount uint) (leakybucket.BucketState, error) {
+	bucket, err := t.bucket(ctx, name)
+	if err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	state, err := leakybucket.AddContext(ctx, bucket, amount)
+	var mismatch *leakybucket.ConfigMismatchError
+	if t.adaptive && errors.As(err, &mismatch) {
+		// the limits were adapted elsewhere since the bucket was created
+		t.learn(name, limits{mismatch.Capacity, mismatch.Rate})
+		if bucket, err = t.bucket(ctx, name); err != nil {
+			return leakybucket.BucketState{}, err
+		}
+		return leakybucket.AddContext(ctx, bucket, amount)
+	}
+	return state, err
+}
+
+// bucket creates the bucket with the given name, with whatever limits it was adapted to.
+func (t *Transport) bucket(ctx context.Context, name string) (leakybucket.Bucket, error) {
+	l := t.limits(name)
+	bucket, err := leakybucket.CreateContext(ctx, t.storage, name, l.capacity, l.rate)
+	var mismatch *leakybucket.ConfigMismatchError
+	if t.adaptive && errors.As(err, &mismatch) {
+		t.learn(name, limits{mismatch.Capacity, mismatch.Rate})
+		return leakybucket.CreateContext(ctx, t.storage, name, mismatch.Capacity, mismatch.Rate)
+	}
+	return bucket, err
+}
+
+func (t *Transport) limits(name string) limits {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if l, ok := t.learned[name]; ok {
+		return l
+	}
+	return limits{t.capacity, t.rate}
+}
+
+func (t *Transport) learn(name string, l limits) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.learned[name] = l
+}
+
+// adapt updates a bucket, in the given state after charging the request, to the rate limit the
+// response describes.
+func (t *Transport) adapt(ctx context.Context, name string, resp *http.Response, state leakybucket.BucketState) {
+	now := time.Now()
+	server, policy, err := ParseRateLimitHeaders(resp.Header, now)
+	if err == ErrNoRateLimit {
+		server, err = ParseHeaders(resp.Header)
+	}
+	if err == ErrNoRateLimit && resp.StatusCode == http.StatusTooManyRequests {
+		server, err = leakybucket.BucketState{Remaining: 0}, nil
+	}
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		server.Remaining = 0
+	}
+
+	current := t.limits(name)
+	updated := current
+	if server.Capacity > 0 {
+		updated.capacity = server.Capacity
+	}
+	if policy.Window > 0 {
+		updated.rate = policy.Window
+	}
+	if updated != current {
+		if state, err = leakybucket.UpdateLimits(t.storage, name, updated.capacity, updated.rate); err != nil {
+			return
+		}
+		t.learn(name, updated)
+	}
+	if server.Remaining < state.Remaining {
+		bucket, err := t.bucket(ctx, name)
+		if err != nil {
+			return
+		}
+		leakybucket.AddContext(ctx, bucket, state.Remaining-server.Remaining)
+	}
+}
+
+// Host charges outbound requests to a bucket per host they're sent to, including the port if
+// there is one.
+func Host(r *http.Request) (string, error) {
+	if r.URL.Host == "" {
+		return "", fmt.Errorf("request to %q has no host", r.URL)
+	}
+	return strings.ToLower(r.URL.Host), nil
+}
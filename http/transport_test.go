@@ -0,0 +1,138 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(ok)
+	defer server.Close()
+	other := httptest.NewServer(ok)
+	defer other.Close()
+
+	client := &http.Client{Transport: NewTransport(memory.New(), 2, time.Minute)}
+	require.NoError(t, get(t, client, server.URL))
+	require.NoError(t, get(t, client, server.URL+"/path"))
+	err := get(t, client, server.URL)
+	require.True(t, errors.Is(err, leakybucket.ErrorFull), err)
+	var limited *LimitedError
+	require.True(t, errors.As(err, &limited))
+	require.Equal(t, uint(0), limited.State.Remaining)
+
+	// other hosts have their own bucket
+	require.NoError(t, get(t, client, other.URL))
+}
+
+type body struct {
+	io.Reader
+	closed bool
+}
+
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+// RoundTrippers must close request bodies, which http.Client relies on when the request isn't sent.
+func TestTransportClosesBody(t *testing.T) {
+	server := httptest.NewServer(ok)
+	defer server.Close()
+
+	transport := NewTransport(memory.New(), 1, time.Minute)
+	client := &http.Client{Transport: transport}
+	require.NoError(t, get(t, client, server.URL))
+	b := &body{Reader: strings.NewReader("payload")}
+	req, err := http.NewRequest("POST", server.URL, b)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.True(t, errors.Is(err, leakybucket.ErrorFull), err)
+	require.True(t, b.closed)
+
+	// so are the bodies of requests without a bucket
+	transport = NewTransport(memory.New(), 1, time.Minute,
+		WithTransportKey(func(*http.Request) (string, error) { return "", errors.New("no key") }))
+	b = &body{Reader: strings.NewReader("payload")}
+	req, err = http.NewRequest("POST", server.URL, b)
+	require.NoError(t, err)
+	_, err = transport.RoundTrip(req)
+	require.Error(t, err)
+	require.True(t, b.closed)
+}
+
+func TestTransportWait(t *testing.T) {
+	server := httptest.NewServer(ok)
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTransport(memory.New(), 1, 200*time.Millisecond, WithWait(time.Second))}
+	require.NoError(t, get(t, client, server.URL))
+	start := time.Now()
+	require.NoError(t, get(t, client, server.URL))
+	require.True(t, time.Since(start) > 100*time.Millisecond)
+
+	// waiting stops with the request's context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// requests that would wait too long fail immediately
+	client = &http.Client{Transport: NewTransport(memory.New(), 1, time.Minute, WithWait(time.Second))}
+	require.NoError(t, get(t, client, server.URL))
+	require.True(t, errors.Is(get(t, client, server.URL), leakybucket.ErrorFull))
+}
+
+func TestTransportAdaptive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Policy", `"default";q=5;w=30`)
+		w.Header().Set("RateLimit", `"default";r=2;t=30`)
+	}))
+	defer server.Close()
+
+	storage := memory.New()
+	transport := NewTransport(storage, 100, time.Minute, WithAdaptiveLimits())
+	client := &http.Client{Transport: transport}
+	require.NoError(t, get(t, client, server.URL))
+
+	name, err := Host(httptest.NewRequest("GET", server.URL, nil))
+	require.NoError(t, err)
+	bucket, err := storage.Create(name, 5, 30*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), bucket.Remaining())
+
+	// another transport sharing the storage picks up the adapted limits
+	client = &http.Client{Transport: NewTransport(storage, 100, time.Minute, WithAdaptiveLimits())}
+	require.NoError(t, get(t, client, server.URL))
+	require.NoError(t, get(t, client, server.URL))
+	require.True(t, errors.Is(get(t, client, server.URL), leakybucket.ErrorFull))
+}
+
+func TestTransportTooManyRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(tooManyRequests))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTransport(memory.New(), 10, time.Minute, WithAdaptiveLimits())}
+	require.NoError(t, get(t, client, server.URL))
+	require.True(t, errors.Is(get(t, client, server.URL), leakybucket.ErrorFull))
+}
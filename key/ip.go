@@ -0,0 +1,114 @@
+package key
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type ipConfig struct {
+	trusted    []netip.Prefix
+	ipv6Prefix int
+	err        error
+}
+
+// IPOption configures ClientIP.
+type IPOption func(*ipConfig)
+
+// WithTrustedProxies sets the proxies, as IPs or CIDR prefixes, trusted to append the address of
+// their client to the X-Forwarded-For header. By default no proxies are trusted and
+// X-Forwarded-For is ignored.
+func WithTrustedProxies(proxies ...string) IPOption {
+	return func(c *ipConfig) {
+		for _, proxy := range proxies {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(proxy)
+				if addrErr != nil {
+					c.err = fmt.Errorf("invalid trusted proxy %q: %s", proxy, err)
+					return
+				}
+				prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+			}
+			c.trusted = append(c.trusted, prefix.Masked())
+		}
+	}
+}
+
+// WithIPv6Prefix sets the length of the prefix IPv6 clients are grouped by. Clients are usually
+// given a whole /64, so by default clients within the same /64 share a key. A length of 128 gives
+// every IPv6 address its own key.
+func WithIPv6Prefix(bits int) IPOption {
+	return func(c *ipConfig) {
+		if bits < 0 || bits > 128 {
+			c.err = fmt.Errorf("invalid IPv6 prefix length %d", bits)
+			return
+		}
+		c.ipv6Prefix = bits
+	}
+}
+
+// ClientIP returns the IP of the client a request comes from. When the request comes from a
+// trusted proxy, the client is the last address in X-Forwarded-For that isn't a trusted proxy.
+// IPv6 clients are grouped by prefix, e.g. "2001:db8::/64".
+func ClientIP(opts ...IPOption) Extractor {
+	c := &ipConfig{ipv6Prefix: 64}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return func(r *http.Request) (string, error) {
+		if c.err != nil {
+			return "", c.err
+		}
+		addr, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil {
+			return "", fmt.Errorf("invalid remote address %q: %s", r.RemoteAddr, err)
+		}
+		client := addr.Addr().Unmap()
+		if c.isTrusted(client) {
+			client = c.forwardedFor(r, client)
+		}
+		return c.group(client), nil
+	}
+}
+
+func (c *ipConfig) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor walks X-Forwarded-For from the closest hop back, stopping at the first address
+// that isn't a trusted proxy. Addresses further back were set by the client itself, and can't be
+// trusted. If every address is trusted, the furthest one is the client.
+func (c *ipConfig) forwardedFor(r *http.Request, proxy netip.Addr) netip.Addr {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := proxy
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// a malformed hop can't be attributed to anyone, so blame the proxy that passed it on
+			return client
+		}
+		client = addr.Unmap()
+		if !c.isTrusted(client) {
+			return client
+		}
+	}
+	return client
+}
+
+func (c *ipConfig) group(addr netip.Addr) string {
+	if !addr.Is6() || c.ipv6Prefix == 128 {
+		return addr.WithZone("").String()
+	}
+	prefix, _ := addr.WithZone("").Prefix(c.ipv6Prefix)
+	return prefix.String()
+}
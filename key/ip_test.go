@@ -0,0 +1,53 @@
+package key
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, test := range []struct {
+		remote, forwarded string
+		opts              []IPOption
+		expected          string
+	}{
+		{remote: "1.2.3.4:80", expected: "1.2.3.4"},
+		{remote: "[::ffff:1.2.3.4]:80", expected: "1.2.3.4"},
+		{remote: "[2001:db8:1:2:3:4:5:6]:80", expected: "2001:db8:1:2::/64"},
+		{remote: "[2001:db8:1:2:3:4:5:6]:80", opts: []IPOption{WithIPv6Prefix(48)}, expected: "2001:db8:1::/48"},
+		{remote: "[2001:db8:1:2:3:4:5:6]:80", opts: []IPOption{WithIPv6Prefix(128)}, expected: "2001:db8:1:2:3:4:5:6"},
+		// X-Forwarded-For is ignored unless it comes from a trusted proxy
+		{remote: "1.2.3.4:80", forwarded: "5.6.7.8", expected: "1.2.3.4"},
+		{remote: "1.2.3.4:80", forwarded: "5.6.7.8", opts: []IPOption{WithTrustedProxies("10.0.0.0/8")}, expected: "1.2.3.4"},
+		{remote: "10.0.0.1:80", forwarded: "5.6.7.8", opts: []IPOption{WithTrustedProxies("10.0.0.0/8")}, expected: "5.6.7.8"},
+		// addresses the client added itself are skipped
+		{remote: "10.0.0.1:80", forwarded: "9.9.9.9, 5.6.7.8, 10.0.0.2", opts: []IPOption{WithTrustedProxies("10.0.0.0/8")}, expected: "5.6.7.8"},
+		{remote: "10.0.0.1:80", forwarded: "10.0.0.3, 10.0.0.2", opts: []IPOption{WithTrustedProxies("10.0.0.0/8")}, expected: "10.0.0.3"},
+		{remote: "10.0.0.1:80", forwarded: "5.6.7.8, garbage", opts: []IPOption{WithTrustedProxies("10.0.0.1")}, expected: "10.0.0.1"},
+		{remote: "10.0.0.1:80", forwarded: "2001:db8::1", opts: []IPOption{WithTrustedProxies("10.0.0.1")}, expected: "2001:db8::/64"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		v, err := ClientIP(test.opts...)(r)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, v, "%+v", test)
+	}
+}
+
+func TestClientIPErrors(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "invalid"
+	_, err := ClientIP()(r)
+	require.Error(t, err)
+
+	r.RemoteAddr = "1.2.3.4:80"
+	_, err = ClientIP(WithTrustedProxies("not an ip"))(r)
+	require.Error(t, err)
+	_, err = ClientIP(WithIPv6Prefix(129))(r)
+	require.Error(t, err)
+}
@@ -0,0 +1,212 @@
+package key
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Bearer returns the bearer token of a request's Authorization header.
+func Bearer(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):]), nil
+	}
+	return "", missing("no bearer token")
+}
+
+// Verifier checks the signature of a JWT signed with the algorithm alg.
+type Verifier func(alg string, signed, signature []byte) error
+
+// ErrInvalidToken matches, using errors.Is, the errors of Claim for tokens that are malformed,
+// badly signed or expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, fmt.Sprintf(format, args...))
+}
+
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// hash returns the hash of signed for an algorithm of the given family, e.g. "HS" for HS256.
+func hash(family, alg string, signed []byte) (crypto.Hash, []byte, error) {
+	h, ok := hashes[strings.TrimPrefix(alg, family)]
+	if !strings.HasPrefix(alg, family) || !ok {
+		return 0, nil, invalid("unexpected algorithm %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	return h, hasher.Sum(nil), nil
+}
+
+// HMAC verifies tokens signed with HS256, HS384 or HS512 and the given secret.
+func HMAC(secret []byte) Verifier {
+	return func(alg string, signed, signature []byte) error {
+		h, _, err := hash("HS", alg, nil)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(h.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return invalid("bad signature")
+		}
+		return nil
+	}
+}
+
+// RSA verifies tokens signed with RS256, RS384 or RS512 and the private key of the given public
+// key.
+func RSA(key *rsa.PublicKey) Verifier {
+	return func(alg string, signed, signature []byte) error {
+		h, digest, err := hash("RS", alg, signed)
+		if err != nil {
+			return err
+		}
+		if err := rsa.VerifyPKCS1v15(key, h, digest, signature); err != nil {
+			return invalid("bad signature")
+		}
+		return nil
+	}
+}
+
+// ECDSA verifies tokens signed with ES256, ES384 or ES512 and the private key of the given public
+// key.
+func ECDSA(key *ecdsa.PublicKey) Verifier {
+	return func(alg string, signed, signature []byte) error {
+		_, digest, err := hash("ES", alg, signed)
+		if err != nil {
+			return err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid("bad signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalid("bad signature")
+		}
+		return nil
+	}
+}
+
+type claimConfig struct {
+	token  Extractor
+	verify Verifier
+	now    func() time.Time
+}
+
+// ClaimOption configures Claim.
+type ClaimOption func(*claimConfig)
+
+// FromToken sets where Claim finds the token. By default it's the bearer token of the request.
+func FromToken(token Extractor) ClaimOption {
+	return func(c *claimConfig) {
+		c.token = token
+	}
+}
+
+// Verify makes Claim verify the signature of tokens, and that they haven't expired. By default
+// tokens are trusted as is, which is only safe once something else, e.g. an authenticating proxy
+// or middleware, has verified them.
+func Verify(v Verifier) ClaimOption {
+	return func(c *claimConfig) {
+		c.verify = v
+	}
+}
+
+// Claim returns the value of a claim of a request's JWT, e.g. "sub". Strings are returned as is,
+// other values in their JSON encoding.
+func Claim(name string, opts ...ClaimOption) Extractor {
+	c := &claimConfig{token: Bearer, now: time.Now}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return func(r *http.Request) (string, error) {
+		token, err := c.token(r)
+		if err != nil {
+			return "", err
+		}
+		claims, err := c.parse(token)
+		if err != nil {
+			return "", err
+		}
+		claim, ok := claims[name]
+		if !ok {
+			return "", missing("no %s claim", name)
+		}
+		var s string
+		if err := json.Unmarshal(claim, &s); err == nil {
+			return s, nil
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, claim); err != nil {
+			return "", invalid("malformed %s claim", name)
+		}
+		return compact.String(), nil
+	}
+}
+
+// parse decodes the claims of a token, verifying it if configured to.
+func (c *claimConfig) parse(token string) (map[string]json.RawMessage, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalid("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	var claims map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if c.verify == nil {
+		return claims, nil
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalid("malformed signature")
+	}
+	if err := c.verify(header.Alg, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"]; ok {
+		var expiry float64
+		if err := json.Unmarshal(exp, &expiry); err != nil {
+			return nil, invalid("malformed exp claim")
+		}
+		if c.now().After(time.Unix(int64(expiry), 0)) {
+			return nil, invalid("expired")
+		}
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return invalid("malformed segment")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return invalid("malformed segment")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package key
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sign builds a JWT with the given claims, signed by sign.
+func sign(t *testing.T, alg, claims string, sign func(signed []byte) []byte) string {
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func claim(t *testing.T, e Extractor, token string) (string, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return e(r)
+}
+
+func TestBearer(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	_, err := Bearer(r)
+	require.True(t, errors.Is(err, ErrMissing))
+	r.Header.Set("Authorization", "bearer token")
+	v, err := Bearer(r)
+	require.NoError(t, err)
+	require.Equal(t, "token", v)
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	_, err = Bearer(r)
+	require.True(t, errors.Is(err, ErrMissing))
+}
+
+func TestClaimUnverified(t *testing.T) {
+	token := sign(t, "none", `{"sub":"user","org":42,"roles":["a", "b"]}`, func([]byte) []byte { return nil })
+	for name, expected := range map[string]string{"sub": "user", "org": "42", "roles": `["a","b"]`} {
+		v, err := claim(t, Claim(name), token)
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+	}
+	_, err := claim(t, Claim("other"), token)
+	require.True(t, errors.Is(err, ErrMissing))
+	_, err = claim(t, Claim("sub"), "not.a.jwt")
+	require.True(t, errors.Is(err, ErrInvalidToken))
+}
+
+func TestClaimHMAC(t *testing.T) {
+	secret := []byte("secret")
+	hs256 := func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+	sub := Claim("sub", Verify(HMAC(secret)))
+
+	v, err := claim(t, sub, sign(t, "HS256", `{"sub":"user"}`, hs256))
+	require.NoError(t, err)
+	require.Equal(t, "user", v)
+
+	for _, token := range []string{
+		sign(t, "HS256", `{"sub":"user"}`, func([]byte) []byte { return []byte("forged") }),
+		sign(t, "none", `{"sub":"user"}`, func([]byte) []byte { return nil }),
+		sign(t, "RS256", `{"sub":"user"}`, hs256),
+		sign(t, "HS256", `{"sub":"user","exp":1}`, hs256),
+	} {
+		_, err := claim(t, sub, token)
+		require.True(t, errors.Is(err, ErrInvalidToken), token)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	_, err = claim(t, sub, sign(t, "HS256", `{"sub":"user","exp":`+strconv.FormatInt(exp, 10)+`}`, hs256))
+	require.NoError(t, err)
+}
+
+func TestClaimRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rs256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+		return signature
+	}
+	sub := Claim("sub", Verify(RSA(&key.PublicKey)))
+	v, err := claim(t, sub, sign(t, "RS256", `{"sub":"user"}`, rs256))
+	require.NoError(t, err)
+	require.Equal(t, "user", v)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = claim(t, Claim("sub", Verify(RSA(&other.PublicKey))), sign(t, "RS256", `{"sub":"user"}`, rs256))
+	require.True(t, errors.Is(err, ErrInvalidToken))
+}
+
+func TestClaimECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	es256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+	sub := Claim("sub", Verify(ECDSA(&key.PublicKey)))
+	v, err := claim(t, sub, sign(t, "ES256", `{"sub":"user"}`, es256))
+	require.NoError(t, err)
+	require.Equal(t, "user", v)
+
+	_, err = claim(t, sub, sign(t, "ES256", `{"sub":"other"}`, func([]byte) []byte { return make([]byte, 64) }))
+	require.True(t, errors.Is(err, ErrInvalidToken))
+}
+
+func TestClaimFromToken(t *testing.T) {
+	token := sign(t, "none", `{"sub":"user"}`, func([]byte) []byte { return nil })
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Cookie", "jwt="+token)
+	v, err := Claim("sub", FromToken(Cookie("jwt")))(r)
+	require.NoError(t, err)
+	require.Equal(t, "user", v)
+}
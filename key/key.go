@@ -0,0 +1,136 @@
+// Package key builds bucket names from the identity of HTTP requests. Extractors each return one
+// dimension of a request's identity, such as its client IP, API key or route, and combinators join
+// them into a stable bucket name.
+//
+// Usage:
+//
+//	name := key.Join(key.Static("api"), key.FirstOf(
+//		key.Hash(key.Header("X-Api-Key")),
+//		key.ClientIP(key.WithTrustedProxies("10.0.0.0/8")),
+//	), key.Path("/users/{id}", "/users/{id}/posts/{post}"))
+//	limiter := leakybucketHTTP.New(storage, 100, time.Minute, leakybucketHTTP.WithKey(leakybucketHTTP.KeyFunc(name)))
+package key
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Extractor returns one dimension of the identity of a request.
+type Extractor func(r *http.Request) (string, error)
+
+// ErrMissing matches, using errors.Is, the errors of extractors that found nothing to extract from
+// a request, e.g. because it doesn't have the header they read. FirstOf skips such extractors.
+var ErrMissing = errors.New("missing key")
+
+func missing(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrMissing, fmt.Sprintf(format, args...))
+}
+
+// Static returns the same value for every request, e.g. to namespace bucket names.
+func Static(value string) Extractor {
+	return func(*http.Request) (string, error) {
+		return value, nil
+	}
+}
+
+// Header returns the value of a request header.
+func Header(name string) Extractor {
+	return func(r *http.Request) (string, error) {
+		if v := r.Header.Get(name); v != "" {
+			return v, nil
+		}
+		return "", missing("no %s header", name)
+	}
+}
+
+// Cookie returns the value of a request cookie.
+func Cookie(name string) Extractor {
+	return func(r *http.Request) (string, error) {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return c.Value, nil
+		}
+		return "", missing("no %s cookie", name)
+	}
+}
+
+// Query returns the value of a URL query parameter.
+func Query(name string) Extractor {
+	return func(r *http.Request) (string, error) {
+		if v := r.URL.Query().Get(name); v != "" {
+			return v, nil
+		}
+		return "", missing("no %s query parameter", name)
+	}
+}
+
+// Method returns the request method.
+func Method(r *http.Request) (string, error) {
+	return r.Method, nil
+}
+
+// Host returns the host the request is for, without its port.
+func Host(r *http.Request) (string, error) {
+	u := url.URL{Host: r.Host}
+	if host := u.Hostname(); host != "" {
+		return strings.ToLower(host), nil
+	}
+	return "", missing("no host")
+}
+
+// Join joins the values of several extractors into a single bucket name, separated by colons.
+// Colons and backslashes within values are escaped, so different combinations of values never
+// produce the same name. Join fails if any of the extractors does.
+func Join(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (string, error) {
+		parts := make([]string, len(extractors))
+		for i, e := range extractors {
+			v, err := e(r)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = escape(v)
+		}
+		return strings.Join(parts, ":"), nil
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// FirstOf returns the value of the first extractor that finds one. Extractors failing with
+// ErrMissing are skipped, other errors are returned immediately.
+func FirstOf(extractors ...Extractor) Extractor {
+	return func(r *http.Request) (string, error) {
+		for _, e := range extractors {
+			v, err := e(r)
+			if err == nil {
+				return v, nil
+			} else if !errors.Is(err, ErrMissing) {
+				return "", err
+			}
+		}
+		return "", missing("no extractor found a key")
+	}
+}
+
+// Hash replaces the value of an extractor with a hex-encoded SHA-256 hash of it, so that secrets
+// such as API keys aren't stored as bucket names, and bucket names have a bounded length.
+func Hash(e Extractor) Extractor {
+	return func(r *http.Request) (string, error) {
+		v, err := e(r)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256([]byte(v))
+		return hex.EncodeToString(sum[:]), nil
+	}
+}
@@ -0,0 +1,86 @@
+package key
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValues(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://Example.com:8080/?q=query", nil)
+	r.Header.Set("X-Api-Key", "header")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "cookie"})
+
+	for e, expected := range map[*Extractor]string{
+		ptr(Header("X-Api-Key")): "header",
+		ptr(Cookie("session")):   "cookie",
+		ptr(Query("q")):          "query",
+		ptr(Method):              "GET",
+		ptr(Host):                "example.com",
+		ptr(Static("static")):    "static",
+	} {
+		v, err := (*e)(r)
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+	}
+
+	for _, e := range []Extractor{Header("X-Other"), Cookie("other"), Query("other")} {
+		_, err := e(r)
+		require.True(t, errors.Is(err, ErrMissing), err)
+	}
+}
+
+func ptr(e Extractor) *Extractor {
+	return &e
+}
+
+func TestJoin(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("A", `a:b\`)
+	r.Header.Set("B", "c")
+
+	v, err := Join(Static("api"), Header("A"), Header("B"))(r)
+	require.NoError(t, err)
+	require.Equal(t, `api:a\:b\\:c`, v)
+
+	// values that would collide when joined naively don't once escaped
+	r.Header.Set("A", "a")
+	r.Header.Set("B", "b:c")
+	other, err := Join(Static("api"), Header("A"), Header("B"))(r)
+	require.NoError(t, err)
+	r.Header.Set("A", "a:b")
+	r.Header.Set("B", "c")
+	v, err = Join(Static("api"), Header("A"), Header("B"))(r)
+	require.NoError(t, err)
+	require.NotEqual(t, other, v)
+
+	_, err = Join(Static("api"), Header("C"))(r)
+	require.True(t, errors.Is(err, ErrMissing))
+}
+
+func TestFirstOf(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("B", "b")
+
+	v, err := FirstOf(Header("A"), Header("B"), Static("c"))(r)
+	require.NoError(t, err)
+	require.Equal(t, "b", v)
+
+	_, err = FirstOf(Header("A"), Header("C"))(r)
+	require.True(t, errors.Is(err, ErrMissing))
+
+	failing := errors.New("failing")
+	_, err = FirstOf(func(*http.Request) (string, error) { return "", failing }, Header("B"))(r)
+	require.Equal(t, failing, err)
+}
+
+func TestHash(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Api-Key", "secret")
+	v, err := Hash(Header("X-Api-Key"))(r)
+	require.NoError(t, err)
+	require.Equal(t, "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b", v)
+}
@@ -0,0 +1,109 @@
+package key
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// template is a parsed URL path template, e.g. "/users/{id}/files/{path...}".
+type template struct {
+	raw      string
+	segments []string
+}
+
+func parseTemplate(raw string) (template, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return template{}, fmt.Errorf("path template %q doesn't start with /", raw)
+	}
+	segments := strings.Split(raw[1:], "/")
+	for i, s := range segments {
+		if strings.HasSuffix(s, "...}") && i != len(segments)-1 {
+			return template{}, fmt.Errorf("path template %q has a wildcard before its end", raw)
+		}
+	}
+	return template{raw: raw, segments: segments}, nil
+}
+
+func isWildcard(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// match returns the values of the template's wildcards in path, and whether it matches. A
+// "{name}" wildcard matches one non-empty segment and a final "{name...}" wildcard matches the
+// rest of the path.
+func (t template) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	segments := strings.Split(path[1:], "/")
+	values := map[string]string{}
+	for i, s := range t.segments {
+		if strings.HasSuffix(s, "...}") {
+			values[s[1:len(s)-4]] = strings.Join(segments[i:], "/")
+			return values, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if !isWildcard(s) {
+			if s != segments[i] {
+				return nil, false
+			}
+			continue
+		}
+		if segments[i] == "" {
+			return nil, false
+		}
+		values[s[1:len(s)-1]] = segments[i]
+	}
+	return values, len(segments) == len(t.segments)
+}
+
+func parseTemplates(raw []string) ([]template, error) {
+	templates := make([]template, 0, len(raw))
+	for _, r := range raw {
+		t, err := parseTemplate(r)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// Path returns the first of the given templates the request's path matches, e.g. "/users/{id}"
+// for "/users/42", so that every path matching a template shares a key.
+func Path(templates ...string) Extractor {
+	parsed, err := parseTemplates(templates)
+	return func(r *http.Request) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		for _, t := range parsed {
+			if _, ok := t.match(r.URL.Path); ok {
+				return t.raw, nil
+			}
+		}
+		return "", missing("path %q matches no template", r.URL.Path)
+	}
+}
+
+// PathValue returns the value of the wildcard name in the first of the given templates the
+// request's path matches, e.g. "42" for the wildcard "id" of "/users/{id}" and "/users/42".
+func PathValue(name string, templates ...string) Extractor {
+	parsed, err := parseTemplates(templates)
+	return func(r *http.Request) (string, error) {
+		if err != nil {
+			return "", err
+		}
+		for _, t := range parsed {
+			if values, ok := t.match(r.URL.Path); ok {
+				if v, ok := values[name]; ok {
+					return v, nil
+				}
+			}
+		}
+		return "", missing("path %q has no %s value", r.URL.Path, name)
+	}
+}
@@ -0,0 +1,47 @@
+package key
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPath(t *testing.T) {
+	path := Path("/users/{id}", "/users/{id}/posts/{post}", "/files/{path...}")
+	for url, expected := range map[string]string{
+		"/users/42":          "/users/{id}",
+		"/users/42/posts/7":  "/users/{id}/posts/{post}",
+		"/files/a/b/c":       "/files/{path...}",
+		"/files/":            "/files/{path...}",
+		"/users/42?query=ok": "/users/{id}",
+	} {
+		v, err := path(httptest.NewRequest("GET", url, nil))
+		require.NoError(t, err, url)
+		require.Equal(t, expected, v, url)
+	}
+	for _, url := range []string{"/users", "/users/", "/users/42/posts", "/other"} {
+		_, err := path(httptest.NewRequest("GET", url, nil))
+		require.True(t, errors.Is(err, ErrMissing), url)
+	}
+
+	_, err := Path("users/{id}")(httptest.NewRequest("GET", "/users/42", nil))
+	require.Error(t, err)
+	_, err = Path("/{path...}/users")(httptest.NewRequest("GET", "/users/42", nil))
+	require.Error(t, err)
+}
+
+func TestPathValue(t *testing.T) {
+	id := PathValue("id", "/users/{id}", "/orgs/{org}/users/{id}")
+	v, err := id(httptest.NewRequest("GET", "/orgs/1/users/42", nil))
+	require.NoError(t, err)
+	require.Equal(t, "42", v)
+
+	v, err = PathValue("path", "/files/{path...}")(httptest.NewRequest("GET", "/files/a/b", nil))
+	require.NoError(t, err)
+	require.Equal(t, "a/b", v)
+
+	_, err = id(httptest.NewRequest("GET", "/orgs/1", nil))
+	require.True(t, errors.Is(err, ErrMissing))
+}
@@ -0,0 +1,321 @@
+// Package lease provides a leakybucket.Storage decorator that takes space in the buckets of a
+// remote storage, such as redis or DynamoDB, a block at a time, and admits Add calls out of it
+// locally until the block is used up or the lease on it expires.
+//
+// This trades a bounded amount of precision for fewer calls to the storage: space leased by one
+// process isn't available to others until it's used or given back, so buckets may reject an Add
+// while processes still hold unused leases, by at most a block per process. Space leased but
+// left unused is given back when the lease expires, if the buckets of the storage are
+// leakybucket.Releasers, as those of the memory, redis and dynamodb packages are.
+//
+// Wrap the storage itself with leases, and the storage leasing with other decorators:
+//
+//	storage := leakybucketPrometheus.New(lease.New(redisStorage, lease.WithBlock(0.1)))
+package lease
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// Storage leases space in the buckets of a storage.
+type Storage struct {
+	storage leakybucket.Storage
+	block   float64
+	ttl     time.Duration
+	onError func(name string, err error)
+
+	mutex  sync.Mutex
+	leases map[string]*lease
+}
+
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+)
+
+// lease is the space a Storage holds in a bucket.
+type lease struct {
+	mutex  sync.Mutex
+	spec   leakybucket.BucketSpec
+	bucket leakybucket.Bucket
+	// state is the state of the bucket as of taking the lease, left the space leased not used yet.
+	state   leakybucket.BucketState
+	left    uint
+	expires time.Time
+	timer   *time.Timer
+}
+
+type config struct {
+	block   float64
+	ttl     time.Duration
+	onError func(name string, err error)
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*config)
+
+// WithBlock sets the fraction of their capacity leased from buckets at a time. Adds of more than a
+// block lease just what they need. The default is 0.1.
+func WithBlock(fraction float64) Option {
+	return func(c *config) {
+		c.block = fraction
+	}
+}
+
+// WithTTL sets how long leases last at most. Leases also expire when their bucket drains. The
+// default is one second.
+func WithTTL(d time.Duration) Option {
+	return func(c *config) {
+		c.ttl = d
+	}
+}
+
+// WithErrorHandler sets a function called when giving back unused space fails, e.g. to log it. By
+// default such errors are ignored: the space stays used until the bucket drains.
+func WithErrorHandler(onError func(name string, err error)) Option {
+	return func(c *config) {
+		c.onError = onError
+	}
+}
+
+// New wraps a storage, leasing space in its buckets.
+func New(storage leakybucket.Storage, opts ...Option) *Storage {
+	c := &config{
+		block:   0.1,
+		ttl:     time.Second,
+		onError: func(string, error) {},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return &Storage{
+		storage: storage,
+		block:   c.block,
+		ttl:     c.ttl,
+		onError: c.onError,
+		leases:  make(map[string]*lease),
+	}
+}
+
+// Create a bucket. Only the first Create of a bucket calls the storage, until the lease on it
+// expires.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket, passing ctx on to the storage.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	spec := leakybucket.BucketSpec{Name: name, Capacity: capacity, Rate: rate}
+	l := s.lease(name)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.bucket == nil || l.spec != spec {
+		b, err := leakybucket.CreateContext(ctx, s.storage, name, capacity, rate)
+		if err != nil {
+			return nil, err
+		}
+		// the limits changed: the space leased under the old ones goes back
+		s.release(l)
+		l.spec = spec
+		l.bucket = b
+		l.state = leakybucket.BucketState{Capacity: b.Capacity(), Remaining: b.Remaining(), Reset: b.Reset()}
+	}
+	return &bucket{storage: s, spec: spec, state: l.view()}, nil
+}
+
+// UpdateLimits gives back the space leased in a bucket, then changes its limits.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	s.mutex.Lock()
+	l, ok := s.leases[name]
+	delete(s.leases, name)
+	s.mutex.Unlock()
+	if ok {
+		l.mutex.Lock()
+		s.release(l)
+		l.bucket = nil
+		l.mutex.Unlock()
+	}
+	return leakybucket.UpdateLimits(s.storage, name, capacity, rate)
+}
+
+// Close gives back the space leased in every bucket, e.g. before the process exits.
+func (s *Storage) Close() {
+	s.mutex.Lock()
+	leases := s.leases
+	s.leases = make(map[string]*lease)
+	s.mutex.Unlock()
+	for _, l := range leases {
+		l.mutex.Lock()
+		s.release(l)
+		l.bucket = nil
+		l.mutex.Unlock()
+	}
+}
+
+// lease returns the lease on a bucket, creating it if needed.
+func (s *Storage) lease(name string) *lease {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.leases[name]
+	if !ok {
+		l = &lease{}
+		s.leases[name] = l
+	}
+	return l
+}
+
+// expire gives back the space left in a lease once it expires, and forgets the lease.
+func (s *Storage) expire(l *lease) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if time.Now().Before(l.expires) {
+		// the lease was renewed
+		return
+	}
+	s.release(l)
+	s.mutex.Lock()
+	if s.leases[l.spec.Name] == l {
+		delete(s.leases, l.spec.Name)
+	}
+	s.mutex.Unlock()
+}
+
+// release gives back the space left in a lease. The caller must hold the lease's mutex.
+func (s *Storage) release(l *lease) {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	left := l.left
+	l.left = 0
+	l.expires = time.Time{}
+	releaser, ok := l.bucket.(leakybucket.Releaser)
+	if left == 0 || !ok || !time.Now().Before(l.state.Reset) {
+		return
+	}
+	state, err := releaser.Release(left, l.state.Reset)
+	if err != nil {
+		s.onError(l.spec.Name, err)
+		return
+	}
+	l.state = state
+}
+
+// view returns the state of the bucket as seen from the lease. The caller must hold the lease's
+// mutex.
+func (l *lease) view() leakybucket.BucketState {
+	return leakybucket.BucketState{
+		Capacity:  l.state.Capacity,
+		Remaining: l.state.Remaining + l.left,
+		Reset:     l.state.Reset,
+	}
+}
+
+// add admits amount out of the lease on a bucket, leasing more space if needed.
+func (s *Storage) add(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+	for {
+		l := s.lease(spec.Name)
+		l.mutex.Lock()
+		if l.bucket == nil || l.spec != spec {
+			// the lease expired, or the limits changed, since the bucket was created
+			l.mutex.Unlock()
+			if _, err := s.CreateContext(ctx, spec.Name, spec.Capacity, spec.Rate); err != nil {
+				return leakybucket.BucketState{}, err
+			}
+			continue
+		}
+		state, err := s.addLeased(ctx, l, amount)
+		l.mutex.Unlock()
+		return state, err
+	}
+}
+
+// addLeased admits amount out of a lease, leasing more space if needed. The caller must hold the
+// lease's mutex.
+func (s *Storage) addLeased(ctx context.Context, l *lease, amount uint) (leakybucket.BucketState, error) {
+	now := time.Now()
+	if !now.Before(l.expires) {
+		s.release(l)
+	}
+	if amount <= l.left {
+		l.left -= amount
+		return l.view(), nil
+	}
+
+	need := amount - l.left
+	size := max(need, uint(s.block*float64(l.spec.Capacity)), 1)
+	state, err := leakybucket.AddContext(ctx, l.bucket, size)
+	if err == leakybucket.ErrorFull && size > need {
+		// there isn't room for a whole block, but there may be for the Add
+		size = need
+		state, err = leakybucket.AddContext(ctx, l.bucket, size)
+	}
+	if err != nil {
+		if state.Capacity != 0 || !state.Reset.IsZero() {
+			l.state = state
+		}
+		return l.view(), err
+	}
+
+	l.state = state
+	l.left = l.left + size - amount
+	l.expires = now.Add(s.ttl)
+	if state.Reset.Before(l.expires) {
+		l.expires = state.Reset
+	}
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.timer = time.AfterFunc(l.expires.Sub(now), func() { s.expire(l) })
+	return l.view(), nil
+}
+
+// bucket is a bucket whose adds are admitted out of the storage's lease on it.
+type bucket struct {
+	storage *Storage
+	spec    leakybucket.BucketSpec
+	mutex   sync.Mutex
+	state   leakybucket.BucketState
+}
+
+var _ leakybucket.ContextBucket = &bucket{}
+
+func (b *bucket) Capacity() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Capacity
+}
+
+// Remaining space in the bucket, counting the space leased but not used yet.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Reset
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket, passing ctx on to the storage when leasing more space.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	state, err := b.storage.add(ctx, b.spec, amount)
+	if err == nil || state.Capacity != 0 || !state.Reset.IsZero() {
+		b.mutex.Lock()
+		b.state = state
+		b.mutex.Unlock()
+	}
+	return state, err
+}
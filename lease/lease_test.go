@@ -0,0 +1,167 @@
+package lease
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+// counting is a storage counting the Add calls to its buckets.
+type counting struct {
+	leakybucket.Storage
+	adds *atomic.Int64
+}
+
+type releaserBucket interface {
+	leakybucket.Bucket
+	leakybucket.Releaser
+}
+
+type countingBucket struct {
+	releaserBucket
+	adds *atomic.Int64
+}
+
+func newCounting() counting {
+	return counting{Storage: memory.New(), adds: &atomic.Int64{}}
+}
+
+func (c counting) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, err := c.Storage.Create(name, capacity, rate)
+	if err != nil {
+		return nil, err
+	}
+	return countingBucket{b.(releaserBucket), c.adds}, nil
+}
+
+func (b countingBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	b.adds.Add(1)
+	return b.releaserBucket.Add(amount)
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New()))(t)
+}
+
+func TestAddReset(t *testing.T) {
+	test.AddResetTest(New(memory.New()))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(New(memory.New()))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(New(memory.New()))(t)
+}
+
+func TestBucketInstanceConsistency(t *testing.T) {
+	test.BucketInstanceConsistencyTest(New(memory.New()))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New(memory.New()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(New(memory.New()))(t)
+}
+
+func TestLeasing(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithBlock(0.1), WithTTL(time.Minute))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		state, err := bucket.Add(1)
+		require.NoError(t, err)
+		require.Equal(t, uint(99-i), state.Remaining)
+	}
+	require.Equal(t, int64(1), storage.adds.Load())
+
+	// the next Add leases another block
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), storage.adds.Load())
+
+	// Adds larger than a block lease what they need
+	state, err := bucket.Add(25)
+	require.NoError(t, err)
+	require.Equal(t, uint(64), state.Remaining)
+
+	direct, err := storage.Storage.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(64), direct.Remaining(), "the 9 tokens of the second block were used first")
+}
+
+func TestExpiry(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithBlock(0.1), WithTTL(50*time.Millisecond))
+	bucket, err := s.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+
+	direct, err := storage.Storage.Create("testbucket", 100, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(90), direct.Remaining())
+
+	// the unused space goes back once the lease expires
+	require.Eventually(t, func() bool {
+		state, err := direct.Add(0)
+		return err == nil && state.Remaining == 99
+	}, time.Second, 10*time.Millisecond)
+
+	state, err := bucket.Add(1)
+	require.NoError(t, err)
+	require.Equal(t, uint(98), state.Remaining)
+	require.Equal(t, int64(2), storage.adds.Load())
+}
+
+func TestFull(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithBlock(0.5), WithTTL(time.Minute))
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+
+	other, err := storage.Storage.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = other.Add(7)
+	require.NoError(t, err)
+
+	// there isn't room for a block, but there is for the Add
+	state, err := bucket.Add(2)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), state.Remaining)
+
+	_, err = bucket.Add(2)
+	require.Equal(t, leakybucket.ErrorFull, err)
+}
+
+func TestClose(t *testing.T) {
+	storage := newCounting()
+	s := New(storage, WithBlock(0.5), WithTTL(time.Minute))
+	for _, name := range []string{"a", "b"} {
+		bucket, err := s.Create(name, 10, time.Minute)
+		require.NoError(t, err)
+		_, err = bucket.Add(1)
+		require.NoError(t, err)
+	}
+
+	s.Close()
+	for _, name := range []string{"a", "b"} {
+		direct, err := storage.Storage.Create(name, 10, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, uint(9), direct.Remaining())
+	}
+}
@@ -0,0 +1,17 @@
+module github.com/Clever/leakybucket/memcached/v2
+
+go 1.24
+
+require (
+	github.com/Clever/leakybucket/v2 v2.0.0
+	github.com/bradfitz/gomemcache v0.0.0-20250403215159-8d39553ac7cf
+	github.com/stretchr/testify v1.10.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/Clever/leakybucket/v2 => ../
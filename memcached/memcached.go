@@ -0,0 +1,437 @@
+/*
+Package memcached provides a leaky bucket implementation backed by memcached.
+
+Every bucket is stored as two items, both expiring once the bucket drains:
+  - a meta item, under the bucket's key, holding its capacity, rate, reset and the generation of
+    its current window, replaced with compare-and-swap when a new window starts;
+  - a counter item per generation, under the bucket's key and the generation, incremented by
+    every Add.
+
+An Add increments the counter and, if the bucket turns out to be full, decrements it back. Unlike
+the redis package, whose Adds check and update a bucket in a single script, an Add that doesn't fit
+is counted until it's decremented: Adds concurrent with it may see its amount in the meantime, and
+be wrongly rejected for it. Windows are started and expired by the clock of the processes, as with
+the dynamodb package, rather than by memcached's.
+*/
+package memcached
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+	_ leakybucket.ContextBucket  = &bucket{}
+	_ leakybucket.Releaser       = &bucket{}
+)
+
+// maxAttempts bounds how many times an operation tries again when a bucket changes under it.
+const maxAttempts = 10
+
+// errBucketConflict is returned when a bucket keeps changing under an operation.
+var errBucketConflict = errors.New("bucket changed concurrently")
+
+// meta is the meta item of a bucket.
+type meta struct {
+	capacity   uint
+	rate       time.Duration
+	reset      time.Time
+	generation string
+	item       *memcache.Item
+}
+
+func decodeMeta(item *memcache.Item) (*meta, error) {
+	var capacity uint
+	var rate, reset int64
+	var generation string
+	if _, err := fmt.Sscanf(string(item.Value), "%d %d %d %s", &capacity, &rate, &reset, &generation); err != nil {
+		return nil, fmt.Errorf("invalid bucket %q: %w", item.Key, err)
+	}
+	return &meta{
+		capacity:   capacity,
+		rate:       time.Duration(rate),
+		reset:      time.Unix(0, reset),
+		generation: generation,
+		item:       item,
+	}, nil
+}
+
+func (m *meta) encode() []byte {
+	return []byte(fmt.Sprintf("%d %d %d %s", m.capacity, m.rate.Nanoseconds(), m.reset.UnixNano(), m.generation))
+}
+
+func (m *meta) mismatch(name string, capacity uint, rate time.Duration) error {
+	if m.capacity == capacity && m.rate == rate {
+		return nil
+	}
+	return &leakybucket.ConfigMismatchError{
+		Name:              name,
+		Capacity:          m.capacity,
+		Rate:              m.rate,
+		RequestedCapacity: capacity,
+		RequestedRate:     rate,
+	}
+}
+
+func newGeneration() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// expiration returns the expiration of items for a bucket draining at reset, in memcached's terms:
+// seconds from now up to 30 days, a Unix time beyond.
+func expiration(reset time.Time) int32 {
+	seconds := int64(time.Until(reset)/time.Second) + 1
+	if seconds < 1 {
+		seconds = 1
+	}
+	if seconds > 60*60*24*30 {
+		return int32(reset.Unix() + 1)
+	}
+	return int32(seconds)
+}
+
+type bucket struct {
+	name     string
+	key      string
+	capacity uint
+	rate     time.Duration
+	storage  *Storage
+	mutex    sync.Mutex
+	state    leakybucket.BucketState
+}
+
+// Capacity of the bucket.
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Reset
+}
+
+// update sets the local state of the bucket, unless an error left it unknown.
+func (b *bucket) update(state leakybucket.BucketState, err error) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil || state.Capacity != 0 {
+		b.state = state
+	}
+	return b.state, err
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket. The memcached client can't be canceled, so ctx is unused.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	return b.update(b.storage.add(b.name, b.key, amount, b.capacity, b.rate))
+}
+
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	s := b.storage
+	m, err := s.meta(b.key)
+	if err != nil {
+		return b.update(leakybucket.BucketState{}, err)
+	} else if m == nil || !m.reset.Equal(reset) || m.mismatch(b.name, b.capacity, b.rate) != nil || time.Now().After(m.reset) {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.state, nil
+	}
+	used, err := s.client.Decrement(counterKey(b.key, m.generation), uint64(amount))
+	if err == memcache.ErrCacheMiss {
+		used, err = 0, nil
+	} else if err != nil {
+		return b.update(leakybucket.BucketState{}, err)
+	}
+	return b.update(state(m, uint(used)), nil)
+}
+
+func state(m *meta, used uint) leakybucket.BucketState {
+	return leakybucket.BucketState{
+		Capacity:  m.capacity,
+		Remaining: m.capacity - min(used, m.capacity),
+		Reset:     m.reset,
+	}
+}
+
+// Storage is a memcached-based, thread-safe leaky bucket factory.
+type Storage struct {
+	client      *memcache.Client
+	prefix      string
+	reconfigure bool
+	usage       leakybucket.UsageMode
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithPrefix sets the prefix of the keys of buckets. The default is "leakybucket:".
+func WithPrefix(prefix string) Option {
+	return func(s *Storage) {
+		s.prefix = prefix
+	}
+}
+
+// WithReconfigure makes Create store the requested capacity and rate with a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
+}
+
+// New initializes the connection to the given memcached servers, e.g. "localhost:11211".
+func New(servers []string, opts ...Option) (*Storage, error) {
+	s := &Storage{
+		client: memcache.New(servers...),
+		prefix: "leakybucket:",
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.client.Ping(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// key returns the key of a bucket. Names that aren't valid in memcached keys, e.g. because they
+// contain spaces or are too long, are hashed.
+func (s *Storage) key(name string) string {
+	key := s.prefix + name
+	if len(key) > 200 {
+		return s.prefix + hashName(name)
+	}
+	for _, c := range []byte(key) {
+		if c <= ' ' || c == 0x7f {
+			return s.prefix + hashName(name)
+		}
+	}
+	return key
+}
+
+func hashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func counterKey(key, generation string) string {
+	return key + "#" + generation
+}
+
+// meta reads the meta item of a bucket, returning nil if it doesn't exist.
+func (s *Storage) meta(key string) (*meta, error) {
+	item, err := s.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeMeta(item)
+}
+
+// used reads the counter of a window.
+func (s *Storage) used(m *meta, key string) (uint, error) {
+	item, err := s.client.Get(counterKey(key, m.generation))
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	used, err := strconv.ParseUint(string(item.Value), 10, 64)
+	return uint(used), err
+}
+
+// startWindow stores a new window for a bucket, with used already used, replacing prev unless it
+// has changed in the meantime. It returns nil if it has.
+func (s *Storage) startWindow(key string, prev *meta, capacity uint, rate time.Duration, reset time.Time, used uint) (*meta, error) {
+	m := &meta{capacity: capacity, rate: rate, reset: reset, generation: newGeneration()}
+	if used > 0 {
+		if err := s.client.Set(&memcache.Item{
+			Key:        counterKey(key, m.generation),
+			Value:      []byte(strconv.FormatUint(uint64(used), 10)),
+			Expiration: expiration(reset),
+		}); err != nil {
+			return nil, err
+		}
+	}
+	item := &memcache.Item{Key: key, Value: m.encode(), Expiration: expiration(reset)}
+	var err error
+	if prev == nil {
+		err = s.client.Add(item)
+	} else {
+		item.CasID = prev.item.CasID
+		err = s.client.CompareAndSwap(item)
+	}
+	switch err {
+	case nil:
+		return m, nil
+	case memcache.ErrNotStored, memcache.ErrCASConflict, memcache.ErrCacheMiss:
+		return nil, nil
+	}
+	return nil, err
+}
+
+// window returns the current window of a bucket, creating the bucket or starting a new window if
+// needed.
+func (s *Storage) window(name, key string, capacity uint, rate time.Duration) (*meta, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		m, err := s.meta(key)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			if err := m.mismatch(name, capacity, rate); err != nil {
+				return m, err
+			}
+			if !time.Now().After(m.reset) {
+				return m, nil
+			}
+		}
+		if m, err = s.startWindow(key, m, capacity, rate, time.Now().Add(rate), 0); err != nil || m != nil {
+			return m, err
+		}
+	}
+	return nil, errBucketConflict
+}
+
+// add adds to a bucket if there is space for it, creating the bucket if needed.
+func (s *Storage) add(name, key string, amount, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	m, err := s.window(name, key, capacity, rate)
+	if err != nil {
+		if m != nil {
+			used, _ := s.used(m, key)
+			return state(m, used), err
+		}
+		return leakybucket.BucketState{}, err
+	}
+	if amount == 0 {
+		used, err := s.used(m, key)
+		return state(m, used), err
+	}
+
+	counter := counterKey(key, m.generation)
+	used, err := s.client.Increment(counter, uint64(amount))
+	if err == memcache.ErrCacheMiss {
+		// the first add of the window creates the counter
+		err = s.client.Add(&memcache.Item{Key: counter, Value: []byte("0"), Expiration: expiration(m.reset)})
+		if err != nil && err != memcache.ErrNotStored {
+			return state(m, 0), err
+		}
+		used, err = s.client.Increment(counter, uint64(amount))
+	}
+	if err != nil {
+		return state(m, 0), err
+	}
+	if used > uint64(capacity) {
+		used, err = s.client.Decrement(counter, uint64(amount))
+		if err != nil && err != memcache.ErrCacheMiss {
+			return state(m, capacity), err
+		}
+		return state(m, uint(used)), leakybucket.ErrorFull
+	}
+	return state(m, uint(used)), nil
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket. The memcached client can't be canceled, so ctx is unused.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	key := s.key(name)
+	// adding 0 creates the bucket, or starts a new window if it has drained
+	state, err := s.add(name, key, 0, capacity, rate)
+	if err != nil && s.reconfigure && errors.Is(err, leakybucket.ErrConfigMismatch) {
+		state, err = s.updateLimits(key, capacity, rate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{
+		name:     name,
+		key:      key,
+		capacity: capacity,
+		rate:     rate,
+		storage:  s,
+		state:    state,
+	}, nil
+}
+
+// updateLimits stores a new configuration with a bucket, carrying over its used space and the
+// start of its window in a new window. Adds to the previous window made in the meantime are lost.
+func (s *Storage) updateLimits(key string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		now := time.Now()
+		prev, err := s.meta(key)
+		if err != nil {
+			return leakybucket.BucketState{}, err
+		} else if prev == nil {
+			return leakybucket.BucketState{Capacity: capacity, Remaining: capacity, Reset: now.Add(rate)}, nil
+		}
+		var used uint
+		reset := prev.reset
+		if !now.After(reset) {
+			if used, err = s.used(prev, key); err != nil {
+				return leakybucket.BucketState{}, err
+			}
+			used = s.usage.Carry(used, prev.capacity, capacity)
+			// the window keeps its start
+			reset = reset.Add(rate - prev.rate)
+		}
+		if now.After(reset) {
+			// the bucket drained under the new rate
+			used = 0
+			reset = now.Add(rate)
+		}
+		m, err := s.startWindow(key, prev, capacity, rate, reset, used)
+		if err != nil {
+			return leakybucket.BucketState{}, err
+		} else if m != nil {
+			return state(m, used), nil
+		}
+	}
+	return leakybucket.BucketState{}, errBucketConflict
+}
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	return s.updateLimits(s.key(name), capacity, rate)
+}
@@ -0,0 +1,124 @@
+package memcached
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+// testServer spawns a memcached process for the test, skipping the test if memcached isn't
+// installed.
+func testServer(t *testing.T) string {
+	path, err := exec.LookPath("memcached")
+	if err != nil {
+		// CI installs memcached, so the tests must run there
+		if os.Getenv("CI") != "" {
+			t.Fatal("memcached is not installed")
+		}
+		t.Skip("memcached is not installed")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cmd := exec.Command(path, "-l", "127.0.0.1", "-p", fmt.Sprint(port), "-U", "0")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return address
+}
+
+func testStorage(t *testing.T, opts ...Option) *Storage {
+	s, err := New([]string{testServer(t)}, opts...)
+	require.NoError(t, err)
+	return s
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(testStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(testStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(testStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	test.AddResetTest(testStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(testStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	test.BucketInstanceConsistencyTest(testStorage(t))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(testStorage(t))(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	test.ReconfigureTest(testStorage(t, WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(testStorage(t))(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	test.UpdateLimitsProportionalTest(testStorage(t, WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	test.ReleaseTest(testStorage(t))(t)
+}
+
+// package specific tests
+func TestInvalidHost(t *testing.T) {
+	_, err := New([]string{"127.0.0.1:1"})
+	require.Error(t, err)
+}
+
+func TestKey(t *testing.T) {
+	s := &Storage{prefix: "leakybucket:"}
+	require.Equal(t, "leakybucket:user:1", s.key("user:1"))
+	require.True(t, strings.HasPrefix(s.key("user 1"), "leakybucket:sha256:"))
+	require.True(t, strings.HasPrefix(s.key(strings.Repeat("a", 250)), "leakybucket:sha256:"))
+	require.NotEqual(t, s.key("user 1"), s.key("user 2"))
+}
+
+func TestUnusualNames(t *testing.T) {
+	s := testStorage(t)
+	for _, name := range []string{"with spaces", strings.Repeat("long", 100)} {
+		bucket, err := s.Create(name, 2, time.Minute)
+		require.NoError(t, err)
+		_, err = bucket.Add(2)
+		require.NoError(t, err)
+		_, err = bucket.Add(1)
+		require.Equal(t, leakybucket.ErrorFull, err)
+	}
+}
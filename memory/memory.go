@@ -4,7 +4,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/Clever/leakybucket"
+	"github.com/Clever/leakybucket/v2"
 )
 
 type bucket struct {
@@ -16,16 +16,22 @@ type bucket struct {
 }
 
 func (b *bucket) Capacity() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.capacity
 }
 
 // Remaining space in the bucket.
 func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.remaining
 }
 
 // Reset returns when the bucket will be drained.
 func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.reset
 }
 
@@ -44,22 +50,104 @@ func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
 	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}, nil
 }
 
-// Storage is a non thread-safe in-memory leaky bucket factory.
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.reset.Equal(reset) && time.Now().Before(b.reset) {
+		b.remaining += min(amount, b.capacity-b.remaining)
+	}
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}, nil
+}
+
+// Storage is a thread-safe in-memory leaky bucket factory.
 type Storage struct {
-	buckets map[string]*bucket
+	mutex       sync.Mutex
+	buckets     map[string]*bucket
+	reconfigure bool
+	usage       leakybucket.UsageMode
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithReconfigure makes Create apply the requested capacity and rate to a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
 }
 
 // New initializes the in-memory bucket store.
-func New() *Storage {
-	return &Storage{
+func New(opts ...Option) *Storage {
+	s := &Storage{
 		buckets: make(map[string]*bucket),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// configure checks the bucket's configuration against the requested one, applying the requested
+// configuration if reconfigure is set.
+func (b *bucket) configure(name string, capacity uint, rate time.Duration, reconfigure bool, usage leakybucket.UsageMode) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.capacity == capacity && b.rate == rate {
+		return nil
+	}
+	if !reconfigure {
+		return &leakybucket.ConfigMismatchError{
+			Name:              name,
+			Capacity:          b.capacity,
+			Rate:              b.rate,
+			RequestedCapacity: capacity,
+			RequestedRate:     rate,
+		}
+	}
+	b.updateLimits(capacity, rate, usage)
+	return nil
+}
+
+// updateLimits applies a new capacity and rate to the bucket. The caller must hold the mutex.
+func (b *bucket) updateLimits(capacity uint, rate time.Duration, usage leakybucket.UsageMode) {
+	now := time.Now()
+	used := uint(0)
+	if !now.After(b.reset) {
+		used = usage.Carry(b.capacity-b.remaining, b.capacity, capacity)
+		// the window keeps its start
+		b.reset = b.reset.Add(rate - b.rate)
+	}
+	if now.After(b.reset) {
+		// the bucket drained under the new rate
+		used = 0
+		b.reset = now.Add(rate)
+	}
+	b.capacity = capacity
+	b.remaining = capacity - used
+	b.rate = rate
 }
 
 // Create a bucket.
 func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	b, ok := s.buckets[name]
 	if ok {
+		if err := b.configure(name, capacity, rate, s.reconfigure, s.usage); err != nil {
+			return nil, err
+		}
 		return b, nil
 	}
 	b = &bucket{
@@ -71,3 +159,17 @@ func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakyb
 	s.buckets[name] = b
 	return b, nil
 }
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	s.mutex.Lock()
+	b, ok := s.buckets[name]
+	s.mutex.Unlock()
+	if !ok {
+		return leakybucket.BucketState{Capacity: capacity, Remaining: capacity, Reset: time.Now().Add(rate)}, nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.updateLimits(capacity, rate, s.usage)
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}, nil
+}
@@ -3,7 +3,8 @@ package memory
 import (
 	"testing"
 
-	"github.com/Clever/leakybucket/test"
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
 )
 
 func TestCreate(t *testing.T) {
@@ -33,3 +34,27 @@ func TestFindOrCreate(t *testing.T) {
 func TestBucketInstanceConsistencyTest(t *testing.T) {
 	test.BucketInstanceConsistencyTest(New())(t)
 }
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New())(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	test.ReconfigureTest(New(WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(New())(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	test.UpdateLimitsProportionalTest(New(WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	test.ReleaseTest(New())(t)
+}
+
+func TestThreadSafeCreate(t *testing.T) {
+	test.ThreadSafeCreateTest(New())(t)
+}
@@ -0,0 +1,149 @@
+package leakybucket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BucketSpec identifies a bucket and the configuration it's used with.
+type BucketSpec struct {
+	Name     string
+	Capacity uint
+	Rate     time.Duration
+}
+
+// CreateFunc creates the bucket described by spec, as Storage.Create does.
+type CreateFunc func(ctx context.Context, spec BucketSpec) (Bucket, error)
+
+// AddFunc adds amount to the bucket described by spec, as Bucket.Add does.
+type AddFunc func(ctx context.Context, spec BucketSpec, amount uint) (BucketState, error)
+
+// UpdateLimitsFunc changes the capacity and rate of the bucket named by spec to spec's, as
+// LimitUpdater.UpdateLimits does.
+type UpdateLimitsFunc func(ctx context.Context, spec BucketSpec) (BucketState, error)
+
+// ClassFunc returns the class of a bucket given its name, e.g. the route or tier it limits, for
+// middleware that treats buckets by class rather than one by one.
+type ClassFunc func(name string) string
+
+// Middleware adds behavior, such as metrics or logging, to a Storage and its buckets. Each field
+// wraps the function doing the corresponding operation, calling next to carry it on, and may be
+// nil to leave the operation alone. Use Chain to apply middleware to a Storage.
+type Middleware struct {
+	Create       func(next CreateFunc) CreateFunc
+	Add          func(next AddFunc) AddFunc
+	UpdateLimits func(next UpdateLimitsFunc) UpdateLimitsFunc
+}
+
+// Chain applies middleware to a storage. The first middleware is the outermost: it's the first to
+// see every operation and the last to see its result. Buckets created by the returned storage run
+// their adds through the Add of every middleware, down to the bucket created by the Create of
+// the innermost middleware. Contexts passed to CreateContext and AddContext are passed down the
+// chain, and on to the storage if it's a ContextStorage. The UpdateLimits of the returned storage
+// fails with errors.ErrUnsupported unless storage is a LimitUpdater too.
+func Chain(storage Storage, middleware ...Middleware) ChainedStorage {
+	create := CreateFunc(func(ctx context.Context, spec BucketSpec) (Bucket, error) {
+		return CreateContext(ctx, storage, spec.Name, spec.Capacity, spec.Rate)
+	})
+	updateLimits := UpdateLimitsFunc(func(ctx context.Context, spec BucketSpec) (BucketState, error) {
+		return UpdateLimits(storage, spec.Name, spec.Capacity, spec.Rate)
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].Create != nil {
+			create = middleware[i].Create(create)
+		}
+		if middleware[i].UpdateLimits != nil {
+			updateLimits = middleware[i].UpdateLimits(updateLimits)
+		}
+	}
+	return &chain{create: create, updateLimits: updateLimits, middleware: middleware}
+}
+
+// ChainedStorage is a storage with middleware applied by Chain. Storage decorators embed it to
+// offer every operation of the storage they wrap.
+type ChainedStorage interface {
+	ContextStorage
+	LimitUpdater
+}
+
+type chain struct {
+	create       CreateFunc
+	updateLimits UpdateLimitsFunc
+	middleware   []Middleware
+}
+
+func (c *chain) Create(name string, capacity uint, rate time.Duration) (Bucket, error) {
+	return c.CreateContext(context.Background(), name, capacity, rate)
+}
+
+func (c *chain) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (Bucket, error) {
+	spec := BucketSpec{Name: name, Capacity: capacity, Rate: rate}
+	inner, err := c.create(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	add := AddFunc(func(ctx context.Context, spec BucketSpec, amount uint) (BucketState, error) {
+		return AddContext(ctx, inner, amount)
+	})
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		if c.middleware[i].Add != nil {
+			add = c.middleware[i].Add(add)
+		}
+	}
+	return &chainBucket{
+		spec: spec,
+		add:  add,
+		state: BucketState{
+			Capacity:  inner.Capacity(),
+			Remaining: inner.Remaining(),
+			Reset:     inner.Reset(),
+		},
+	}, nil
+}
+
+func (c *chain) UpdateLimits(name string, capacity uint, rate time.Duration) (BucketState, error) {
+	return c.updateLimits(context.Background(), BucketSpec{Name: name, Capacity: capacity, Rate: rate})
+}
+
+// chainBucket is a bucket whose adds run through a chain of middleware. Its state is whatever the
+// chain last returned.
+type chainBucket struct {
+	spec  BucketSpec
+	add   AddFunc
+	mutex sync.Mutex
+	state BucketState
+}
+
+func (b *chainBucket) Capacity() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Capacity
+}
+
+func (b *chainBucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Remaining
+}
+
+func (b *chainBucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Reset
+}
+
+func (b *chainBucket) Add(amount uint) (BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+func (b *chainBucket) AddContext(ctx context.Context, amount uint) (BucketState, error) {
+	state, err := b.add(ctx, b.spec, amount)
+	if err == nil || state.Capacity != 0 || !state.Reset.IsZero() {
+		// failures may not know the state of the bucket
+		b.mutex.Lock()
+		b.state = state
+		b.mutex.Unlock()
+	}
+	return state, err
+}
@@ -0,0 +1,104 @@
+package leakybucket_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+)
+
+// recorder is middleware appending the operations it sees to calls, tagged with its name.
+func recorder(name string, calls *[]string) leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				*calls = append(*calls, name+" create "+spec.Name)
+				return next(ctx, spec)
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				*calls = append(*calls, name+" add "+spec.Name)
+				state, err := next(ctx, spec, amount)
+				*calls = append(*calls, name+" added "+spec.Name)
+				return state, err
+			}
+		},
+	}
+}
+
+type ctxKey struct{}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	s := leakybucket.Chain(memory.New(), recorder("outer", &calls), recorder("inner", &calls), leakybucket.Middleware{})
+	bucket, err := s.Create("bucket", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Remaining() != 1 {
+		t.Fatalf("expected 1 remaining, got %d", bucket.Remaining())
+	}
+	expected := []string{
+		"outer create bucket", "inner create bucket",
+		"outer add bucket", "inner add bucket", "inner added bucket", "outer added bucket",
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected calls %v, got %v", expected, calls)
+	}
+	for i := range calls {
+		if calls[i] != expected[i] {
+			t.Fatalf("expected calls %v, got %v", expected, calls)
+		}
+	}
+}
+
+func TestChainContext(t *testing.T) {
+	var seen []interface{}
+	s := leakybucket.Chain(memory.New(), leakybucket.Middleware{
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				seen = append(seen, ctx.Value(ctxKey{}))
+				return next(ctx, spec, amount)
+			}
+		},
+	})
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	bucket, err := leakybucket.CreateContext(ctx, s, "bucket", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leakybucket.AddContext(ctx, bucket, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[0] != "value" {
+		t.Fatalf("expected the context to be passed down, saw %v", seen)
+	}
+}
+
+func TestChainConformance(t *testing.T) {
+	t.Run("Create", test.CreateTest(leakybucket.Chain(memory.New())))
+	t.Run("Add", test.AddTest(leakybucket.Chain(memory.New())))
+	t.Run("AddReset", test.AddResetTest(leakybucket.Chain(memory.New())))
+	t.Run("ConfigMismatch", test.ConfigMismatchTest(leakybucket.Chain(memory.New())))
+	t.Run("UpdateLimits", test.UpdateLimitsTest(leakybucket.Chain(memory.New())))
+}
+
+// createOnly is a storage that can't update the limits of its buckets.
+type createOnly struct {
+	leakybucket.Storage
+}
+
+func TestChainUpdateLimitsUnsupported(t *testing.T) {
+	s := leakybucket.Chain(createOnly{memory.New()})
+	if _, err := leakybucket.UpdateLimits(s, "testbucket", 10, time.Minute); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected errors.ErrUnsupported, received %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+// Package otel provides a leakybucket.Storage decorator instrumenting its buckets with
+// OpenTelemetry traces and metrics.
+//
+// Create and Add calls are traced as spans named "leakybucket.Create" and "leakybucket.Add", with
+// attributes for the bucket's name, capacity and rate, the amount added, the space remaining and
+// the outcome. Bucket names are often user IDs, API keys or addresses: use WithRedaction to keep
+// them out of traces. Storages that support contexts, such as the redis and dynamodb ones configured with
+// WithTracerProvider, trace their own requests as children of those spans. Use CreateContext and
+// AddContext from the leakybucket package to parent the spans to the caller's.
+//
+// The metrics mirror those of the prometheus package:
+//
+//   - leakybucket.adds counts calls to Bucket.Add by outcome: "allowed", "rejected" when the
+//     bucket is full, or "error".
+//   - leakybucket.storage.duration is a histogram of the latency of the underlying storage, in
+//     seconds, by operation: "create", "add" or "update_limits".
+//   - leakybucket.remaining_ratio is a histogram of the fraction of their capacity buckets have
+//     left after each allowed Add.
+//
+// Every metric has a leakybucket.class attribute, as returned by a leakybucket.ClassFunc, rather
+// than the bucket's name, to bound the cardinality of the metrics.
+package otel
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const scope = "github.com/Clever/leakybucket/otel/v2"
+
+// Add outcomes.
+const (
+	outcomeAllowed  = "allowed"
+	outcomeRejected = "rejected"
+	outcomeError    = "error"
+)
+
+// Storage operations.
+const (
+	opCreate       = "create"
+	opAdd          = "add"
+	opUpdateLimits = "update_limits"
+)
+
+// Instruments trace and record metrics about buckets through their Middleware.
+type Instruments struct {
+	class     leakybucket.ClassFunc
+	redact    func(name string) string
+	tracer    trace.Tracer
+	adds      metric.Int64Counter
+	duration  metric.Float64Histogram
+	remaining metric.Float64Histogram
+}
+
+// Storage wraps a leakybucket.Storage, instrumenting its buckets.
+type Storage struct {
+	leakybucket.ChainedStorage
+}
+
+type config struct {
+	class          leakybucket.ClassFunc
+	redact         func(name string) string
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*config)
+
+// WithClass sets the class of buckets. By default every bucket's class is "default".
+func WithClass(class leakybucket.ClassFunc) Option {
+	return func(c *config) {
+		c.class = class
+	}
+}
+
+// WithRedaction sets what is recorded in place of bucket names, in span attributes and the errors
+// spans record, e.g. the slog package's HashNames. By default names are recorded as is.
+func WithRedaction(redact func(name string) string) Option {
+	return func(c *config) {
+		c.redact = redact
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer spans are recorded with. The default is the
+// global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithMeterProvider sets the provider of the meter metrics are recorded with. The default is the
+// global provider.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = mp
+	}
+}
+
+// New wraps a storage, instrumenting its buckets. It fails if the metrics can't be created.
+func New(storage leakybucket.Storage, opts ...Option) (*Storage, error) {
+	instruments, err := NewInstruments(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{leakybucket.Chain(storage, instruments.Middleware())}, nil
+}
+
+// NewInstruments creates the instruments used by New, to instrument a storage of one's own making
+// with Middleware and leakybucket.Chain. It fails if the metrics can't be created.
+func NewInstruments(opts ...Option) (*Instruments, error) {
+	c := &config{
+		class:          func(string) string { return "default" },
+		redact:         func(name string) string { return name },
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	meter := c.meterProvider.Meter(scope)
+	s := &Instruments{
+		class:  c.class,
+		redact: c.redact,
+		tracer: c.tracerProvider.Tracer(scope),
+	}
+	var err error
+	if s.adds, err = meter.Int64Counter("leakybucket.adds",
+		metric.WithDescription("Calls to Bucket.Add by outcome: allowed, rejected or error."),
+		metric.WithUnit("{call}")); err != nil {
+		return nil, err
+	}
+	if s.duration, err = meter.Float64Histogram("leakybucket.storage.duration",
+		metric.WithDescription("Latency of the bucket storage by operation: create, add or update_limits."),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if s.remaining, err = meter.Float64Histogram("leakybucket.remaining_ratio",
+		metric.WithDescription("Fraction of their capacity buckets have left after each allowed Add."),
+		metric.WithUnit("1"),
+		metric.WithExplicitBucketBoundaries(0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1)); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Instruments) observe(ctx context.Context, class, op string, start time.Time) {
+	s.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("leakybucket.class", class),
+		attribute.String("leakybucket.operation", op),
+	))
+}
+
+// fail records err on span, with the bucket name of configuration mismatches redacted.
+func (s *Instruments) fail(span trace.Span, err error) {
+	var mismatch *leakybucket.ConfigMismatchError
+	if errors.As(err, &mismatch) {
+		redacted := *mismatch
+		redacted.Name = s.redact(mismatch.Name)
+		err = &redacted
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *Instruments) specAttributes(spec leakybucket.BucketSpec, class string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("leakybucket.name", s.redact(spec.Name)),
+		attribute.String("leakybucket.class", class),
+		attribute.Int64("leakybucket.capacity", int64(spec.Capacity)),
+		attribute.Int64("leakybucket.rate_ms", spec.Rate.Milliseconds()),
+	)
+}
+
+// Middleware traces and records metrics about the operations of a storage and its buckets.
+func (s *Instruments) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				class := s.class(spec.Name)
+				ctx, span := s.tracer.Start(ctx, "leakybucket.Create", s.specAttributes(spec, class))
+				defer span.End()
+				start := time.Now()
+				b, err := next(ctx, spec)
+				s.observe(ctx, class, opCreate, start)
+				if err != nil {
+					s.fail(span, err)
+					return nil, err
+				}
+				span.SetAttributes(attribute.Int64("leakybucket.remaining", int64(b.Remaining())))
+				return b, nil
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				class := s.class(spec.Name)
+				ctx, span := s.tracer.Start(ctx, "leakybucket.Add", s.specAttributes(spec, class),
+					trace.WithAttributes(attribute.Int64("leakybucket.amount", int64(amount))))
+				defer span.End()
+				start := time.Now()
+				state, err := next(ctx, spec, amount)
+				s.observe(ctx, class, opAdd, start)
+
+				outcome := outcomeAllowed
+				switch {
+				case err == nil:
+					if state.Capacity > 0 {
+						s.remaining.Record(ctx, float64(state.Remaining)/float64(state.Capacity),
+							metric.WithAttributes(attribute.String("leakybucket.class", class)))
+					}
+				case errors.Is(err, leakybucket.ErrorFull):
+					outcome = outcomeRejected
+				default:
+					outcome = outcomeError
+					s.fail(span, err)
+				}
+				span.SetAttributes(
+					attribute.Int64("leakybucket.remaining", int64(state.Remaining)),
+					attribute.String("leakybucket.outcome", outcome),
+				)
+				s.adds.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("leakybucket.class", class),
+					attribute.String("leakybucket.outcome", outcome),
+				))
+				return state, err
+			}
+		},
+		UpdateLimits: func(next leakybucket.UpdateLimitsFunc) leakybucket.UpdateLimitsFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.BucketState, error) {
+				class := s.class(spec.Name)
+				ctx, span := s.tracer.Start(ctx, "leakybucket.UpdateLimits", s.specAttributes(spec, class))
+				defer span.End()
+				start := time.Now()
+				state, err := next(ctx, spec)
+				s.observe(ctx, class, opUpdateLimits, start)
+				if err != nil {
+					s.fail(span, err)
+				}
+				return state, err
+			}
+		},
+	}
+}
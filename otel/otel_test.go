@@ -0,0 +1,142 @@
+package otel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newStorage(t *testing.T, opts ...Option) *Storage {
+	s, err := New(memory.New(), opts...)
+	require.NoError(t, err)
+	return s
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(newStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(newStorage(t))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(newStorage(t))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(newStorage(t))(t)
+}
+
+func attributes(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := map[attribute.Key]attribute.Value{}
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s := newStorage(t, WithTracerProvider(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	bucket, err := leakybucket.CreateContext(ctx, s, "bucket", 2, time.Minute)
+	require.NoError(t, err)
+	_, err = leakybucket.AddContext(ctx, bucket, 2)
+	require.NoError(t, err)
+	_, err = leakybucket.AddContext(ctx, bucket, 1)
+	require.Equal(t, leakybucket.ErrorFull, err)
+	parent.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 4)
+	for _, span := range spans[:3] {
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+
+	create := attributes(spans[0].Attributes())
+	require.Equal(t, "leakybucket.Create", spans[0].Name())
+	require.Equal(t, int64(2), create["leakybucket.capacity"].AsInt64())
+	require.Equal(t, int64(60000), create["leakybucket.rate_ms"].AsInt64())
+
+	allowed := attributes(spans[1].Attributes())
+	require.Equal(t, "leakybucket.Add", spans[1].Name())
+	require.Equal(t, int64(2), allowed["leakybucket.amount"].AsInt64())
+	require.Equal(t, int64(0), allowed["leakybucket.remaining"].AsInt64())
+	require.Equal(t, "allowed", allowed["leakybucket.outcome"].AsString())
+
+	rejected := attributes(spans[2].Attributes())
+	require.Equal(t, "rejected", rejected["leakybucket.outcome"].AsString())
+	// rejections are expected, not errors
+	require.Equal(t, codes.Unset, spans[2].Status().Code)
+}
+
+func TestRedaction(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s := newStorage(t, WithTracerProvider(tp), WithRedaction(func(string) string { return "redacted" }))
+
+	_, err := s.Create("api-key", 2, time.Minute)
+	require.NoError(t, err)
+	_, err = s.Create("api-key", 3, time.Minute)
+	require.ErrorIs(t, err, leakybucket.ErrConfigMismatch)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		require.Equal(t, "redacted", attributes(span.Attributes())["leakybucket.name"].AsString())
+	}
+	require.NotContains(t, spans[1].Status().Description, "api-key")
+	require.Len(t, spans[1].Events(), 1)
+	for _, kv := range spans[1].Events()[0].Attributes {
+		require.NotContains(t, kv.Value.Emit(), "api-key")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	s := newStorage(t, WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))),
+		WithClass(func(name string) string { return "class" }))
+
+	bucket, err := s.Create("bucket", 4, time.Minute)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		bucket.Add(2)
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Len(t, rm.ScopeMetrics, 1)
+	metrics := map[string]metricdata.Metrics{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	adds := map[string]int64{}
+	for _, point := range metrics["leakybucket.adds"].Data.(metricdata.Sum[int64]).DataPoints {
+		outcome, _ := point.Attributes.Value("leakybucket.outcome")
+		adds[outcome.AsString()] = point.Value
+	}
+	require.Equal(t, map[string]int64{"allowed": 2, "rejected": 1}, adds)
+
+	duration := metrics["leakybucket.storage.duration"].Data.(metricdata.Histogram[float64])
+	require.Len(t, duration.DataPoints, 2)
+
+	remaining := metrics["leakybucket.remaining_ratio"].Data.(metricdata.Histogram[float64])
+	require.Len(t, remaining.DataPoints, 1)
+	require.Equal(t, uint64(2), remaining.DataPoints[0].Count)
+	require.Equal(t, 0.5, remaining.DataPoints[0].Sum)
+}
@@ -0,0 +1,209 @@
+// Package prometheus provides a leakybucket.Storage decorator recording Prometheus metrics about
+// the buckets it creates:
+//
+//   - leakybucket_adds_total counts calls to Bucket.Add by result: "allowed", "rejected" when the
+//     bucket is full, or "error".
+//   - leakybucket_storage_duration_seconds is a histogram of the latency of the underlying storage,
+//     by operation: "create", "add" or "update_limits".
+//   - leakybucket_remaining_ratio is a histogram of the fraction of their capacity buckets have
+//     left after each successful Add.
+//
+// Every metric is labeled by the class of the bucket, as returned by a leakybucket.ClassFunc,
+// rather than its name, to bound the cardinality of the metrics.
+//
+// Usage:
+//
+//	storage := leakybucketPrometheus.New(redisStorage, leakybucketPrometheus.WithClass(func(name string) string {
+//		return strings.SplitN(name, ":", 2)[0]
+//	}))
+//	prometheus.MustRegister(storage)
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Add results.
+const (
+	resultAllowed  = "allowed"
+	resultRejected = "rejected"
+	resultError    = "error"
+)
+
+// Storage operations.
+const (
+	opCreate       = "create"
+	opAdd          = "add"
+	opUpdateLimits = "update_limits"
+)
+
+// Metrics records metrics about buckets through its Middleware. It's a prometheus.Collector of
+// those metrics.
+type Metrics struct {
+	class     leakybucket.ClassFunc
+	adds      *prometheus.CounterVec
+	duration  *prometheus.HistogramVec
+	remaining *prometheus.HistogramVec
+}
+
+var _ prometheus.Collector = &Metrics{}
+
+// Storage wraps a leakybucket.Storage, recording metrics about its buckets. It's a
+// prometheus.Collector of those metrics.
+type Storage struct {
+	leakybucket.ChainedStorage
+	*Metrics
+}
+
+type config struct {
+	class          leakybucket.ClassFunc
+	namespace      string
+	constLabels    prometheus.Labels
+	latencyBuckets []float64
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*config)
+
+// WithClass sets the class of buckets. Classes label the metrics of a Storage, so there should be
+// few of them. By default every bucket's class is "default".
+func WithClass(class leakybucket.ClassFunc) Option {
+	return func(c *config) {
+		c.class = class
+	}
+}
+
+// WithNamespace prefixes the names of the metrics with a namespace, e.g. "myapp" for
+// myapp_leakybucket_adds_total.
+func WithNamespace(namespace string) Option {
+	return func(c *config) {
+		c.namespace = namespace
+	}
+}
+
+// WithConstLabels adds labels with constant values to every metric, e.g. to tell storages apart.
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(c *config) {
+		c.constLabels = labels
+	}
+}
+
+// WithLatencyBuckets sets the buckets, in seconds, of the storage latency histogram. The default is
+// prometheus.DefBuckets.
+func WithLatencyBuckets(buckets []float64) Option {
+	return func(c *config) {
+		c.latencyBuckets = buckets
+	}
+}
+
+// New wraps a storage, recording metrics about its buckets.
+func New(storage leakybucket.Storage, opts ...Option) *Storage {
+	m := NewMetrics(opts...)
+	return &Storage{
+		ChainedStorage: leakybucket.Chain(storage, m.Middleware()),
+		Metrics:        m,
+	}
+}
+
+// NewMetrics creates the metrics recorded by New, to record them about a storage of one's own
+// making with Middleware and leakybucket.Chain.
+func NewMetrics(opts ...Option) *Metrics {
+	c := &config{
+		class:          func(string) string { return "default" },
+		latencyBuckets: prometheus.DefBuckets,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return &Metrics{
+		class: c.class,
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   c.namespace,
+			Subsystem:   "leakybucket",
+			Name:        "adds_total",
+			Help:        "Calls to Bucket.Add by result: allowed, rejected or error.",
+			ConstLabels: c.constLabels,
+		}, []string{"class", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   c.namespace,
+			Subsystem:   "leakybucket",
+			Name:        "storage_duration_seconds",
+			Help:        "Latency of the bucket storage by operation: create, add or update_limits.",
+			ConstLabels: c.constLabels,
+			Buckets:     c.latencyBuckets,
+		}, []string{"class", "op"}),
+		remaining: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   c.namespace,
+			Subsystem:   "leakybucket",
+			Name:        "remaining_ratio",
+			Help:        "Fraction of their capacity buckets have left after each allowed Add.",
+			ConstLabels: c.constLabels,
+			Buckets:     prometheus.LinearBuckets(0, 0.1, 11),
+		}, []string{"class"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.adds.Describe(ch)
+	m.duration.Describe(ch)
+	m.remaining.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.adds.Collect(ch)
+	m.duration.Collect(ch)
+	m.remaining.Collect(ch)
+}
+
+func (m *Metrics) observe(class, op string, start time.Time) {
+	m.duration.WithLabelValues(class, op).Observe(time.Since(start).Seconds())
+}
+
+// Middleware records metrics about the operations of a storage and its buckets.
+func (m *Metrics) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				start := time.Now()
+				b, err := next(ctx, spec)
+				m.observe(m.class(spec.Name), opCreate, start)
+				return b, err
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				class := m.class(spec.Name)
+				start := time.Now()
+				state, err := next(ctx, spec, amount)
+				m.observe(class, opAdd, start)
+				switch {
+				case err == nil:
+					m.adds.WithLabelValues(class, resultAllowed).Inc()
+					if state.Capacity > 0 {
+						m.remaining.WithLabelValues(class).Observe(float64(state.Remaining) / float64(state.Capacity))
+					}
+				case errors.Is(err, leakybucket.ErrorFull):
+					m.adds.WithLabelValues(class, resultRejected).Inc()
+				default:
+					m.adds.WithLabelValues(class, resultError).Inc()
+				}
+				return state, err
+			}
+		},
+		UpdateLimits: func(next leakybucket.UpdateLimitsFunc) leakybucket.UpdateLimitsFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.BucketState, error) {
+				start := time.Now()
+				state, err := next(ctx, spec)
+				m.observe(m.class(spec.Name), opUpdateLimits, start)
+				return state, err
+			}
+		},
+	}
+}
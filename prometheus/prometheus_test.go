@@ -0,0 +1,115 @@
+package prometheus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New()))(t)
+}
+
+func TestAddReset(t *testing.T) {
+	test.AddResetTest(New(memory.New()))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(New(memory.New()))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(New(memory.New()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(New(memory.New()))(t)
+}
+
+// failing is a storage whose buckets fail to add.
+type failing struct {
+	leakybucket.Storage
+}
+
+type failingBucket struct {
+	leakybucket.Bucket
+}
+
+func (f failing) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, err := f.Storage.Create(name, capacity, rate)
+	return failingBucket{b}, err
+}
+
+func (failingBucket) Add(uint) (leakybucket.BucketState, error) {
+	return leakybucket.BucketState{}, errors.New("failing")
+}
+
+func TestMetrics(t *testing.T) {
+	s := New(memory.New(), WithNamespace("test"), WithClass(func(name string) string {
+		return strings.SplitN(name, ":", 2)[0]
+	}))
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(s))
+
+	for _, name := range []string{"api:a", "api:b"} {
+		bucket, err := s.Create(name, 4, time.Minute)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err := bucket.Add(2)
+			if i < 2 {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, leakybucket.ErrorFull, err)
+			}
+		}
+	}
+	_, err := s.UpdateLimits("web:c", 1, time.Minute)
+	require.NoError(t, err)
+
+	failed := New(failing{memory.New()}, WithNamespace("test"))
+	bucket, err := failed.Create("web:c", 1, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.Error(t, err)
+
+	require.Equal(t, 4.0, testutil.ToFloat64(s.adds.WithLabelValues("api", resultAllowed)))
+	require.Equal(t, 2.0, testutil.ToFloat64(s.adds.WithLabelValues("api", resultRejected)))
+	require.Equal(t, 1.0, testutil.ToFloat64(failed.adds.WithLabelValues("default", resultError)))
+
+	require.NoError(t, testutil.CollectAndCompare(s, strings.NewReader(`
+# HELP test_leakybucket_remaining_ratio Fraction of their capacity buckets have left after each allowed Add.
+# TYPE test_leakybucket_remaining_ratio histogram
+test_leakybucket_remaining_ratio_bucket{class="api",le="0"} 2
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.1"} 2
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.2"} 2
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.30000000000000004"} 2
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.4"} 2
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.5"} 4
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.6"} 4
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.7"} 4
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.7999999999999999"} 4
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.8999999999999999"} 4
+test_leakybucket_remaining_ratio_bucket{class="api",le="0.9999999999999999"} 4
+test_leakybucket_remaining_ratio_bucket{class="api",le="+Inf"} 4
+test_leakybucket_remaining_ratio_sum{class="api"} 1
+test_leakybucket_remaining_ratio_count{class="api"} 4
+`), "test_leakybucket_remaining_ratio"))
+
+	// create and add for the api class, update_limits for the web class
+	require.Equal(t, 3, testutil.CollectAndCount(s, "test_leakybucket_storage_duration_seconds"))
+	count, err := testutil.GatherAndCount(registry)
+	require.NoError(t, err)
+	require.Equal(t, 6, count)
+}
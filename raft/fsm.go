@@ -0,0 +1,264 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	hraft "github.com/hashicorp/raft"
+)
+
+var (
+	_ hraft.FSM         = &FSM{}
+	_ hraft.FSMSnapshot = &snapshot{}
+)
+
+const (
+	opCreate        = "create"
+	opAdd           = "add"
+	opUpdateLimits  = "update_limits"
+	opRelease       = "release"
+	opDeleteExpired = "delete_expired"
+)
+
+// command is an operation on the buckets, as replicated in the Raft log. The leader stamps every
+// command with its clock before appending it, so that every node applies it the same way.
+type command struct {
+	Op          string                `json:"op"`
+	Name        string                `json:"name,omitempty"`
+	Amount      uint                  `json:"amount,omitempty"`
+	Capacity    uint                  `json:"capacity,omitempty"`
+	Rate        time.Duration         `json:"rate,omitempty"`
+	Reset       int64                 `json:"reset,omitempty"`
+	Reconfigure bool                  `json:"reconfigure,omitempty"`
+	Usage       leakybucket.UsageMode `json:"usage,omitempty"`
+	Now         int64                 `json:"now"`
+}
+
+// result is the outcome of applying a command.
+type result struct {
+	Capacity  uint      `json:"capacity"`
+	Remaining uint      `json:"remaining"`
+	Reset     int64     `json:"reset"`
+	Full      bool      `json:"full,omitempty"`
+	Mismatch  *mismatch `json:"mismatch,omitempty"`
+	Deleted   int       `json:"deleted,omitempty"`
+}
+
+// mismatch is the configuration a bucket was stored with when it didn't match the requested one.
+type mismatch struct {
+	Capacity uint          `json:"capacity"`
+	Rate     time.Duration `json:"rate"`
+}
+
+func (r *result) state() leakybucket.BucketState {
+	return leakybucket.BucketState{Capacity: r.Capacity, Remaining: r.Remaining, Reset: time.Unix(0, r.Reset)}
+}
+
+// err returns the error the command failed with, if any.
+func (r *result) err(c command) error {
+	switch {
+	case r.Mismatch != nil:
+		return &leakybucket.ConfigMismatchError{
+			Name:              c.Name,
+			Capacity:          r.Mismatch.Capacity,
+			Rate:              r.Mismatch.Rate,
+			RequestedCapacity: c.Capacity,
+			RequestedRate:     c.Rate,
+		}
+	case r.Full:
+		return leakybucket.ErrorFull
+	}
+	return nil
+}
+
+// record is the state of a bucket: how much was added to it in its current window, its
+// configuration, and when it drains.
+type record struct {
+	Used     uint          `json:"used"`
+	Capacity uint          `json:"capacity"`
+	Rate     time.Duration `json:"rate"`
+	Reset    int64         `json:"reset"`
+}
+
+func (r *record) result() *result {
+	return &result{Capacity: r.Capacity, Remaining: r.Capacity - min(r.Used, r.Capacity), Reset: r.Reset}
+}
+
+func (r *record) matches(capacity uint, rate time.Duration) bool {
+	return r.Capacity == capacity && r.Rate == rate
+}
+
+// FSM is the state machine replicated by Raft: the buckets of every node of the cluster. Pass a new
+// FSM to raft.NewRaft for each node, and a Storage over the resulting raft.Raft.
+type FSM struct {
+	mutex   sync.Mutex
+	buckets map[string]*record
+	// clock is the latest time a command was applied at. Leaders' clocks may disagree, so time
+	// never goes backwards for the buckets when leadership changes.
+	clock int64
+}
+
+// NewFSM returns a state machine without any buckets.
+func NewFSM() *FSM {
+	return &FSM{buckets: map[string]*record{}}
+}
+
+// Apply a command appended to the Raft log. It returns a *result, or an error if the command
+// can't be decoded.
+func (f *FSM) Apply(l *hraft.Log) interface{} {
+	var c command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return fmt.Errorf("decoding command: %w", err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.clock = max(f.clock, c.Now)
+	switch c.Op {
+	case opCreate:
+		// adding 0 creates the bucket, or starts a new window if it has drained
+		r := f.add(c.Name, 0, c.Capacity, c.Rate)
+		if r.Mismatch != nil && c.Reconfigure {
+			r = f.updateLimits(c.Name, c.Capacity, c.Rate, c.Usage)
+		}
+		return r
+	case opAdd:
+		return f.add(c.Name, c.Amount, c.Capacity, c.Rate)
+	case opUpdateLimits:
+		return f.updateLimits(c.Name, c.Capacity, c.Rate, c.Usage)
+	case opRelease:
+		return f.release(c.Name, c.Amount, c.Capacity, c.Rate, c.Reset)
+	case opDeleteExpired:
+		return f.deleteExpired()
+	}
+	return fmt.Errorf("unknown command %q", c.Op)
+}
+
+func (f *FSM) drained(r *record) bool {
+	return f.clock > r.Reset
+}
+
+// add adds to a bucket if there is space for it, creating the bucket or starting a new window if
+// needed.
+func (f *FSM) add(name string, amount, capacity uint, rate time.Duration) *result {
+	r := f.buckets[name]
+	if r != nil && !r.matches(capacity, rate) {
+		res := r.result()
+		res.Mismatch = &mismatch{Capacity: r.Capacity, Rate: r.Rate}
+		return res
+	}
+	if r == nil || f.drained(r) {
+		r = &record{Capacity: capacity, Rate: rate, Reset: f.clock + int64(rate)}
+		f.buckets[name] = r
+	}
+	if r.Used+amount > r.Capacity {
+		res := r.result()
+		res.Full = true
+		return res
+	}
+	r.Used += amount
+	return r.result()
+}
+
+// updateLimits stores a new configuration with a bucket, carrying over its used space and the
+// start of its window.
+func (f *FSM) updateLimits(name string, capacity uint, rate time.Duration, usage leakybucket.UsageMode) *result {
+	r := f.buckets[name]
+	if r == nil {
+		return &result{Capacity: capacity, Remaining: capacity, Reset: f.clock + int64(rate)}
+	}
+	var used uint
+	reset := r.Reset
+	if !f.drained(r) {
+		used = usage.Carry(r.Used, r.Capacity, capacity)
+		// the window keeps its start
+		reset += int64(rate - r.Rate)
+	}
+	if f.clock > reset {
+		// the bucket drained under the new rate
+		used = 0
+		reset = f.clock + int64(rate)
+	}
+	r = &record{Used: used, Capacity: capacity, Rate: rate, Reset: reset}
+	f.buckets[name] = r
+	return r.result()
+}
+
+// release removes from what was added to a bucket, as long as it is still in the window ending
+// at reset and has the same configuration.
+func (f *FSM) release(name string, amount, capacity uint, rate time.Duration, reset int64) *result {
+	r := f.buckets[name]
+	if r == nil {
+		return &result{Capacity: capacity, Remaining: capacity, Reset: f.clock + int64(rate)}
+	}
+	if r.Reset == reset && r.matches(capacity, rate) && !f.drained(r) {
+		r.Used -= min(amount, r.Used)
+	}
+	return r.result()
+}
+
+// deleteExpired deletes the buckets that have drained.
+func (f *FSM) deleteExpired() *result {
+	var deleted int
+	for name, r := range f.buckets {
+		if f.drained(r) {
+			delete(f.buckets, name)
+			deleted++
+		}
+	}
+	return &result{Deleted: deleted}
+}
+
+// state is what snapshots of the FSM hold.
+type state struct {
+	Clock   int64              `json:"clock"`
+	Buckets map[string]*record `json:"buckets"`
+}
+
+// Snapshot returns a copy of the buckets for Raft to persist.
+func (f *FSM) Snapshot() (hraft.FSMSnapshot, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	buckets := make(map[string]*record, len(f.buckets))
+	for name, r := range f.buckets {
+		copied := *r
+		buckets[name] = &copied
+	}
+	return &snapshot{state: state{Clock: f.clock, Buckets: buckets}}, nil
+}
+
+// Restore replaces the buckets with those of a snapshot.
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var s state
+	if err := json.NewDecoder(rc).Decode(&s); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if s.Buckets == nil {
+		s.Buckets = map[string]*record{}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.buckets = s.Buckets
+	f.clock = s.Clock
+	return nil
+}
+
+type snapshot struct {
+	state state
+}
+
+// Persist writes the snapshot to sink.
+func (s *snapshot) Persist(sink hraft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release is a no-op: the snapshot is a copy.
+func (s *snapshot) Release() {}
@@ -0,0 +1,313 @@
+/*
+Package raft provides a leaky bucket implementation replicated across a group of service instances
+with Raft, for running rate limits without an external datastore.
+
+Every node of the group runs an FSM under a raft.Raft, and every change to a bucket is a command
+appended to the Raft log, so Add is linearizable and buckets survive the loss of a minority of the
+nodes. Only the leader can append to the log: a Storage on another node returns
+raft.ErrNotLeader, unless it is given a Forwarder to send its commands to the leader's Storage.
+
+	fsm := raft.NewFSM()
+	r, err := hraft.NewRaft(config, fsm, logs, stable, snapshots, transport)
+	storage := raft.New(r, raft.WithForwarder(forward))
+*/
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	hraft "github.com/hashicorp/raft"
+)
+
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+	_ leakybucket.ContextBucket  = &bucket{}
+	_ leakybucket.Releaser       = &bucket{}
+)
+
+type bucket struct {
+	name     string
+	capacity uint
+	rate     time.Duration
+	storage  *Storage
+	mutex    sync.Mutex
+	state    leakybucket.BucketState
+}
+
+// Capacity of the bucket.
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state.Reset
+}
+
+// update sets the local state of the bucket, unless an error left it unknown.
+func (b *bucket) update(res *result, err error) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if res != nil {
+		state := res.state()
+		b.state = leakybucket.BucketState{Capacity: b.capacity, Remaining: state.Remaining, Reset: state.Reset}
+	}
+	return b.state, err
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket, giving up waiting for the command to be committed once ctx is
+// done.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	return b.update(b.storage.apply(ctx, command{
+		Op:       opAdd,
+		Name:     b.name,
+		Amount:   amount,
+		Capacity: b.capacity,
+		Rate:     b.rate,
+	}))
+}
+
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	return b.update(b.storage.apply(context.Background(), command{
+		Op:       opRelease,
+		Name:     b.name,
+		Amount:   amount,
+		Capacity: b.capacity,
+		Rate:     b.rate,
+		Reset:    reset.UnixNano(),
+	}))
+}
+
+// Forwarder sends an encoded command to the Storage of the leader at address, typically over the
+// service's own RPC mechanism, and returns what the leader's Storage.Apply returned.
+type Forwarder func(ctx context.Context, leader hraft.ServerAddress, command []byte) ([]byte, error)
+
+// Storage is a Raft-replicated, thread-safe leaky bucket factory.
+type Storage struct {
+	raft        *hraft.Raft
+	timeout     time.Duration
+	forward     Forwarder
+	clock       func() time.Time
+	reconfigure bool
+	usage       leakybucket.UsageMode
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithApplyTimeout sets how long to wait for a command to be committed, unless the context of the
+// call expires first. The default is 5 seconds.
+func WithApplyTimeout(d time.Duration) Option {
+	return func(s *Storage) {
+		s.timeout = d
+	}
+}
+
+// WithForwarder makes a Storage on a node that isn't the leader send its commands to the leader
+// with forward. By default, such a Storage returns raft.ErrNotLeader.
+func WithForwarder(forward Forwarder) Option {
+	return func(s *Storage) {
+		s.forward = forward
+	}
+}
+
+// WithClock sets the time source the node uses to start and expire bucket windows while it is the
+// leader. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Storage) {
+		s.clock = now
+	}
+}
+
+// WithReconfigure makes Create store the requested capacity and rate with a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
+}
+
+// New initializes a bucket storage replicated by r, whose state machine must be an FSM.
+func New(r *hraft.Raft, opts ...Option) *Storage {
+	s := &Storage{
+		raft:    r,
+		timeout: 5 * time.Second,
+		clock:   time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// apply replicates a command, on this node if it is the leader, or through the leader otherwise.
+func (s *Storage) apply(ctx context.Context, c command) (*result, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if s.forward == nil || s.raft.State() == hraft.Leader {
+		res, err := s.applyLocal(ctx, data)
+		if err == nil || s.forward == nil || !errors.Is(err, hraft.ErrNotLeader) {
+			return s.result(c, res, err)
+		}
+		// lost leadership in the meantime
+	}
+	leader, _ := s.raft.LeaderWithID()
+	if leader == "" {
+		return nil, hraft.ErrNotLeader
+	}
+	data, err = s.forward(ctx, leader, data)
+	if err != nil {
+		return nil, err
+	}
+	var res result
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return s.result(c, &res, nil)
+}
+
+func (s *Storage) result(c command, res *result, err error) (*result, error) {
+	if err != nil {
+		return nil, err
+	}
+	return res, res.err(c)
+}
+
+// applyLocal stamps a command with the clock of this node and appends it to the log, returning the
+// result of applying it once committed.
+func (s *Storage) applyLocal(ctx context.Context, data []byte) (*result, error) {
+	var c command
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	c.Now = s.clock().UnixNano()
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	timeout := s.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		// raft only times out enqueuing commands given a positive timeout
+		timeout = max(min(timeout, time.Until(deadline)), time.Millisecond)
+	}
+	future := s.raft.Apply(data, timeout)
+	// the command may still be committed after giving up on it
+	applied := make(chan error, 1)
+	go func() {
+		applied <- future.Error()
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-applied:
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch res := future.Response().(type) {
+	case *result:
+		return res, nil
+	case error:
+		return nil, res
+	}
+	return nil, errors.New("unexpected response from the state machine")
+}
+
+// Apply applies a command sent by the Forwarder of another node, returning the result to send
+// back. It returns raft.ErrNotLeader if this node isn't the leader.
+func (s *Storage) Apply(ctx context.Context, command []byte) ([]byte, error) {
+	res, err := s.applyLocal(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket, giving up waiting for the command to be committed once ctx is
+// done.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	res, err := s.apply(ctx, command{
+		Op:          opCreate,
+		Name:        name,
+		Capacity:    capacity,
+		Rate:        rate,
+		Reconfigure: s.reconfigure,
+		Usage:       s.usage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{
+		name:     name,
+		capacity: capacity,
+		rate:     rate,
+		storage:  s,
+		state:    res.state(),
+	}, nil
+}
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	res, err := s.apply(context.Background(), command{
+		Op:       opUpdateLimits,
+		Name:     name,
+		Capacity: capacity,
+		Rate:     rate,
+		Usage:    s.usage,
+	})
+	if err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	return res.state(), nil
+}
+
+// DeleteExpired deletes the buckets that have drained on every node, and returns how many it
+// deleted. Drained buckets are otherwise kept, to tell whether they are created with their
+// previous configuration.
+func (s *Storage) DeleteExpired(ctx context.Context) (int, error) {
+	res, err := s.apply(ctx, command{Op: opDeleteExpired})
+	if err != nil {
+		return 0, err
+	}
+	return res.Deleted, nil
+}
@@ -0,0 +1,311 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
+	hraft "github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+type node struct {
+	raft    *hraft.Raft
+	fsm     *FSM
+	address hraft.ServerAddress
+}
+
+type cluster struct {
+	nodes []*node
+}
+
+// newCluster starts n nodes connected by in-memory transports, and waits for them to elect a
+// leader.
+func newCluster(t *testing.T, n int) *cluster {
+	c := &cluster{}
+	transports := make([]*hraft.InmemTransport, n)
+	var configuration hraft.Configuration
+	for i := range transports {
+		address, transport := hraft.NewInmemTransport(hraft.ServerAddress(fmt.Sprintf("node%d", i)))
+		transports[i] = transport
+		configuration.Servers = append(configuration.Servers, hraft.Server{
+			ID:      hraft.ServerID(address),
+			Address: address,
+		})
+	}
+	for i, transport := range transports {
+		for j, other := range transports {
+			if i != j {
+				transport.Connect(other.LocalAddr(), other)
+			}
+		}
+	}
+	for i, transport := range transports {
+		config := hraft.DefaultConfig()
+		config.LocalID = configuration.Servers[i].ID
+		config.HeartbeatTimeout = 50 * time.Millisecond
+		config.ElectionTimeout = 50 * time.Millisecond
+		config.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.CommitTimeout = 5 * time.Millisecond
+		config.LogOutput = io.Discard
+		store := hraft.NewInmemStore()
+		fsm := NewFSM()
+		r, err := hraft.NewRaft(config, fsm, store, store, hraft.NewInmemSnapshotStore(), transport)
+		require.NoError(t, err)
+		t.Cleanup(func() { r.Shutdown().Error() })
+		c.nodes = append(c.nodes, &node{raft: r, fsm: fsm, address: transport.LocalAddr()})
+	}
+	require.NoError(t, c.nodes[0].raft.BootstrapCluster(configuration).Error())
+	c.leader(t)
+	return c
+}
+
+// leader waits for a leader among the nodes still running and returns it.
+func (c *cluster) leader(t *testing.T) *node {
+	var leader *node
+	require.Eventually(t, func() bool {
+		for _, n := range c.nodes {
+			if n.raft.State() == hraft.Leader {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	return leader
+}
+
+func (c *cluster) follower(t *testing.T) *node {
+	leader := c.leader(t)
+	for _, n := range c.nodes {
+		if n != leader && n.raft.State() == hraft.Follower {
+			return n
+		}
+	}
+	t.Fatal("no follower")
+	return nil
+}
+
+// storages returns a Storage for every node, forwarding to the leader's with opts.
+func (c *cluster) storages(opts ...Option) map[hraft.ServerAddress]*Storage {
+	storages := map[hraft.ServerAddress]*Storage{}
+	forward := func(ctx context.Context, leader hraft.ServerAddress, command []byte) ([]byte, error) {
+		return storages[leader].Apply(ctx, command)
+	}
+	for _, n := range c.nodes {
+		storages[n.address] = New(n.raft, append([]Option{WithForwarder(forward)}, opts...)...)
+	}
+	return storages
+}
+
+func leaderStorage(t *testing.T, opts ...Option) *Storage {
+	c := newCluster(t, 3)
+	return New(c.leader(t).raft, opts...)
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(leaderStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(leaderStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(leaderStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	test.AddResetTest(leaderStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(leaderStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	test.BucketInstanceConsistencyTest(leaderStorage(t))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(leaderStorage(t))(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	test.ReconfigureTest(leaderStorage(t, WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(leaderStorage(t))(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	test.UpdateLimitsProportionalTest(leaderStorage(t, WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	test.ReleaseTest(leaderStorage(t))(t)
+}
+
+// Commands are stamped with the leader's clock, so a follower whose clock runs ahead doesn't drain
+// buckets early.
+func TestClockSkew(t *testing.T) {
+	c := newCluster(t, 3)
+	slow := New(c.leader(t).raft)
+	fast := New(c.follower(t).raft,
+		WithClock(func() time.Time { return time.Now().Add(2 * time.Second) }),
+		WithForwarder(func(ctx context.Context, leader hraft.ServerAddress, command []byte) ([]byte, error) {
+			return slow.Apply(ctx, command)
+		}))
+	test.ClockSkewTest(fast, slow)(t)
+}
+
+// package specific tests
+func TestFollowerNotLeader(t *testing.T) {
+	c := newCluster(t, 3)
+	s := New(c.follower(t).raft)
+	_, err := s.Create("testbucket", 10, time.Minute)
+	require.ErrorIs(t, err, hraft.ErrNotLeader)
+}
+
+func TestForwarding(t *testing.T) {
+	c := newCluster(t, 3)
+	storages := c.storages()
+	follower := storages[c.follower(t).address]
+	bucket, err := follower.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(4)
+	require.NoError(t, err)
+
+	state, err := storages[c.leader(t).address].UpdateLimits("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(6), state.Remaining)
+
+	_, err = follower.Create("testbucket", 20, time.Minute)
+	require.ErrorIs(t, err, leakybucket.ErrConfigMismatch)
+	_, err = bucket.Add(7)
+	require.Equal(t, leakybucket.ErrorFull, err)
+}
+
+func TestContextDone(t *testing.T) {
+	s := leaderStorage(t)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = leakybucket.AddContext(ctx, bucket, 1)
+	require.ErrorIs(t, err, context.Canceled)
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = leakybucket.AddContext(ctx, bucket, 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// neither add was applied
+	state, err := bucket.Add(0)
+	require.NoError(t, err)
+	require.Equal(t, uint(10), state.Remaining)
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3)
+	s := New(c.leader(t).raft)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(3)
+	require.NoError(t, err)
+
+	for _, n := range c.nodes {
+		require.Eventually(t, func() bool {
+			n.fsm.mutex.Lock()
+			defer n.fsm.mutex.Unlock()
+			r := n.fsm.buckets["testbucket"]
+			return r != nil && r.Used == 3
+		}, 5*time.Second, 10*time.Millisecond, "bucket not replicated to %s", n.address)
+	}
+}
+
+func TestLeaderLoss(t *testing.T) {
+	c := newCluster(t, 3)
+	storages := c.storages()
+	leader := c.leader(t)
+	bucket, err := storages[leader.address].Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(6)
+	require.NoError(t, err)
+
+	require.NoError(t, leader.raft.Shutdown().Error())
+	var running []*node
+	for _, n := range c.nodes {
+		if n != leader {
+			running = append(running, n)
+		}
+	}
+	c.nodes = running
+
+	s := storages[c.leader(t).address]
+	bucket, err = s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint(4), bucket.Remaining())
+	_, err = bucket.Add(5)
+	require.Equal(t, leakybucket.ErrorFull, err)
+	state, err := bucket.Add(4)
+	require.NoError(t, err)
+	require.Equal(t, uint(0), state.Remaining)
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s := leaderStorage(t)
+	bucket, err := s.Create("short", 10, time.Millisecond)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+	_, err = s.Create("long", 10, time.Minute)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	deleted, err := s.DeleteExpired(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	// the drained bucket may now be created with another configuration
+	_, err = s.Create("short", 5, time.Second)
+	require.NoError(t, err)
+}
+
+type sink struct {
+	bytes.Buffer
+}
+
+func (s *sink) ID() string    { return "test" }
+func (s *sink) Cancel() error { return nil }
+func (s *sink) Close() error  { return nil }
+
+func TestSnapshotRestore(t *testing.T) {
+	fsm := NewFSM()
+	for _, c := range []string{
+		`{"op":"create","name":"a","capacity":10,"rate":60000000000,"now":1000}`,
+		`{"op":"add","name":"a","amount":4,"capacity":10,"rate":60000000000,"now":2000}`,
+		`{"op":"create","name":"b","capacity":5,"rate":1000000000,"now":3000}`,
+	} {
+		require.IsType(t, &result{}, fsm.Apply(&hraft.Log{Data: []byte(c)}))
+	}
+	snapshot, err := fsm.Snapshot()
+	require.NoError(t, err)
+	var out sink
+	require.NoError(t, snapshot.Persist(&out))
+
+	restored := NewFSM()
+	require.NoError(t, restored.Restore(io.NopCloser(&out)))
+	require.Equal(t, fsm.buckets, restored.buckets)
+	require.Equal(t, int64(3000), restored.clock)
+
+	// the restored state machine carries on from the snapshot's clock
+	res := restored.Apply(&hraft.Log{Data: []byte(`{"op":"add","name":"a","amount":6,"capacity":10,"rate":60000000000,"now":0}`)})
+	require.Equal(t, uint(0), res.(*result).Remaining)
+	require.Equal(t, int64(1000+time.Minute), res.(*result).Reset)
+}
@@ -1,4 +1,8 @@
 // Package redis provides a leaky bucket implementation backed by redis.
 //
+// Buckets are stored as hashes under the "leakybucket:v2:" prefix. Versions of this package before
+// v2 stored them as counters under their bare names, and the two don't share buckets: while a
+// rolling deploy runs both, each bucket may admit up to its capacity through each of them.
+//
 // Usage: TODO
 package redis
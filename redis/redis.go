@@ -1,17 +1,202 @@
 package redis
 
 import (
-	"github.com/Clever/leakybucket"
-	"github.com/garyburd/redigo/redis"
+	"context"
 	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// keyPrefix starts the keys of buckets. Before buckets were stored as hashes, they were stored
+// under their bare name as string counters. Those keys are left alone for the clients still using
+// them, so that they don't fail with WRONGTYPE errors during a rolling deploy.
+const keyPrefix = "leakybucket:v2:"
+
+// key returns the key of the bucket with the given name.
+func key(name string) string {
+	return keyPrefix + name
+}
+
+// Buckets are stored as hashes with the following fields, expiring when the bucket drains:
+//   - count: how much has been added to the bucket
+//   - capacity and rate: the configuration of the bucket, rate in milliseconds
+//   - reset: when the bucket drains, in milliseconds since the epoch
+//
+// All times are taken from the redis server's clock, so clients with skewed clocks still agree on
+// when buckets drain.
+//
+// The prelude below loads a bucket into the locals now, count, capacity, rate and reset, with
+// capacity, rate and reset nil if the bucket doesn't exist.
+const prelude = `
+if redis.replicate_commands then
+	redis.replicate_commands()
+end
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local stored = redis.call("HMGET", KEYS[1], "count", "capacity", "rate", "reset")
+local count = tonumber(stored[1]) or 0
+local capacity = stored[2]
+local rate = stored[3]
+local reset = tonumber(stored[4])
+`
+
+// Script statuses.
+const (
+	statusOK       = 0
+	statusFull     = 1
+	statusMismatch = 2
 )
 
+// configScript checks the configuration stored with a bucket against the requested one.
+//
+// KEYS[1]: bucket key
+// ARGV[1], ARGV[2]: requested capacity and rate
+//
+// Returns {status, count, reset, stored capacity, stored rate}.
+var configScript = redis.NewScript(1, prelude+`
+if not reset then
+	reset = now + tonumber(ARGV[2])
+end
+if capacity and (capacity ~= ARGV[1] or rate ~= ARGV[2]) then
+	return {2, count, reset, tonumber(capacity), tonumber(rate)}
+end
+return {0, count, reset, 0, 0}
+`)
+
+// limitsScript stores a new configuration with a bucket, carrying over its count and the start of
+// its window. Keep the carry over in sync with leakybucket.UsageMode.Carry.
+//
+// KEYS[1]: bucket key
+// ARGV[1], ARGV[2]: new capacity and rate
+// ARGV[3]: the leakybucket.UsageMode
+//
+// Returns {status, count, reset, 0, 0}.
+var limitsScript = redis.NewScript(1, prelude+`
+local newCapacity = tonumber(ARGV[1])
+local newRate = tonumber(ARGV[2])
+if not reset then
+	return {0, 0, now + newRate, 0, 0}
+end
+local oldCapacity = tonumber(capacity)
+local oldRate = tonumber(rate)
+if ARGV[3] == "1" then
+	if oldCapacity == 0 then
+		count = 0
+	else
+		count = math.floor((count * newCapacity + math.floor(oldCapacity / 2)) / oldCapacity)
+	end
+end
+count = math.min(count, newCapacity)
+reset = reset + newRate - oldRate
+if reset <= now then
+	redis.call("DEL", KEYS[1])
+	return {0, 0, now + newRate, 0, 0}
+end
+redis.call("HMSET", KEYS[1], "count", count, "capacity", ARGV[1], "rate", ARGV[2], "reset", reset)
+redis.call("PEXPIREAT", KEYS[1], reset)
+return {0, count, reset, 0, 0}
+`)
+
+// addScript atomically adds to a bucket if there is space for it, creating the bucket if needed.
+//
+// KEYS[1]: bucket key
+// ARGV[1]: amount to add
+// ARGV[2], ARGV[3]: capacity and rate of the bucket
+//
+// Returns {status, count, reset, stored capacity, stored rate}.
+var addScript = redis.NewScript(1, prelude+`
+if capacity and (capacity ~= ARGV[2] or rate ~= ARGV[3]) then
+	return {2, count, reset, tonumber(capacity), tonumber(rate)}
+end
+if not reset then
+	reset = now + tonumber(ARGV[3])
+end
+local amount = tonumber(ARGV[1])
+if count + amount > tonumber(ARGV[2]) then
+	return {1, count, reset, 0, 0}
+end
+count = redis.call("HINCRBY", KEYS[1], "count", amount)
+if not capacity then
+	redis.call("HMSET", KEYS[1], "capacity", ARGV[2], "rate", ARGV[3], "reset", reset)
+	redis.call("PEXPIREAT", KEYS[1], reset)
+end
+return {0, count, reset, 0, 0}
+`)
+
+// releaseScript removes from the count of a bucket, if it's still in the given window and
+// configured as given.
+//
+// KEYS[1]: bucket key
+// ARGV[1]: amount to release
+// ARGV[2]: reset of the window to release from
+// ARGV[3], ARGV[4]: capacity and rate of the bucket
+//
+// Returns {status, count, reset, 0, 0}.
+var releaseScript = redis.NewScript(1, prelude+`
+if not reset then
+	return {0, 0, now + tonumber(ARGV[4]), 0, 0}
+end
+if reset ~= tonumber(ARGV[2]) or (capacity and (capacity ~= ARGV[3] or rate ~= ARGV[4])) then
+	return {0, count, reset, 0, 0}
+end
+count = math.max(count - tonumber(ARGV[1]), 0)
+redis.call("HSET", KEYS[1], "count", count)
+return {0, count, reset, 0, 0}
+`)
+
+// scriptResult is the reply of the scripts above.
+type scriptResult struct {
+	status         int64
+	count          uint
+	reset          time.Time
+	capacity, rate int64
+}
+
+// runScript runs one of the scripts above, named name, in a span of its own.
+func runScript(ctx context.Context, tracer trace.Tracer, conn redis.Conn, name string, script *redis.Script, keysAndArgs ...interface{}) (scriptResult, error) {
+	_, span := tracer.Start(ctx, "EVALSHA", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "redis"),
+		attribute.String("db.operation", "EVALSHA"),
+		attribute.String("leakybucket.script", name),
+	))
+	defer span.End()
+	values, err := redis.Int64s(script.Do(conn, keysAndArgs...))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return scriptResult{}, err
+	}
+	return scriptResult{
+		status:   values[0],
+		count:    uint(values[1]),
+		reset:    time.Unix(0, values[2]*millisecond),
+		capacity: values[3],
+		rate:     values[4],
+	}, nil
+}
+
+func (r scriptResult) mismatch(name string, capacity uint, rate time.Duration) error {
+	return &leakybucket.ConfigMismatchError{
+		Name:              name,
+		Capacity:          uint(r.capacity),
+		Rate:              time.Duration(r.rate * millisecond),
+		RequestedCapacity: capacity,
+		RequestedRate:     rate,
+	}
+}
+
 type bucket struct {
 	name                string
 	capacity, remaining uint
 	reset               time.Time
 	rate                time.Duration
 	pool                *redis.Pool
+	tracer              trace.Tracer
 }
 
 func (b *bucket) Capacity() uint {
@@ -34,109 +219,156 @@ func (b *bucket) State() leakybucket.BucketState {
 
 var millisecond = int64(time.Millisecond)
 
-func (b *bucket) updateOldReset() error {
-	if b.reset.Unix() > time.Now().Unix() {
-		return nil
-	}
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
 
+// AddContext adds to the bucket, tracing the redis commands it runs as children of ctx's span.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
 	conn := b.pool.Get()
 	defer conn.Close()
 
-	ttl, err := conn.Do("PTTL", b.name)
+	// Go y u no have Milliseconds method? Why only Seconds and Nanoseconds?
+	expiry := b.rate.Nanoseconds() / millisecond
+
+	res, err := runScript(ctx, b.tracer, conn, "add", addScript, key(b.name), amount, b.capacity, expiry)
 	if err != nil {
-		return err
+		return b.State(), err
 	}
-	b.reset = time.Now().Add(time.Duration(ttl.(int64) * millisecond))
-	return nil
-}
 
-// Add to the bucket.
-func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
-	conn := b.pool.Get()
-	defer conn.Close()
-
-	if count, err := redis.Uint64(conn.Do("GET", b.name)); err != nil {
-		// handle the key not being set
-		if err == redis.ErrNil {
-			b.remaining = b.capacity
-		} else {
-			return b.State(), err
-		}
-	} else {
-		b.remaining = b.capacity - min(uint(count), b.capacity)
-	}
+	b.reset = res.reset
+	// Ensure we can't overflow
+	b.remaining = b.capacity - min(res.count, b.capacity)
 
-	if amount > b.remaining {
-		b.updateOldReset()
+	switch res.status {
+	case statusFull:
 		return b.State(), leakybucket.ErrorFull
+	case statusMismatch:
+		return b.State(), res.mismatch(b.name, b.capacity, b.rate)
 	}
+	return b.State(), nil
+}
 
-	// Go y u no have Milliseconds method? Why only Seconds and Nanoseconds?
-	expiry := int(b.rate.Nanoseconds() / millisecond)
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
 
-	count, err := redis.Uint64(conn.Do("INCRBY", b.name, amount))
+	res, err := runScript(context.Background(), b.tracer, conn, "release", releaseScript,
+		key(b.name), amount, reset.UnixNano()/millisecond, b.capacity, b.rate.Nanoseconds()/millisecond)
 	if err != nil {
 		return b.State(), err
-	} else if uint(count) == amount {
-		if _, err := conn.Do("PEXPIRE", b.name, expiry); err != nil {
-			return b.State(), err
-		}
 	}
-
-	b.updateOldReset()
-
-	// Ensure we can't overflow
-	b.remaining = b.capacity - min(uint(count), b.capacity)
+	b.reset = res.reset
+	b.remaining = b.capacity - min(res.count, b.capacity)
 	return b.State(), nil
 }
 
 // Storage is a redis-based, non thread-safe leaky bucket factory.
 type Storage struct {
-	pool *redis.Pool
+	pool        *redis.Pool
+	reconfigure bool
+	usage       leakybucket.UsageMode
+	tracer      trace.Tracer
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithReconfigure makes Create store the requested capacity and rate with a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
+}
+
+// WithTracerProvider traces every redis command run by the storage and its buckets. Commands are
+// children of the spans of the contexts passed to CreateContext and AddContext. By default nothing
+// is traced.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(s *Storage) {
+		s.tracer = tp.Tracer("github.com/Clever/leakybucket/v2/redis")
+	}
 }
 
 // Create a bucket.
 func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket, tracing the redis commands it runs as children of ctx's span.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
 	conn := s.pool.Get()
 	defer conn.Close()
 
-	if count, err := redis.Uint64(conn.Do("GET", name)); err != nil {
-		if err != redis.ErrNil {
-			return nil, err
-		}
-		// return a standard bucket if key was not found
-		return &bucket{
-			name:      name,
-			capacity:  capacity,
-			remaining: capacity,
-			reset:     time.Now().Add(rate),
-			rate:      rate,
-			pool:      s.pool,
-		}, nil
-	} else if ttl, err := redis.Int64(conn.Do("PTTL", name)); err != nil {
+	res, err := runScript(ctx, s.tracer, conn, "config", configScript, key(name), capacity, rate.Nanoseconds()/millisecond)
+	if err != nil {
 		return nil, err
-	} else {
-		b := &bucket{
-			name:      name,
-			capacity:  capacity,
-			remaining: capacity - min(capacity, uint(count)),
-			reset:     time.Now().Add(time.Duration(ttl * millisecond)),
-			rate:      rate,
-			pool:      s.pool,
+	} else if res.status == statusMismatch {
+		if !s.reconfigure {
+			return nil, res.mismatch(name, capacity, rate)
 		}
-		return b, nil
+		if res, err = s.updateLimits(ctx, conn, name, capacity, rate); err != nil {
+			return nil, err
+		}
+	}
+	b := &bucket{
+		name:      name,
+		capacity:  capacity,
+		remaining: capacity - min(capacity, res.count),
+		reset:     res.reset,
+		rate:      rate,
+		pool:      s.pool,
+		tracer:    s.tracer,
 	}
+	return b, nil
+}
+
+func (s *Storage) updateLimits(ctx context.Context, conn redis.Conn, name string, capacity uint, rate time.Duration) (scriptResult, error) {
+	return runScript(ctx, s.tracer, conn, "limits", limitsScript, key(name), capacity, rate.Nanoseconds()/millisecond, int(s.usage))
+}
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	res, err := s.updateLimits(context.Background(), conn, name, capacity, rate)
+	if err != nil {
+		return leakybucket.BucketState{}, err
+	}
+	return leakybucket.BucketState{
+		Capacity:  capacity,
+		Remaining: capacity - min(capacity, res.count),
+		Reset:     res.reset,
+	}, nil
 }
 
 // New initializes the connection to redis.
-func New(network, address string) (*Storage, error) {
+func New(network, address string, opts ...Option) (*Storage, error) {
 	// If we find we need to change this timeout per application, we may want to expose
 	// this as an extra config option
 	timeout := time.Duration(5000 * millisecond) // 5 seconds
 	s := &Storage{
 		pool: redis.NewPool(func() (redis.Conn, error) {
 			return redis.Dial(network, address, redis.DialReadTimeout(timeout), redis.DialWriteTimeout(timeout))
-		}, 5)}
+		}, 5),
+		tracer: noop.NewTracerProvider().Tracer(""),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
 	// When using a connection pool, you only get connection errors while trying to send commands.
 	// Try to PING so we can fail-fast in the case of invalid address.
 	conn := s.pool.Get()
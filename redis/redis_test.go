@@ -1,17 +1,21 @@
 package redis
 
 import (
+	"context"
 	"os"
 	"sync"
 	"testing"
 	"time"
 
-	"github.com/Clever/leakybucket"
-	"github.com/Clever/leakybucket/test"
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/garyburd/redigo/redis"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-func getLocalStorage() *Storage {
-	storage, err := New("tcp", os.Getenv("REDIS_URL"))
+func getLocalStorage(opts ...Option) *Storage {
+	storage, err := New("tcp", os.Getenv("REDIS_URL"), opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -46,10 +50,6 @@ func TestAdd(t *testing.T) {
 }
 
 func TestThreadSafeAdd(t *testing.T) {
-	// Redis Add is not thread safe. If you run this, the test should fail because it never received
-	// ErrorFull. It's not thread safe because we don't atomically check the state of the bucket and
-	// increment.
-	t.Skip()
 	flushDb()
 	test.ThreadSafeAddTest(getLocalStorage())(t)
 }
@@ -69,6 +69,87 @@ func TestBucketInstanceConsistencyTest(t *testing.T) {
 	test.BucketInstanceConsistencyTest(getLocalStorage())(t)
 }
 
+func TestConfigMismatch(t *testing.T) {
+	flushDb()
+	test.ConfigMismatchTest(getLocalStorage())(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	flushDb()
+	test.ReconfigureTest(getLocalStorage(WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	flushDb()
+	test.UpdateLimitsTest(getLocalStorage())(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	flushDb()
+	test.UpdateLimitsProportionalTest(getLocalStorage(WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	flushDb()
+	test.ReleaseTest(getLocalStorage())(t)
+}
+
+// The redis backend only ever uses the redis server's clock, so local clocks can't skew and it is
+// exempt from test.ClockSkewTest. Make sure buckets reset according to the server's clock instead.
+func TestServerClock(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	conn := s.pool.Get()
+	defer conn.Close()
+	serverTime := func() time.Time {
+		reply, err := redis.Int64s(conn.Do("TIME"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Unix(reply[0], reply[1]*int64(time.Microsecond))
+	}
+
+	before := serverTime().Truncate(time.Millisecond)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := serverTime()
+	if reset := bucket.Reset(); reset.Before(before.Add(time.Minute)) || reset.After(after.Add(time.Minute)) {
+		t.Fatalf("expected reset a minute after the server's time, between %s and %s, got %s",
+			before.Add(time.Minute), after.Add(time.Minute), reset)
+	}
+}
+
+// Buckets used to be stored as plain counters under their bare name. Make sure clients of that
+// version can keep using them alongside the current one.
+func TestLegacyKey(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "testbucket", 3, "PX", 60000); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := bucket.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 9 {
+		t.Fatalf("expected 9 remaining, got %d", state.Remaining)
+	}
+	if count, err := redis.Int64(conn.Do("INCRBY", "testbucket", 1)); err != nil {
+		t.Fatal(err)
+	} else if count != 4 {
+		t.Fatalf("expected the legacy counter to be left alone, got %d", count)
+	}
+}
+
 // One implementation of redis leaky bucket had a bug where very fast access could result in us
 // creating buckets without a TTL on them. This test was reliably able to reproduce this bug.
 func TestFastAccess(t *testing.T) {
@@ -105,12 +186,12 @@ func TestFastAccess(t *testing.T) {
 	conn := s.pool.Get()
 	defer conn.Close()
 
-	if exists, err := conn.Do("GET", "testbucket"); err != nil {
+	if exists, err := redis.Bool(conn.Do("EXISTS", key("testbucket"))); err != nil {
 		t.Fatal(err)
-	} else if exists == nil {
+	} else if !exists {
 		return
 	}
-	ttl, err := conn.Do("PTTL", "testbucket")
+	ttl, err := conn.Do("PTTL", key("testbucket"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,3 +199,36 @@ func TestFastAccess(t *testing.T) {
 		t.Fatal("no ttl set on bucket")
 	}
 }
+
+func TestTracing(t *testing.T) {
+	flushDb()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	storage := getLocalStorage(WithTracerProvider(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	bucket, err := storage.CreateContext(ctx, "testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leakybucket.AddContext(ctx, bucket, 1); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+	for i, script := range []string{"config", "add"} {
+		span := spans[i]
+		if span.Name() != "EVALSHA" || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("expected an EVALSHA child span, got %s", span.Name())
+		}
+		for _, kv := range span.Attributes() {
+			if kv.Key == "leakybucket.script" && kv.Value.AsString() != script {
+				t.Fatalf("expected the %s script, got %s", script, kv.Value.AsString())
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package slog provides a leakybucket.Storage decorator logging the decisions of its buckets with
+// log/slog, e.g. to reconstruct why a client was rate limited.
+//
+// Every rejected Add is logged at slog.LevelInfo and every failed Create or Add at
+// slog.LevelError. Allowed adds are logged at slog.LevelDebug, but only a sample of them, none by
+// default. Each record has the bucket's name, the amount added, the state of the bucket and the
+// storage's error, if any.
+//
+// Usage:
+//
+//	storage := leakybucketSlog.New(redisStorage, slog.Default(),
+//		leakybucketSlog.WithAdmissionSampling(0.01),
+//		leakybucketSlog.WithRedaction(leakybucketSlog.HashNames))
+package slog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+// RedactFunc returns what to log in place of a bucket's name, e.g. to keep API keys out of logs.
+type RedactFunc func(name string) string
+
+// HashNames redacts bucket names by replacing them with the first 16 hex digits of their SHA-256
+// hash, so that records about the same bucket can still be correlated.
+func HashNames(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Logger logs the decisions of buckets through its Middleware.
+type Logger struct {
+	logger    *slog.Logger
+	admitted  float64
+	rejected  float64
+	redact    RedactFunc
+	levels    levels
+	randFloat func() float64
+}
+
+// Storage wraps a leakybucket.Storage, logging the decisions of its buckets.
+type Storage struct {
+	leakybucket.ChainedStorage
+	*Logger
+}
+
+type levels struct {
+	admitted, rejected, failed slog.Level
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Logger)
+
+// WithAdmissionSampling sets the fraction of allowed adds that are logged, between 0 and 1. The
+// default is 0.
+func WithAdmissionSampling(rate float64) Option {
+	return func(l *Logger) {
+		l.admitted = rate
+	}
+}
+
+// WithRejectionSampling sets the fraction of rejected adds that are logged, between 0 and 1. The
+// default is 1, logging every rejection.
+func WithRejectionSampling(rate float64) Option {
+	return func(l *Logger) {
+		l.rejected = rate
+	}
+}
+
+// WithRedaction sets what is logged in place of bucket names. By default names are logged as is.
+func WithRedaction(redact RedactFunc) Option {
+	return func(l *Logger) {
+		l.redact = redact
+	}
+}
+
+// WithLevels sets the levels allowed adds, rejected adds and failures are logged at. The defaults
+// are slog.LevelDebug, slog.LevelInfo and slog.LevelError.
+func WithLevels(admitted, rejected, failed slog.Level) Option {
+	return func(l *Logger) {
+		l.levels = levels{admitted, rejected, failed}
+	}
+}
+
+// New wraps a storage, logging the decisions of its buckets to logger.
+func New(storage leakybucket.Storage, logger *slog.Logger, opts ...Option) *Storage {
+	l := NewLogger(logger, opts...)
+	return &Storage{
+		ChainedStorage: leakybucket.Chain(storage, l.Middleware()),
+		Logger:         l,
+	}
+}
+
+// NewLogger creates the Logger used by New, to log the decisions of a storage of one's own making
+// with Middleware and leakybucket.Chain.
+func NewLogger(logger *slog.Logger, opts ...Option) *Logger {
+	l := &Logger{
+		logger:    logger,
+		rejected:  1,
+		redact:    func(name string) string { return name },
+		levels:    levels{slog.LevelDebug, slog.LevelInfo, slog.LevelError},
+		randFloat: rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// errorAttr returns the attribute logging err, with the bucket name of configuration mismatches
+// redacted.
+func (l *Logger) errorAttr(err error) slog.Attr {
+	var mismatch *leakybucket.ConfigMismatchError
+	if errors.As(err, &mismatch) {
+		redacted := *mismatch
+		redacted.Name = l.redact(mismatch.Name)
+		return slog.Any("error", &redacted)
+	}
+	return slog.Any("error", err)
+}
+
+// sampled reports whether to log a record sampled at rate.
+func (l *Logger) sampled(rate float64) bool {
+	return rate >= 1 || (rate > 0 && l.randFloat() < rate)
+}
+
+func (l *Logger) failed(ctx context.Context, msg string, spec leakybucket.BucketSpec, err error) {
+	l.logger.LogAttrs(ctx, l.levels.failed, msg,
+		slog.String("bucket", l.redact(spec.Name)),
+		slog.Uint64("capacity", uint64(spec.Capacity)),
+		slog.Duration("rate", spec.Rate),
+		l.errorAttr(err),
+	)
+}
+
+// Middleware logs the decisions of a storage's buckets, and failures of the storage.
+func (l *Logger) Middleware() leakybucket.Middleware {
+	return leakybucket.Middleware{
+		Create: func(next leakybucket.CreateFunc) leakybucket.CreateFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.Bucket, error) {
+				b, err := next(ctx, spec)
+				if err != nil {
+					l.failed(ctx, "leakybucket create failed", spec, err)
+				}
+				return b, err
+			}
+		},
+		Add: func(next leakybucket.AddFunc) leakybucket.AddFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec, amount uint) (leakybucket.BucketState, error) {
+				state, err := next(ctx, spec, amount)
+				l.add(ctx, spec, amount, state, err)
+				return state, err
+			}
+		},
+		UpdateLimits: func(next leakybucket.UpdateLimitsFunc) leakybucket.UpdateLimitsFunc {
+			return func(ctx context.Context, spec leakybucket.BucketSpec) (leakybucket.BucketState, error) {
+				state, err := next(ctx, spec)
+				if err != nil {
+					l.failed(ctx, "leakybucket update limits failed", spec, err)
+				}
+				return state, err
+			}
+		},
+	}
+}
+
+// add logs the decision of an add, if it's sampled.
+func (l *Logger) add(ctx context.Context, spec leakybucket.BucketSpec, amount uint, state leakybucket.BucketState, err error) {
+	level, msg := l.levels.admitted, "leakybucket add allowed"
+	switch {
+	case err == nil:
+		if !l.sampled(l.admitted) {
+			return
+		}
+	case errors.Is(err, leakybucket.ErrorFull):
+		if !l.sampled(l.rejected) {
+			return
+		}
+		level, msg = l.levels.rejected, "leakybucket add rejected"
+	default:
+		level, msg = l.levels.failed, "leakybucket add failed"
+	}
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("bucket", l.redact(spec.Name)),
+		slog.Uint64("amount", uint64(amount)),
+		slog.Group("state",
+			slog.Uint64("capacity", uint64(state.Capacity)),
+			slog.Uint64("remaining", uint64(state.Remaining)),
+			slog.Time("reset", state.Reset),
+		),
+	}
+	if err != nil && !errors.Is(err, leakybucket.ErrorFull) {
+		attrs = append(attrs, l.errorAttr(err))
+	}
+	l.logger.LogAttrs(ctx, level, msg, attrs...)
+}
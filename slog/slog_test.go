@@ -0,0 +1,127 @@
+package slog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+	"github.com/Clever/leakybucket/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func newLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(New(memory.New(), slog.Default()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(New(memory.New(), slog.Default()))(t)
+}
+
+func TestRejections(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(memory.New(), newLogger(&buf))
+	bucket, err := s.Create("api:key", 2, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(2)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.Equal(t, leakybucket.ErrorFull, err)
+
+	logged := records(t, &buf)
+	require.Len(t, logged, 1)
+	require.Equal(t, "INFO", logged[0]["level"])
+	require.Equal(t, "leakybucket add rejected", logged[0]["msg"])
+	require.Equal(t, "api:key", logged[0]["bucket"])
+	require.Equal(t, 1.0, logged[0]["amount"])
+	state := logged[0]["state"].(map[string]interface{})
+	require.Equal(t, 2.0, state["capacity"])
+	require.Equal(t, 0.0, state["remaining"])
+	require.NotEmpty(t, state["reset"])
+	require.NotContains(t, logged[0], "error")
+}
+
+func TestSampling(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(memory.New(), newLogger(&buf), WithAdmissionSampling(0.5), WithRejectionSampling(0.5))
+	samples := []float64{0.2, 0.7, 0.9, 0.1}
+	s.randFloat = func() float64 {
+		sample := samples[0]
+		samples = samples[1:]
+		return sample
+	}
+	bucket, err := s.Create("bucket", 2, time.Minute)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		bucket.Add(1)
+	}
+
+	logged := records(t, &buf)
+	require.Len(t, logged, 2)
+	require.Equal(t, "DEBUG", logged[0]["level"])
+	require.Equal(t, "leakybucket add allowed", logged[0]["msg"])
+	require.Equal(t, "leakybucket add rejected", logged[1]["msg"])
+}
+
+// failing is a storage whose buckets fail to add.
+type failing struct {
+	leakybucket.Storage
+}
+
+type failingBucket struct {
+	leakybucket.Bucket
+}
+
+func (f failing) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, err := f.Storage.Create(name, capacity, rate)
+	return failingBucket{b}, err
+}
+
+func (failingBucket) Add(uint) (leakybucket.BucketState, error) {
+	return leakybucket.BucketState{}, errors.New("connection refused")
+}
+
+func TestFailuresAndRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(failing{memory.New()}, newLogger(&buf), WithRedaction(HashNames), WithRejectionSampling(0))
+	bucket, err := s.Create("api:secret", 1, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.Error(t, err)
+
+	s = New(memory.New(), newLogger(&buf), WithRedaction(HashNames))
+	_, err = s.Create("api:secret", 1, time.Minute)
+	require.NoError(t, err)
+	_, err = s.Create("api:secret", 2, time.Minute)
+	require.True(t, errors.Is(err, leakybucket.ErrConfigMismatch))
+
+	require.NotContains(t, buf.String(), "secret")
+	logged := records(t, &buf)
+	require.Len(t, logged, 2)
+	require.Equal(t, "ERROR", logged[0]["level"])
+	require.Equal(t, "connection refused", logged[0]["error"])
+	require.Equal(t, HashNames("api:secret"), logged[0]["bucket"])
+	require.Len(t, logged[0]["bucket"], 16)
+	require.Equal(t, "leakybucket create failed", logged[1]["msg"])
+	require.Contains(t, logged[1]["error"], HashNames("api:secret"))
+}
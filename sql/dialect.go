@@ -0,0 +1,105 @@
+package sql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Dialect adapts the statements of a Storage to a database.
+type Dialect struct {
+	name        string
+	placeholder func(n int) string
+}
+
+var (
+	// Postgres is the dialect of PostgreSQL, 9.5 or later.
+	Postgres = Dialect{name: "postgres", placeholder: func(n int) string { return fmt.Sprintf("$%d", n) }}
+	// SQLite is the dialect of SQLite, 3.35 or later.
+	SQLite = Dialect{name: "sqlite", placeholder: func(n int) string { return fmt.Sprintf("?%d", n) }}
+)
+
+func (d Dialect) String() string {
+	return d.name
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var placeholders = regexp.MustCompile(`\$(\d+)`)
+
+// statement fills in the table and the placeholders, written $1, $2, ..., of a statement.
+func (d Dialect) statement(table, query string) string {
+	query = strings.ReplaceAll(query, "{table}", table)
+	return placeholders.ReplaceAllStringFunc(query, func(p string) string {
+		var n int
+		fmt.Sscanf(p, "$%d", &n)
+		return d.placeholder(n)
+	})
+}
+
+// Buckets are stored in a table with a row per bucket:
+//   - name: the name of the bucket
+//   - used: how much has been added to the bucket in its current window
+//   - capacity and rate_ns: the configuration of the bucket, rate in nanoseconds
+//   - reset_ns: when the bucket drains, in nanoseconds since the epoch
+//
+// migrations are the statements creating and updating the table, in order. Every migration is
+// applied once: append migrations rather than editing them.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS {table} (
+	name TEXT PRIMARY KEY,
+	used BIGINT NOT NULL,
+	capacity BIGINT NOT NULL,
+	rate_ns BIGINT NOT NULL,
+	reset_ns BIGINT NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS {table}_reset_ns ON {table} (reset_ns)`,
+}
+
+// Migrations returns the statements creating and updating the table of buckets, in order, for
+// applying them with a migration tool of one's own rather than Storage.Migrate.
+func Migrations(dialect Dialect, table string) []string {
+	statements := make([]string, len(migrations))
+	for i, m := range migrations {
+		statements[i] = dialect.statement(table, m)
+	}
+	return statements
+}
+
+// addStatement adds to a bucket if there is space for it, creating the bucket or starting a new
+// window if needed, and returns the bucket's used space and reset. It returns no row if the bucket
+// is full or configured otherwise.
+//
+// $1: name, $2: amount, $3: capacity, $4: rate, $5: when drained windows end by, $6: now + rate
+const addStatement = `INSERT INTO {table} (name, used, capacity, rate_ns, reset_ns) VALUES ($1, $2, $3, $4, $6)
+ON CONFLICT (name) DO UPDATE SET
+	used = CASE WHEN {table}.reset_ns < $5 THEN excluded.used ELSE {table}.used + excluded.used END,
+	reset_ns = CASE WHEN {table}.reset_ns < $5 THEN excluded.reset_ns ELSE {table}.reset_ns END
+WHERE {table}.capacity = excluded.capacity AND {table}.rate_ns = excluded.rate_ns
+	AND ({table}.reset_ns < $5 OR {table}.used + excluded.used <= {table}.capacity)
+RETURNING used, reset_ns`
+
+// selectStatement reads a bucket.
+//
+// $1: name
+const selectStatement = `SELECT used, capacity, rate_ns, reset_ns FROM {table} WHERE name = $1`
+
+// updateStatement overwrites a bucket iff nobody else has changed it since it was read.
+//
+// $1: name, $2, $3, $4, $5: new used, capacity, rate and reset, $6, $7, $8, $9: the ones read
+const updateStatement = `UPDATE {table} SET used = $2, capacity = $3, rate_ns = $4, reset_ns = $5
+WHERE name = $1 AND used = $6 AND capacity = $7 AND rate_ns = $8 AND reset_ns = $9`
+
+// releaseStatement removes from the used space of a bucket, if it's still in the given window and
+// configured as given, and returns the bucket's used space and reset. It returns no row otherwise.
+//
+// $1: name, $2: amount, $3: capacity, $4: rate, $5: reset of the window, $6: when drained
+// windows end by
+const releaseStatement = `UPDATE {table} SET used = CASE WHEN used > $2 THEN used - $2 ELSE 0 END
+WHERE name = $1 AND capacity = $3 AND rate_ns = $4 AND reset_ns = $5 AND reset_ns >= $6
+RETURNING used, reset_ns`
+
+// deleteExpiredStatement deletes the buckets that have drained.
+//
+// $1: when drained windows end by
+const deleteExpiredStatement = `DELETE FROM {table} WHERE reset_ns < $1`
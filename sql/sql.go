@@ -0,0 +1,429 @@
+/*
+Package sql provides a leaky bucket implementation backed by a SQL database through database/sql,
+with dialects for PostgreSQL and SQLite.
+
+Buckets are rows of a table, created by Storage.Migrate or by the statements of Migrations. Adds
+are single atomic upserts, so processes sharing the database share buckets. Windows are started
+and expired by the clock of the processes, as with the dynamodb package, rather than the
+database's.
+
+With SQLite, give the database a busy timeout, or a single connection with db.SetMaxOpenConns(1),
+so that concurrent adds wait for each other rather than fail with SQLITE_BUSY.
+*/
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+)
+
+var (
+	_ leakybucket.ContextStorage = &Storage{}
+	_ leakybucket.LimitUpdater   = &Storage{}
+	_ leakybucket.ContextBucket  = &bucket{}
+	_ leakybucket.Releaser       = &bucket{}
+)
+
+type bucket struct {
+	name                string
+	capacity, remaining uint
+	reset               time.Time
+	rate                time.Duration
+	storage             *Storage
+	mutex               sync.Mutex
+}
+
+// Capacity of the bucket.
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+func (b *bucket) state() leakybucket.BucketState {
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// update sets the local state of the bucket from a row.
+func (b *bucket) update(used uint, reset time.Time) leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining = b.capacity - min(used, b.capacity)
+	b.reset = reset
+	return b.state()
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// AddContext adds to the bucket, running its statements with ctx.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	res, err := b.storage.add(ctx, b.name, amount, b.capacity, b.rate)
+	if err != nil {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.state(), err
+	}
+	state := b.update(res.used, res.reset)
+	switch res.status {
+	case statusFull:
+		return state, leakybucket.ErrorFull
+	case statusMismatch:
+		return state, res.mismatch(b.name, b.capacity, b.rate)
+	}
+	return state, nil
+}
+
+// Release space added to the bucket in the window ending at reset.
+func (b *bucket) Release(amount uint, reset time.Time) (leakybucket.BucketState, error) {
+	s := b.storage
+	var used, resetNs int64
+	err := s.db.QueryRowContext(context.Background(), s.statements.release,
+		b.name, int64(amount), int64(b.capacity), b.rate.Nanoseconds(), reset.UnixNano(), s.drained(s.now()).UnixNano(),
+	).Scan(&used, &resetNs)
+	if err == sql.ErrNoRows {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.state(), nil
+	} else if err != nil {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.state(), err
+	}
+	return b.update(uint(used), time.Unix(0, resetNs)), nil
+}
+
+// Storage is a SQL-based, thread-safe leaky bucket factory.
+type Storage struct {
+	db          *sql.DB
+	dialect     Dialect
+	table       string
+	statements  statements
+	reconfigure bool
+	usage       leakybucket.UsageMode
+	clock       func() time.Time
+	skew        time.Duration
+}
+
+// statements are the statements of a Storage, in its dialect.
+type statements struct {
+	add, get, update, release, deleteExpired string
+}
+
+// Option configures optional behavior of a Storage.
+type Option func(*Storage)
+
+// WithTable sets the name of the table of buckets. The default is "leakybucket".
+func WithTable(name string) Option {
+	return func(s *Storage) {
+		s.table = name
+	}
+}
+
+// WithReconfigure makes Create store the requested capacity and rate with a bucket that already
+// exists with a different configuration, as UpdateLimits does, instead of returning
+// leakybucket.ErrConfigMismatch.
+func WithReconfigure() Option {
+	return func(s *Storage) {
+		s.reconfigure = true
+	}
+}
+
+// WithUsageMode sets how UpdateLimits carries the space used in a bucket over to its new capacity.
+// The default is leakybucket.UsageAbsolute.
+func WithUsageMode(mode leakybucket.UsageMode) Option {
+	return func(s *Storage) {
+		s.usage = mode
+	}
+}
+
+// WithClock sets the time source used to start and expire bucket windows. The default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(s *Storage) {
+		s.clock = now
+	}
+}
+
+// WithSkewTolerance makes buckets drain d later than the time stored with them, so that a client
+// whose clock runs ahead of the others' by up to d doesn't drain buckets early. Buckets whose
+// window was started by such a client may drain up to d late for everyone else.
+func WithSkewTolerance(d time.Duration) Option {
+	return func(s *Storage) {
+		s.skew = d
+	}
+}
+
+// New initializes a bucket storage backed by a database in the given dialect. Call Migrate, or
+// apply the statements of Migrations, to create the table of buckets.
+func New(db *sql.DB, dialect Dialect, opts ...Option) (*Storage, error) {
+	s := &Storage{
+		db:      db,
+		dialect: dialect,
+		table:   "leakybucket",
+		clock:   time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if !identifier.MatchString(s.table) {
+		return nil, fmt.Errorf("invalid table name %q", s.table)
+	}
+	s.statements = statements{
+		add:           dialect.statement(s.table, addStatement),
+		get:           dialect.statement(s.table, selectStatement),
+		update:        dialect.statement(s.table, updateStatement),
+		release:       dialect.statement(s.table, releaseStatement),
+		deleteExpired: dialect.statement(s.table, deleteExpiredStatement),
+	}
+	return s, nil
+}
+
+func (s *Storage) now() time.Time {
+	return s.clock()
+}
+
+// drained returns the time before which windows must have ended for buckets to have drained,
+// giving other clients' clocks the benefit of the doubt up to the skew tolerance.
+func (s *Storage) drained(now time.Time) time.Time {
+	return now.Add(-s.skew)
+}
+
+// Migrate creates or updates the table of buckets, recording the migrations applied in a table
+// named after it with a _migrations suffix. Run it from one process at a time, e.g. on deploy.
+func (s *Storage) Migrate(ctx context.Context) error {
+	versions := s.table + "_migrations"
+	if _, err := s.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versions+" (version BIGINT PRIMARY KEY)"); err != nil {
+		return err
+	}
+	var applied int
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+versions).Scan(&applied); err != nil {
+		return err
+	}
+	for version, statement := range Migrations(s.dialect, s.table) {
+		if version < applied {
+			continue
+		}
+		err := s.transaction(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, s.dialect.statement(versions, "INSERT INTO {table} (version) VALUES ($1)"), version+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("applying migration %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) transaction(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteExpired deletes the buckets that have drained, which don't otherwise go away, and returns
+// how many it deleted.
+func (s *Storage) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, s.statements.deleteExpired, s.drained(s.now()).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Statuses of adds.
+const (
+	statusOK = iota
+	statusFull
+	statusMismatch
+)
+
+// addResult is the outcome of an add, with the state of the bucket after it.
+type addResult struct {
+	status         int
+	used           uint
+	reset          time.Time
+	capacity, rate int64
+}
+
+func (r addResult) mismatch(name string, capacity uint, rate time.Duration) error {
+	return &leakybucket.ConfigMismatchError{
+		Name:              name,
+		Capacity:          uint(r.capacity),
+		Rate:              time.Duration(r.rate),
+		RequestedCapacity: capacity,
+		RequestedRate:     rate,
+	}
+}
+
+// add atomically adds to a bucket if there is space for it, creating the bucket if needed.
+func (s *Storage) add(ctx context.Context, name string, amount, capacity uint, rate time.Duration) (addResult, error) {
+	now := s.now()
+	if amount > capacity {
+		// never fits, but the bucket must exist all the same
+		res, err := s.add(ctx, name, 0, capacity, rate)
+		if err == nil && res.status == statusOK {
+			res.status = statusFull
+		}
+		return res, err
+	}
+	var used, reset int64
+	err := s.db.QueryRowContext(ctx, s.statements.add,
+		name, int64(amount), int64(capacity), rate.Nanoseconds(), s.drained(now).UnixNano(), now.Add(rate).UnixNano(),
+	).Scan(&used, &reset)
+	if err == nil {
+		return addResult{status: statusOK, used: uint(used), reset: time.Unix(0, reset)}, nil
+	} else if err != sql.ErrNoRows {
+		return addResult{}, err
+	}
+
+	// the bucket is full, or configured otherwise
+	row, err := s.get(ctx, name)
+	if err != nil {
+		return addResult{}, err
+	} else if row == nil {
+		// deleted in the meantime
+		return s.add(ctx, name, amount, capacity, rate)
+	}
+	res := addResult{status: statusFull, used: row.used, reset: row.reset}
+	if row.capacity != capacity || row.rate != rate {
+		res.status = statusMismatch
+		res.capacity, res.rate = int64(row.capacity), int64(row.rate)
+	}
+	return res, nil
+}
+
+// bucketRow is a row of the table of buckets.
+type bucketRow struct {
+	used, capacity uint
+	rate           time.Duration
+	reset          time.Time
+}
+
+// get reads a bucket, returning nil if it doesn't exist.
+func (s *Storage) get(ctx context.Context, name string) (*bucketRow, error) {
+	var used, capacity, rate, reset int64
+	err := s.db.QueryRowContext(ctx, s.statements.get, name).Scan(&used, &capacity, &rate, &reset)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &bucketRow{
+		used:     uint(used),
+		capacity: uint(capacity),
+		rate:     time.Duration(rate),
+		reset:    time.Unix(0, reset),
+	}, nil
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return s.CreateContext(context.Background(), name, capacity, rate)
+}
+
+// CreateContext creates a bucket, running its statements with ctx.
+func (s *Storage) CreateContext(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	// adding 0 creates the bucket, or starts a new window if it has drained
+	res, err := s.add(ctx, name, 0, capacity, rate)
+	if err != nil {
+		return nil, err
+	} else if res.status == statusMismatch {
+		if !s.reconfigure {
+			return nil, res.mismatch(name, capacity, rate)
+		}
+		state, err := s.updateLimits(ctx, name, capacity, rate)
+		if err != nil {
+			return nil, err
+		}
+		res.used, res.reset = capacity-state.Remaining, state.Reset
+	}
+	return &bucket{
+		name:      name,
+		capacity:  capacity,
+		remaining: capacity - min(res.used, capacity),
+		reset:     res.reset,
+		rate:      rate,
+		storage:   s,
+	}, nil
+}
+
+// maxUpdateAttempts bounds how many times updateLimits tries again when the bucket changes
+// between reading and writing it.
+const maxUpdateAttempts = 10
+
+// errBucketConflict is returned when a bucket keeps changing while updating its limits.
+var errBucketConflict = errors.New("bucket changed concurrently")
+
+// updateLimits stores a new configuration with a bucket, carrying over its used space and the
+// start of its window.
+func (s *Storage) updateLimits(ctx context.Context, name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	for attempt := 1; attempt <= maxUpdateAttempts; attempt++ {
+		now := s.now()
+		row, err := s.get(ctx, name)
+		if err != nil {
+			return leakybucket.BucketState{}, err
+		} else if row == nil {
+			return leakybucket.BucketState{Capacity: capacity, Remaining: capacity, Reset: now.Add(rate)}, nil
+		}
+
+		var used uint
+		reset := row.reset
+		if !s.drained(now).After(reset) {
+			used = s.usage.Carry(row.used, row.capacity, capacity)
+			// the window keeps its start
+			reset = reset.Add(rate - row.rate)
+		}
+		if s.drained(now).After(reset) {
+			// the bucket drained under the new rate
+			used = 0
+			reset = now.Add(rate)
+		}
+
+		res, err := s.db.ExecContext(ctx, s.statements.update, name,
+			int64(used), int64(capacity), rate.Nanoseconds(), reset.UnixNano(),
+			int64(row.used), int64(row.capacity), row.rate.Nanoseconds(), row.reset.UnixNano())
+		if err != nil {
+			return leakybucket.BucketState{}, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return leakybucket.BucketState{}, err
+		} else if n == 1 {
+			return leakybucket.BucketState{Capacity: capacity, Remaining: capacity - used, Reset: reset}, nil
+		}
+	}
+	return leakybucket.BucketState{}, errBucketConflict
+}
+
+// UpdateLimits changes the capacity and rate of a bucket.
+func (s *Storage) UpdateLimits(name string, capacity uint, rate time.Duration) (leakybucket.BucketState, error) {
+	return s.updateLimits(context.Background(), name, capacity, rate)
+}
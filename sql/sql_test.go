@@ -0,0 +1,216 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/test"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "leakybucket.db"))
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testStorage(t *testing.T, opts ...Option) *Storage {
+	s, err := New(testDB(t), SQLite, opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.Migrate(context.Background()))
+	return s
+}
+
+// postgresDB opens the PostgreSQL database at POSTGRES_URL, skipping the test if it isn't set, and
+// drops the tables of the test's buckets before and after the test.
+func postgresDB(t *testing.T) *sql.DB {
+	url, ok := os.LookupEnv("POSTGRES_URL")
+	if !ok {
+		t.Skip("POSTGRES_URL not set")
+	}
+	db, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	drop := func() {
+		_, err := db.Exec("DROP TABLE IF EXISTS leakybucket_test, leakybucket_test_migrations")
+		require.NoError(t, err)
+	}
+	drop()
+	t.Cleanup(func() {
+		drop()
+		db.Close()
+	})
+	return db
+}
+
+func postgresStorage(t *testing.T, db *sql.DB, opts ...Option) *Storage {
+	s, err := New(db, Postgres, append([]Option{WithTable("leakybucket_test")}, opts...)...)
+	require.NoError(t, err)
+	require.NoError(t, s.Migrate(context.Background()))
+	return s
+}
+
+// TestPostgres runs the tests every storage must pass against PostgreSQL, when POSTGRES_URL is set.
+func TestPostgres(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		test func(leakybucket.Storage) func(*testing.T)
+		opts []Option
+	}{
+		{"Create", test.CreateTest, nil},
+		{"Add", test.AddTest, nil},
+		{"ThreadSafeAdd", test.ThreadSafeAddTest, nil},
+		{"Reset", test.AddResetTest, nil},
+		{"FindOrCreate", test.FindOrCreateTest, nil},
+		{"BucketInstanceConsistency", test.BucketInstanceConsistencyTest, nil},
+		{"ConfigMismatch", test.ConfigMismatchTest, nil},
+		{"Reconfigure", test.ReconfigureTest, []Option{WithReconfigure()}},
+		{"UpdateLimits", test.UpdateLimitsTest, nil},
+		{"UpdateLimitsProportional", test.UpdateLimitsProportionalTest,
+			[]Option{WithUsageMode(leakybucket.UsageProportional)}},
+		{"Release", test.ReleaseTest, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(postgresStorage(t, postgresDB(t), c.opts...))(t)
+		})
+	}
+	t.Run("ClockSkew", func(t *testing.T) {
+		db := postgresDB(t)
+		fast := postgresStorage(t, db, WithSkewTolerance(3*time.Second), WithClock(func() time.Time {
+			return time.Now().Add(2 * time.Second)
+		}))
+		slow := postgresStorage(t, db, WithSkewTolerance(3*time.Second))
+		test.ClockSkewTest(fast, slow)(t)
+	})
+	t.Run("DeleteExpired", func(t *testing.T) {
+		s := postgresStorage(t, postgresDB(t))
+		_, err := s.Create("short", 10, time.Millisecond)
+		require.NoError(t, err)
+		_, err = s.Create("long", 10, time.Minute)
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+
+		deleted, err := s.DeleteExpired(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, int64(1), deleted)
+	})
+}
+
+func TestCreate(t *testing.T) {
+	test.CreateTest(testStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	test.AddTest(testStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	test.ThreadSafeAddTest(testStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	test.AddResetTest(testStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	test.FindOrCreateTest(testStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	test.BucketInstanceConsistencyTest(testStorage(t))(t)
+}
+
+func TestConfigMismatch(t *testing.T) {
+	test.ConfigMismatchTest(testStorage(t))(t)
+}
+
+func TestReconfigure(t *testing.T) {
+	test.ReconfigureTest(testStorage(t, WithReconfigure()))(t)
+}
+
+func TestUpdateLimits(t *testing.T) {
+	test.UpdateLimitsTest(testStorage(t))(t)
+}
+
+func TestUpdateLimitsProportional(t *testing.T) {
+	test.UpdateLimitsProportionalTest(testStorage(t, WithUsageMode(leakybucket.UsageProportional)))(t)
+}
+
+func TestRelease(t *testing.T) {
+	test.ReleaseTest(testStorage(t))(t)
+}
+
+func TestClockSkew(t *testing.T) {
+	db := testDB(t)
+	fast, err := New(db, SQLite, WithSkewTolerance(3*time.Second), WithClock(func() time.Time {
+		return time.Now().Add(2 * time.Second)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, fast.Migrate(context.Background()))
+	slow, err := New(db, SQLite, WithSkewTolerance(3*time.Second))
+	require.NoError(t, err)
+	test.ClockSkewTest(fast, slow)(t)
+}
+
+// package specific tests
+func TestMigrate(t *testing.T) {
+	db := testDB(t)
+	s, err := New(db, SQLite, WithTable("buckets"))
+	require.NoError(t, err)
+	require.NoError(t, s.Migrate(context.Background()))
+	// migrating again is a no-op
+	require.NoError(t, s.Migrate(context.Background()))
+
+	var versions int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM buckets_migrations").Scan(&versions))
+	require.Equal(t, len(migrations), versions)
+
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	_, err = bucket.Add(1)
+	require.NoError(t, err)
+}
+
+func TestInvalidTable(t *testing.T) {
+	_, err := New(testDB(t), SQLite, WithTable("buckets; DROP TABLE users"))
+	require.Error(t, err)
+}
+
+func TestMigrations(t *testing.T) {
+	statements := Migrations(Postgres, "buckets")
+	require.Len(t, statements, len(migrations))
+	require.Contains(t, statements[0], "CREATE TABLE IF NOT EXISTS buckets (")
+
+	require.Contains(t, Postgres.statement("buckets", addStatement), "VALUES ($1, $2, $3, $4, $6)")
+	require.Contains(t, SQLite.statement("buckets", addStatement), "VALUES (?1, ?2, ?3, ?4, ?6)")
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s := testStorage(t)
+	_, err := s.Create("short", 10, time.Millisecond)
+	require.NoError(t, err)
+	_, err = s.Create("long", 10, time.Minute)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	deleted, err := s.DeleteExpired(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	s := testStorage(t)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	require.NoError(t, err)
+	state, err := bucket.Add(11)
+	require.Equal(t, leakybucket.ErrorFull, err)
+	require.Equal(t, uint(10), state.Remaining)
+}
@@ -2,13 +2,15 @@
 package test
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/Clever/leakybucket"
+	"github.com/Clever/leakybucket/v2"
 
 	"github.com/stretchr/testify/require"
 )
@@ -106,8 +108,8 @@ func compareBuckets(a, b leakybucket.Bucket) error {
 }
 
 // FindOrCreateTest returns a test that the Create function is essentially a FindOrCreate: if you
-// create one bucket, wait some time, and create another bucket with the same name, all the
-// properties should be the same.
+// create one bucket, wait some time, and create another bucket with the same name and
+// configuration, all the properties should be the same.
 // It is meant to be used by leakybucket implementers who wish to test this.
 func FindOrCreateTest(s leakybucket.Storage) func(*testing.T) {
 	return func(t *testing.T) {
@@ -123,7 +125,7 @@ func FindOrCreateTest(s leakybucket.Storage) func(*testing.T) {
 
 		time.Sleep(time.Second * 2)
 
-		bucket2, err := s.Create("testbucket", 10, time.Second)
+		bucket2, err := s.Create("testbucket", 10, time.Minute)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -135,6 +137,211 @@ func FindOrCreateTest(s leakybucket.Storage) func(*testing.T) {
 	}
 }
 
+// ConfigMismatchTest returns a test that creating an existing bucket with a different capacity or
+// rate fails with leakybucket.ErrConfigMismatch.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ConfigMismatchTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Some leakybucket implementations don't persist the bucket until Add is called.
+		if _, err := bucket.Add(1); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			capacity uint
+			rate     time.Duration
+		}{{10, time.Second}, {20, time.Minute}} {
+			_, err := s.Create("testbucket", c.capacity, c.rate)
+			if !errors.Is(err, leakybucket.ErrConfigMismatch) {
+				t.Fatalf("expected ErrConfigMismatch creating with capacity %d and rate %s, received %v",
+					c.capacity, c.rate, err)
+			}
+			var mismatch *leakybucket.ConfigMismatchError
+			require.True(t, errors.As(err, &mismatch))
+			require.Equal(t, uint(10), mismatch.Capacity)
+			require.Equal(t, time.Minute, mismatch.Rate)
+		}
+
+		// other buckets are unaffected
+		if _, err := s.Create("otherbucket", 20, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ReconfigureTest returns a test that creating an existing bucket with a different capacity
+// applies the new capacity while keeping the space already used. The storage must be configured
+// to reconfigure buckets rather than return leakybucket.ErrConfigMismatch.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ReconfigureTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket1, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket1.Add(4); err != nil {
+			t.Fatal(err)
+		}
+
+		bucket2, err := s.Create("testbucket", 20, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(20), bucket2.Capacity())
+		require.Equal(t, uint(16), bucket2.Remaining())
+
+		state, err := bucket2.Add(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(20), state.Capacity)
+		require.Equal(t, uint(15), state.Remaining)
+	}
+}
+
+// UpdateLimitsTest returns a test that UpdateLimits changes the limits of a bucket immediately,
+// keeping the amount already used and the start of the bucket's window. The storage must be a
+// leakybucket.LimitUpdater using leakybucket.UsageAbsolute.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func UpdateLimitsTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := bucket.Add(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		updated, err := leakybucket.UpdateLimits(s, "testbucket", 20, 2*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(20), updated.Capacity)
+		require.Equal(t, uint(16), updated.Remaining)
+		e := float64(1 * time.Second) // margin of error
+		if error := float64(updated.Reset.Sub(state.Reset.Add(time.Minute))); math.Abs(error) > e {
+			t.Fatalf("expected reset time close to %s, got %s", state.Reset.Add(time.Minute), updated.Reset)
+		}
+
+		// the bucket now has to be created with the new limits
+		if _, err := s.Create("testbucket", 10, time.Minute); !errors.Is(err, leakybucket.ErrConfigMismatch) {
+			t.Fatalf("expected ErrConfigMismatch, received %v", err)
+		}
+		bucket, err = s.Create("testbucket", 20, 2*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket.Reset().Unix() != updated.Reset.Unix() {
+			t.Fatalf("expected reset %#v, got %#v", updated.Reset.Unix(), bucket.Reset().Unix())
+		}
+		state, err = bucket.Add(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(0), state.Remaining)
+
+		// shortening the rate drains buckets whose window is over under the new rate
+		bucket, err = s.Create("otherbucket", 5, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(5); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+		updated, err = leakybucket.UpdateLimits(s, "otherbucket", 5, 500*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(5), updated.Remaining)
+		bucket, err = s.Create("otherbucket", 5, 500*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// UpdateLimitsProportionalTest returns a test that UpdateLimits keeps the fraction of a bucket's
+// capacity used. The storage must be a leakybucket.LimitUpdater using
+// leakybucket.UsageProportional.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func UpdateLimitsProportionalTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(4); err != nil {
+			t.Fatal(err)
+		}
+
+		updated, err := leakybucket.UpdateLimits(s, "testbucket", 20, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(20), updated.Capacity)
+		require.Equal(t, uint(12), updated.Remaining)
+
+		updated, err = leakybucket.UpdateLimits(s, "testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(5), updated.Capacity)
+		require.Equal(t, uint(3), updated.Remaining)
+	}
+}
+
+// ClockSkewTest returns a test that two clients of the same backend agree on the state of a bucket
+// when their clocks disagree. The clock of fast must run about two seconds ahead of slow's, and
+// backends that tolerate skew instead of avoiding it must tolerate no more than three seconds.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ClockSkewTest(fast, slow leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		// the bucket drains sooner than the clocks are apart
+		slowBucket, err := slow.Create("testbucket", 5, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := slowBucket.Add(5); err != nil {
+			t.Fatal(err)
+		}
+
+		fastBucket, err := fast.Create("testbucket", 5, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fastBucket.Add(1); err != leakybucket.ErrorFull {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+		if err := compareBucketTimes(slowBucket, fastBucket); err != nil {
+			t.Fatal(err)
+		}
+
+		// once the bucket drained, both clients share its next window
+		time.Sleep(4500 * time.Millisecond)
+		if _, err := slowBucket.Add(1); err != nil {
+			t.Fatal(err)
+		}
+		state, err := fastBucket.Add(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, uint(3), state.Remaining)
+		if err := compareBucketTimes(slowBucket, fastBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 // ThreadSafeAddTest returns a test that adding to a single bucket is thread-safe.
 // It is meant to be used by leakybucket implementers who wish to test this.
 func ThreadSafeAddTest(s leakybucket.Storage) func(*testing.T) {
@@ -204,6 +411,38 @@ func ThreadSafeAddTest(s leakybucket.Storage) func(*testing.T) {
 	}
 }
 
+// ThreadSafeCreateTest returns a test that buckets can be created and added to concurrently, all
+// of them sharing the state of the bucket.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ThreadSafeCreateTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		n := 100
+		var wg sync.WaitGroup
+		var added atomic.Int32
+		for i := 0; i < 2*n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				bucket, err := s.Create("testbucket", uint(n), time.Minute)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_, err = bucket.Add(1)
+				if err == nil {
+					added.Add(1)
+				} else if err != leakybucket.ErrorFull {
+					t.Errorf("got an error that is not ErrorFull: %s", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if got := added.Load(); got != int32(n) {
+			t.Errorf("added %d times to a bucket of capacity %d", got, n)
+		}
+	}
+}
+
 // BucketInstanceConsistencyTest returns a test that two instances of a leakybucket pointing to the
 // same remote bucket keep consistent state with the remote.
 func BucketInstanceConsistencyTest(s leakybucket.Storage) func(*testing.T) {
@@ -267,3 +506,46 @@ func BucketInstanceConsistencyTest(s leakybucket.Storage) func(*testing.T) {
 		}
 	}
 }
+
+// ReleaseTest returns a test that buckets give back space released from their current window, and
+// only from it. The buckets of the storage must be leakybucket.Releasers.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ReleaseTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Second)
+		require.NoError(t, err)
+		releaser, ok := bucket.(leakybucket.Releaser)
+		require.True(t, ok, "expected the bucket to be a leakybucket.Releaser")
+
+		state, err := bucket.Add(6)
+		require.NoError(t, err)
+		window := state.Reset
+
+		state, err = releaser.Release(4, window)
+		require.NoError(t, err)
+		require.Equal(t, uint(8), state.Remaining)
+		require.Equal(t, uint(8), bucket.Remaining())
+
+		// only what was added can be released
+		state, err = releaser.Release(10, window)
+		require.NoError(t, err)
+		require.Equal(t, uint(10), state.Remaining)
+
+		state, err = bucket.Add(3)
+		require.NoError(t, err)
+		require.Equal(t, uint(7), state.Remaining)
+
+		// releasing from another window leaves the bucket alone
+		state, err = releaser.Release(3, window.Add(-time.Minute))
+		require.NoError(t, err)
+		require.Equal(t, uint(7), state.Remaining)
+
+		time.Sleep(2 * time.Second)
+		state, err = bucket.Add(1)
+		require.NoError(t, err)
+		require.Equal(t, uint(9), state.Remaining)
+		state, err = releaser.Release(1, window)
+		require.NoError(t, err)
+		require.Equal(t, uint(9), state.Remaining)
+	}
+}
@@ -0,0 +1,36 @@
+package leakybucket
+
+import (
+	"context"
+	"time"
+)
+
+// Wait adds amount to b, waiting for b to drain whenever it's full. It gives up with ErrorFull if
+// amount exceeds the capacity of b, or once b would drain more than maxWait after Wait was called,
+// and with ctx's error once ctx is done. It returns the state of b after the last add.
+func Wait(ctx context.Context, b Bucket, amount uint, maxWait time.Duration) (BucketState, error) {
+	return WaitFunc(ctx, amount, maxWait, func(ctx context.Context, amount uint) (BucketState, error) {
+		return AddContext(ctx, b, amount)
+	})
+}
+
+// WaitFunc is Wait for a bucket added to by add, e.g. to create the bucket anew before every add.
+func WaitFunc(ctx context.Context, amount uint, maxWait time.Duration, add func(ctx context.Context, amount uint) (BucketState, error)) (BucketState, error) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		state, err := add(ctx, amount)
+		if err != ErrorFull {
+			return state, err
+		}
+		if state.Reset.After(deadline) || amount > state.Capacity {
+			return state, err
+		}
+		timer := time.NewTimer(time.Until(state.Reset))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return state, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
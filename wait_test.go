@@ -0,0 +1,40 @@
+package leakybucket_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Clever/leakybucket/v2"
+	"github.com/Clever/leakybucket/v2/memory"
+)
+
+func TestWait(t *testing.T) {
+	bucket, err := memory.New().Create("wait", 1, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leakybucket.Wait(context.Background(), bucket, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	// full until the bucket drains
+	if _, err := leakybucket.Wait(context.Background(), bucket, 1, 0); err != leakybucket.ErrorFull {
+		t.Fatalf("expected ErrorFull, got %v", err)
+	}
+	start := time.Now()
+	if _, err := leakybucket.Wait(context.Background(), bucket, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Fatalf("expected to wait for the bucket to drain, waited %s", waited)
+	}
+	// never fits
+	if _, err := leakybucket.Wait(context.Background(), bucket, 2, time.Second); err != leakybucket.ErrorFull {
+		t.Fatalf("expected ErrorFull, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := leakybucket.Wait(ctx, bucket, 1, time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context's error, got %v", err)
+	}
+}